@@ -0,0 +1,147 @@
+package capture
+
+import (
+	"auditnozzle/firehose"
+	"auditnozzle/scanengine"
+	"fmt"
+	"github.com/cloudfoundry/sonde-go/events"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+/********************************************************************************************************
+* Writes every envelope to a capture file, which can later be fed to any scanner with replay=<file>
+ */
+
+// Each run has its own capture
+type Capture struct {
+	CaptureScan   scanengine.ScanEngine
+	CaptureWriter *firehose.CaptureWriter
+	CaptureErr    error
+	CaptureMutex  sync.Mutex
+}
+
+// A new run's empty capture
+func New(f *firehose.Foundation) *Capture {
+	c := &Capture{CaptureScan: scanengine.ScanEngine{Name: "Capture", Foundation: f}}
+	c.CaptureScan.SeriesColumns = []scanengine.SeriesColumn{{Name: "bytes"}}
+	return c
+}
+
+func (c *Capture) Engine() *scanengine.ScanEngine {
+	return &c.CaptureScan
+}
+
+var Scanner = scanengine.Scanner{
+	Name:    "capture",
+	Measure: "capture",
+	Params:  "<file (default capture-<foundation>-<time>.pb)>",
+	Reports: []scanengine.Report{
+		{Route: "reportcapture", Params: "<series (default no)>", Write: func(r scanengine.Results, req *http.Request, res io.Writer) {
+			r.(*Capture).ReportCapture(res)
+			r.Engine().WriteSeries(res, scanengine.BoolParm(req, "series", false))
+		}},
+	},
+	New: func(f *firehose.Foundation) scanengine.Results { return New(f) },
+	Start: func(r scanengine.Results, req *http.Request, res io.Writer) error {
+		return r.(*Capture).StartCapture(req, res)
+	},
+}
+
+func (c *Capture) ResetData() {
+	c.CaptureScan.Reset()
+}
+
+// The default file name includes the foundation, so captures from different foundations can be told apart
+func (c *Capture) StartCapture(req *http.Request, res io.Writer) error {
+
+	name := req.FormValue("file")
+	if name == "" {
+		name = "capture-" + c.CaptureScan.Foundation.Name + "-" + time.Now().UTC().Format("20060102-150405") + ".pb"
+	}
+
+	c.CaptureMutex.Lock()
+	defer c.CaptureMutex.Unlock()
+
+	if err := c.CaptureScan.Start(req, res); err != nil {
+		return err
+	}
+
+	writer, err := firehose.CreateCapture(name)
+	if err != nil {
+		fmt.Fprintln(res, err)
+		c.CaptureScan.Stop()
+		return err
+	}
+
+	c.CaptureWriter = writer
+	c.CaptureErr = nil
+	fmt.Fprintf(res, "capturing to %s\n", writer.Name)
+
+	go func() {
+		c.CaptureScan.Run(c.CaptureIterator)
+
+		c.CaptureMutex.Lock()
+		if err := writer.Close(); err != nil && c.CaptureErr == nil {
+			c.CaptureErr = err
+		}
+		c.CaptureMutex.Unlock()
+	}()
+	return nil
+}
+
+func (c *Capture) CaptureIterator(msg *events.Envelope) bool {
+
+	c.CaptureMutex.Lock()
+	defer c.CaptureMutex.Unlock()
+
+	if c.CaptureErr != nil {
+		return false
+	}
+
+	// a bad envelope is skipped and counted. A full disk stops the capture being written, but the scan
+	// carries on so the status shows why
+	if err := c.CaptureWriter.Write(msg, c.CaptureScan.MessageTime()); err != nil {
+		if _, skipped := err.(*firehose.MarshalError); skipped {
+			return false
+		}
+		c.CaptureErr = err
+		fmt.Fprintf(os.Stderr, "capture %s: %v\n", c.CaptureWriter.Name, err)
+		return false
+	}
+	c.CaptureScan.Record(0, msg.Size())
+	return true
+}
+
+/******************************************************************************************/
+
+func (c *Capture) ReportCapture(ow io.Writer) {
+
+	c.CaptureScan.WriteStatus(ow)
+
+	c.CaptureMutex.Lock()
+	if c.CaptureWriter != nil {
+		fmt.Fprintf(ow, "%s: %d envelopes, %d bytes\n", c.CaptureWriter.Name, c.CaptureWriter.Count, c.CaptureWriter.Bytes)
+		if c.CaptureWriter.Skipped > 0 {
+			fmt.Fprintf(ow, "%d envelopes skipped, they don't marshal\n", c.CaptureWriter.Skipped)
+		}
+	}
+	if c.CaptureErr != nil {
+		fmt.Fprintf(ow, "capture failed: %v\n", c.CaptureErr)
+	}
+	c.CaptureMutex.Unlock()
+
+	files, err := firehose.CaptureFiles()
+	if err != nil {
+		fmt.Fprintln(ow, err)
+		return
+	}
+
+	fmt.Fprintln(ow, "Capture files:")
+	for _, f := range files {
+		fmt.Fprintf(ow, "%12d %s %s\n", f.Size(), f.ModTime().Format(time.RFC3339), f.Name())
+	}
+}
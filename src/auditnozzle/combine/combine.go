@@ -0,0 +1,208 @@
+package combine
+
+import (
+	"auditnozzle/countlogs"
+	"auditnozzle/counttags"
+	"auditnozzle/firehose"
+	"auditnozzle/helpers"
+	"auditnozzle/latency"
+	"auditnozzle/loglength"
+	"auditnozzle/scanengine"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+/********************************************************************************************************
+* When the app is scaled to several instances sharing a firehose subscription, each instance only sees its
+* share of the envelopes. /export hands out one instance's raw results, and /combine collects the export from
+* every instance (addressing each one through the gorouter with X-CF-APP-INSTANCE) and reports the sum.
+*
+* The metric audit can't be combined: an instance only sees some of the messages for each metric, so the
+* intervals it measures don't mean anything once the subscription is sharded. Sampled runs aren't exported
+* either, the sums would mix counts scaled by different fractions
+ */
+
+type VcapApplication struct {
+	ApplicationId   string   `json:"application_id"`
+	ApplicationUris []string `json:"application_uris"`
+	InstanceIndex   int      `json:"instance_index"`
+}
+
+var exports = map[string]func(*firehose.Foundation) interface{}{
+	"logs":    func(f *firehose.Foundation) interface{} { return countlogs.For(f).Snapshot() },
+	"tags":    func(f *firehose.Foundation) interface{} { return counttags.For(f).Snapshot() },
+	"latency": func(f *firehose.Foundation) interface{} { return latency.For(f).Snapshot() },
+	"loghist": func(f *firehose.Foundation) interface{} { return loglength.For(f).Snapshot() },
+}
+
+/******************************************************************************************/
+
+func Export(req *http.Request, res http.ResponseWriter) {
+
+	export, ok := exports[req.FormValue("scanner")]
+	if !ok {
+		http.Error(res, "scanner= must be one of logs, tags, latency, loghist", http.StatusBadRequest)
+		return
+	}
+
+	foundation, err := firehose.FoundationFromRequest(req)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if run := scanengine.LatestRun(req.FormValue("scanner"), foundation); run != nil && run.Results.Engine().Sampled() {
+		http.Error(res, "run "+run.ID+" was sampled, only unsampled runs can be combined", http.StatusConflict)
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(res).Encode(export(foundation))
+}
+
+func Combine(req *http.Request, res io.Writer) {
+
+	scanner := req.FormValue("report")
+	if _, ok := exports[scanner]; !ok {
+		fmt.Fprintln(res, "report= must be one of logs, tags, latency, loghist")
+		return
+	}
+
+	foundation, err := firehose.FoundationFromRequest(req)
+	if err != nil {
+		fmt.Fprintln(res, err)
+		return
+	}
+
+	bodies, err := FetchExports(scanner, foundation.Name, req.FormValue("instances"))
+	if err != nil {
+		fmt.Fprintln(res, err)
+		return
+	}
+
+	fmt.Fprintf(res, "Combined %s report for %s from %d instances\n", scanner, foundation.Name, len(bodies))
+
+	switch scanner {
+	case "logs":
+		var snapshots []countlogs.LogsSnapshot
+		if err := decodeAll(bodies, &snapshots); err != nil {
+			fmt.Fprintln(res, err)
+			return
+		}
+		if scanengine.BoolParm(req, "byorg", false) {
+			countlogs.ReportLogsByOrgCombined(res, snapshots, scanengine.BoolParm(req, "showguid", false))
+		} else {
+			countlogs.ReportCountedLogsCombined(res, snapshots, scanengine.BoolParm(req, "showguid", false))
+		}
+
+	case "tags":
+		var snapshots []counttags.TagsSnapshot
+		if err := decodeAll(bodies, &snapshots); err != nil {
+			fmt.Fprintln(res, err)
+			return
+		}
+		counttags.ReportCountedTagsCombined(res, snapshots, scanengine.BoolParm(req, "showjobs", false))
+
+	case "latency", "loghist":
+		var snapshots []helpers.HistogramData
+		if err := decodeAll(bodies, &snapshots); err != nil {
+			fmt.Fprintln(res, err)
+			return
+		}
+		if scanner == "latency" {
+			latency.ReportLatencyCombined(res, snapshots)
+		} else {
+			loglength.ReportLogHistogramCombined(res, snapshots)
+		}
+	}
+}
+
+/******************************************************************************************/
+
+// The instance count comes from the instances= parameter, or from the cloud controller if the default
+// foundation's firehose has been opened (and so there is a client to ask). The nozzle is assumed to be
+// pushed to its default foundation
+func FetchExports(scanner, foundation string, instancesParm string) ([][]byte, error) {
+
+	var vcap VcapApplication
+	if err := json.Unmarshal([]byte(os.Getenv("VCAP_APPLICATION")), &vcap); err != nil || len(vcap.ApplicationUris) == 0 {
+		return nil, errors.New("combine needs VCAP_APPLICATION with a route, only available when running on Cloud Foundry")
+	}
+
+	instances, err := strconv.Atoi(instancesParm)
+	if err != nil || instances < 1 {
+		client := firehose.DefaultFoundation().Client()
+		if client == nil {
+			return nil, errors.New("set instances= to the number of app instances")
+		}
+		app, err := client.AppByGuid(vcap.ApplicationId)
+		if err != nil {
+			return nil, fmt.Errorf("unable to find instance count, set instances=: %v", err)
+		}
+		instances = app.Instances
+	}
+
+	skipSSLValidation, _ := strconv.ParseBool(os.Getenv("SKIP_SSL_VALIDATION"))
+	client := &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: skipSSLValidation}},
+	}
+
+	var bodies [][]byte
+
+	for i := 0; i < instances; i++ {
+		body, err := fetchExport(client, vcap, i, scanner, foundation)
+		if err != nil {
+			return nil, fmt.Errorf("instance %d: %v", i, err)
+		}
+		bodies = append(bodies, body)
+	}
+	return bodies, nil
+}
+
+func fetchExport(client *http.Client, vcap VcapApplication, index int, scanner, foundation string) ([]byte, error) {
+
+	query := url.Values{}
+	query.Set("scanner", scanner)
+	query.Set("foundation", foundation)
+
+	req, err := http.NewRequest("GET", "https://"+vcap.ApplicationUris[0]+"/export?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-CF-APP-INSTANCE", fmt.Sprintf("%s:%d", vcap.ApplicationId, index))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("export returned %s", resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// decode each body as one element of the slice pointed to by list
+func decodeAll(bodies [][]byte, list interface{}) error {
+	var raw []json.RawMessage
+	for _, b := range bodies {
+		raw = append(raw, json.RawMessage(b))
+	}
+
+	all, err := json.Marshal(raw)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(all, list)
+}
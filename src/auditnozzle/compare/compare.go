@@ -0,0 +1,135 @@
+package compare
+
+import (
+	"auditnozzle/countlogs"
+	"auditnozzle/firehose"
+	"auditnozzle/latency"
+	"auditnozzle/metricparser"
+	"auditnozzle/scanengine"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+/********************************************************************************************************
+* Puts the results from several foundations side by side, e.g. to check that a staging upgrade behaves like
+* production before rolling it out. /measurecompare starts the same scan, with the same parameters, on each
+* foundation at once, and /compare reports each foundation's latest run. The first foundation listed is the
+* one the others are compared against
+ */
+
+var reports = []string{"metrics", "logs", "latency"}
+
+/******************************************************************************************/
+
+func MeasureCompare(req *http.Request, res io.Writer) {
+
+	foundations, err := Foundations(req)
+	if err != nil {
+		fmt.Fprintln(res, err)
+		return
+	}
+
+	name := req.FormValue("scanner")
+	scanner, ok := scanengine.LookupScanner(name)
+	if !ok || !isReport(name) {
+		fmt.Fprintln(res, "scanner= must be one of "+strings.Join(reports, ", "))
+		return
+	}
+
+	// a new run on each foundation, which /compare reports as the foundation's latest
+	for _, f := range foundations {
+		fmt.Fprintf(res, "%s: ", f.Name)
+		scanengine.NewRun(scanner, f, req, res)
+	}
+}
+
+// report=metrics|logs|latency, all three without it
+func Compare(req *http.Request, res io.Writer) {
+
+	foundations, err := Foundations(req)
+	if err != nil {
+		fmt.Fprintln(res, err)
+		return
+	}
+
+	var names []string
+	for _, f := range foundations {
+		names = append(names, f.Name)
+	}
+
+	report := req.FormValue("report")
+	if report != "" && !isReport(report) {
+		fmt.Fprintln(res, "report= must be one of "+strings.Join(reports, ", "))
+		return
+	}
+
+	if report == "" || report == "metrics" {
+		fmt.Fprintf(res, "\n===============> Metric intervals, %s\n", strings.Join(names, " vs "))
+		var audits []*metricparser.MetricAudit
+		for _, f := range foundations {
+			audits = append(audits, metricparser.For(f))
+		}
+		metricparser.ReportMetricComparison(res, names, audits)
+	}
+
+	if report == "" || report == "logs" {
+		fmt.Fprintf(res, "\n===============> Log rates, %s\n", strings.Join(names, " vs "))
+		var counts []*countlogs.LogCounts
+		for _, f := range foundations {
+			counts = append(counts, countlogs.For(f))
+		}
+		countlogs.ReportLogComparison(res, names, counts)
+	}
+
+	if report == "" || report == "latency" {
+		fmt.Fprintf(res, "\n===============> Envelope latency (ms), %s\n", strings.Join(names, " vs "))
+		var latencies []*latency.Latency
+		for _, f := range foundations {
+			latencies = append(latencies, latency.For(f))
+		}
+		latency.ReportLatencyComparison(res, names, latencies)
+	}
+}
+
+/******************************************************************************************/
+
+// foundations=<name>,<name>... or every configured foundation, default first
+func Foundations(req *http.Request) ([]*firehose.Foundation, error) {
+
+	var list []*firehose.Foundation
+
+	parm := req.FormValue("foundations")
+	if parm == "" {
+		def := firehose.DefaultFoundation()
+		list = append(list, def)
+		for _, f := range firehose.Foundations() {
+			if f != def {
+				list = append(list, f)
+			}
+		}
+	} else {
+		for _, name := range strings.Split(parm, ",") {
+			f, err := firehose.LookupFoundation(strings.TrimSpace(name))
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, f)
+		}
+	}
+
+	if len(list) < 2 {
+		return nil, fmt.Errorf("need at least two foundations to compare, have %d", len(list))
+	}
+	return list, nil
+}
+
+func isReport(name string) bool {
+	for _, r := range reports {
+		if r == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,214 @@
+package countlogs
+
+import (
+	"fmt"
+	"github.com/cloudfoundry/sonde-go/events"
+	"strings"
+)
+
+/********************************************************************************************************
+* The Metron, Doppler and Diego log counters carry a running total and the delta since the sender's envelope
+* before. Each counter is followed by origin, job, index and name, and each envelope is checked against the
+* last total seen:
+*
+*   total up by the delta         the next envelope
+*   total up by more              a gap, envelopes were lost and the difference is their missed delta
+*   total the same                a duplicate if it carries a delta or the same timestamp, else no change
+*   total down, earlier time      out of order, an envelope that arrived after later ones. Its delta is
+*                                 taken off what was missed in the gap its total falls in, and a gap late
+*                                 envelopes have made up in full is no longer counted
+*   total down by overflowing     the counter wrapped around, the delta is counted
+*   total down otherwise          the sender restarted and its counter began again from zero, so the new
+*                                 total is counted; a total above the delta means envelopes since the restart
+*                                 were lost too
+*
+* Without timestamps, a lower total that isn't a fresh start (total and delta the same) and isn't below the
+* run's first total is taken to be out of order
+ */
+
+type CounterKey struct {
+	Origin string
+	Job    string
+	Index  string
+	Name   string
+}
+
+// e.g. doppler/0
+func (k CounterKey) Instance() string {
+	return k.Job + "/" + k.Index
+}
+
+type Counter struct {
+	First      uint64 // the first total the run saw
+	Last       uint64 // the latest total
+	Increase   uint64 // since First, over restarts and wraps
+	Envelopes  int
+	Gaps       int
+	Missed     uint64 // the delta of the envelopes lost in the gaps, less what late envelopes made up
+	Restarts   int
+	Wraps      int
+	Duplicates int
+	OutOfOrder int
+
+	lastTime int64
+	open     []missedRange // the gaps not made up yet
+}
+
+// The totals of the envelopes lost in a gap, above from up to to, and the delta still missing from them
+type missedRange struct {
+	from, to uint64
+	missed   uint64
+}
+
+// The counters of one metric, such as Metron's sent envelopes, for every instance. The caller locks
+type CounterTracker struct {
+	counters map[CounterKey]*Counter
+}
+
+// Every instance added up. First and Last aren't, they only mean something for one instance
+type CounterSum struct {
+	Counter
+	Instances int
+}
+
+/******************************************************************************************/
+
+func (c *Counter) Add(total, delta uint64, timestamp int64) {
+	c.Envelopes++
+
+	// what the sender counted before the run's first envelope is outside the scan window
+	if c.Envelopes == 1 {
+		c.First, c.Last, c.lastTime = total, total, timestamp
+		return
+	}
+
+	last := c.Last
+	switch {
+	case total > last:
+		c.Increase += total - last
+		if last+delta < total {
+			c.gap(last, total-delta)
+		}
+
+	case total == last:
+		if delta > 0 || (timestamp != 0 && timestamp == c.lastTime) {
+			c.Duplicates++
+			return
+		}
+
+	// total is below last, so last+delta overflowed to reach it
+	case delta > 0 && last+delta == total:
+		c.Wraps++
+		c.Increase += delta
+
+	case c.older(total, delta, timestamp):
+		c.OutOfOrder++
+		c.madeUp(total, delta)
+		return
+
+	default:
+		c.Restarts++
+		c.Increase += total
+		if total > delta {
+			c.gap(0, total-delta)
+		}
+	}
+
+	c.Last, c.lastTime = total, timestamp
+}
+
+func (c *Counter) gap(from, to uint64) {
+	c.Gaps++
+	c.Missed += to - from
+	c.open = append(c.open, missedRange{from, to, to - from})
+}
+
+// A late envelope makes up its delta of the gap its total falls in, which is closed once all of it is made up
+func (c *Counter) madeUp(total, delta uint64) {
+	for i := range c.open {
+		r := &c.open[i]
+		if total <= r.from || total > r.to {
+			continue
+		}
+		if delta > r.missed {
+			delta = r.missed
+		}
+		r.missed -= delta
+		c.Missed -= delta
+		if r.missed == 0 {
+			c.Gaps--
+			c.open = append(c.open[:i], c.open[i+1:]...)
+		}
+		return
+	}
+}
+
+// Whether a lower total is an envelope sent before the last one
+func (c *Counter) older(total, delta uint64, timestamp int64) bool {
+	if timestamp != 0 && c.lastTime != 0 {
+		return timestamp < c.lastTime
+	}
+	return total != delta && total >= c.First
+}
+
+// e.g. 2 gaps missed 40, 1 restarts; empty for a counter without any of them
+func (c Counter) Problems() string {
+	var problems []string
+	if c.Gaps > 0 {
+		problems = append(problems, fmt.Sprintf("%d gaps missed %d", c.Gaps, c.Missed))
+	}
+	for _, p := range []struct {
+		n    int
+		name string
+	}{{c.Restarts, "restarts"}, {c.Wraps, "wraps"}, {c.Duplicates, "duplicates"}, {c.OutOfOrder, "out of order"}} {
+		if p.n > 0 {
+			problems = append(problems, fmt.Sprintf("%d %s", p.n, p.name))
+		}
+	}
+	return strings.Join(problems, ", ")
+}
+
+/******************************************************************************************/
+
+func NewCounterTracker() *CounterTracker {
+	return &CounterTracker{counters: make(map[CounterKey]*Counter)}
+}
+
+func (t *CounterTracker) Add(msg *events.Envelope) {
+	event := msg.GetCounterEvent()
+	key := CounterKey{msg.GetOrigin(), msg.GetJob(), msg.GetIndex(), event.GetName()}
+
+	c, ok := t.counters[key]
+	if !ok {
+		c = &Counter{}
+		t.counters[key] = c
+	}
+	c.Add(event.GetTotal(), event.GetDelta(), msg.GetTimestamp())
+}
+
+// Copied, so they can be read after the lock is released. The open gaps are left out, only Add needs them
+func (t *CounterTracker) Counters() map[CounterKey]Counter {
+	counters := make(map[CounterKey]Counter)
+	for key, c := range t.counters {
+		counter := *c
+		counter.open = nil
+		counters[key] = counter
+	}
+	return counters
+}
+
+func (t *CounterTracker) Sum() CounterSum {
+	var sum CounterSum
+	for _, c := range t.counters {
+		sum.Instances++
+		sum.Increase += c.Increase
+		sum.Envelopes += c.Envelopes
+		sum.Gaps += c.Gaps
+		sum.Missed += c.Missed
+		sum.Restarts += c.Restarts
+		sum.Wraps += c.Wraps
+		sum.Duplicates += c.Duplicates
+		sum.OutOfOrder += c.OutOfOrder
+	}
+	return sum
+}
@@ -0,0 +1,183 @@
+package countlogs
+
+import (
+	"auditnozzle/fakecf"
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var counterTags = map[string]string{"event_type": "LogMessage"}
+
+// The counter envelopes of a script, timestamped a second apart in the order they were sent
+func sent(script fakecf.Script) []*events.Envelope {
+	var envelopes []*events.Envelope
+	for i, step := range script {
+		env := *step.Envelope
+		env.Timestamp = proto.Int64(int64(i+1) * int64(time.Second))
+		envelopes = append(envelopes, &env)
+	}
+	return envelopes
+}
+
+func metron(totals ...uint64) fakecf.Script {
+	return fakecf.Counters("MetronAgent", "router", "0", "dropsondeMarshaller.sentEnvelopes", counterTags, totals, time.Second)
+}
+
+// The envelopes at these positions, in this order
+func reorder(envelopes []*events.Envelope, order ...int) []*events.Envelope {
+	var out []*events.Envelope
+	for _, i := range order {
+		out = append(out, envelopes[i])
+	}
+	return out
+}
+
+func counterEnvelope(total, delta uint64, timestamp int64) *events.Envelope {
+	env := fakecf.NewEnvelope("MetronAgent", "router", "0", events.Envelope_CounterEvent)
+	env.Tags = counterTags
+	env.Timestamp = proto.Int64(timestamp)
+	env.CounterEvent = &events.CounterEvent{
+		Name:  proto.String("dropsondeMarshaller.sentEnvelopes"),
+		Delta: proto.Uint64(delta),
+		Total: proto.Uint64(total),
+	}
+	return env
+}
+
+func TestCounter(t *testing.T) {
+	tests := []struct {
+		name      string
+		envelopes []*events.Envelope
+		want      Counter
+	}{
+		{
+			name:      "steady",
+			envelopes: sent(fakecf.CountersWithGaps("MetronAgent", "router", "0", "dropsondeMarshaller.sentEnvelopes", counterTags, 20, 10, nil, time.Second)),
+			want:      Counter{First: 20, Last: 200, Increase: 180, Envelopes: 10},
+		},
+		{
+			name:      "gaps",
+			envelopes: sent(fakecf.CountersWithGaps("MetronAgent", "router", "0", "dropsondeMarshaller.sentEnvelopes", counterTags, 20, 10, []int{4, 5, 7}, time.Second)),
+			want:      Counter{First: 20, Last: 200, Increase: 180, Envelopes: 7, Gaps: 2, Missed: 60},
+		},
+		{
+			name:      "no change",
+			envelopes: sent(metron(50, 50, 50)),
+			want:      Counter{First: 50, Last: 50, Envelopes: 3},
+		},
+		{
+			name:      "restart",
+			envelopes: sent(metron(100, 200, 300, 10, 20)),
+			want:      Counter{First: 100, Last: 20, Increase: 220, Envelopes: 5, Restarts: 1},
+		},
+		{
+			name:      "restart with envelopes lost after it",
+			envelopes: reorder(sent(metron(100, 200, 10, 20, 30)), 0, 1, 4),
+			want:      Counter{First: 100, Last: 30, Increase: 130, Envelopes: 3, Restarts: 1, Gaps: 1, Missed: 20},
+		},
+		{
+			name:      "duplicate",
+			envelopes: reorder(sent(metron(20, 40, 60)), 0, 1, 1, 2),
+			want:      Counter{First: 20, Last: 60, Increase: 40, Envelopes: 4, Duplicates: 1},
+		},
+		{
+			name:      "duplicate without a delta",
+			envelopes: reorder(sent(metron(20, 20, 40)), 0, 1, 1, 2),
+			want:      Counter{First: 20, Last: 40, Increase: 20, Envelopes: 4, Duplicates: 1},
+		},
+		{
+			name:      "out of order",
+			envelopes: reorder(sent(metron(20, 40, 60, 80)), 0, 2, 1, 3),
+			want:      Counter{First: 20, Last: 80, Increase: 60, Envelopes: 4, OutOfOrder: 1},
+		},
+		{
+			name:      "out of order filling one of two gaps",
+			envelopes: reorder(sent(metron(20, 40, 60, 80, 100, 120)), 0, 2, 3, 5, 1),
+			want:      Counter{First: 20, Last: 120, Increase: 100, Envelopes: 5, Gaps: 1, Missed: 20, OutOfOrder: 1},
+		},
+		{
+			name:      "out of order making up part of a gap",
+			envelopes: reorder(sent(metron(20, 40, 60, 80)), 0, 3, 1),
+			want:      Counter{First: 20, Last: 80, Increase: 60, Envelopes: 3, Gaps: 1, Missed: 20, OutOfOrder: 1},
+		},
+		{
+			name:      "out of order making up all of a gap",
+			envelopes: reorder(sent(metron(20, 40, 60, 80)), 0, 3, 2, 1),
+			want:      Counter{First: 20, Last: 80, Increase: 60, Envelopes: 4, OutOfOrder: 2},
+		},
+		{
+			name:      "out of order after a restart",
+			envelopes: reorder(sent(metron(100, 200, 10, 20)), 0, 1, 3, 2),
+			want:      Counter{First: 100, Last: 20, Increase: 120, Envelopes: 4, Restarts: 1, OutOfOrder: 1},
+		},
+		{
+			name: "wraparound",
+			envelopes: []*events.Envelope{
+				counterEnvelope(math.MaxUint64-15, 10, 1),
+				counterEnvelope(math.MaxUint64-5, 10, 2),
+				counterEnvelope(4, 10, 3),
+				counterEnvelope(14, 10, 4),
+			},
+			want: Counter{First: math.MaxUint64 - 15, Last: 14, Increase: 30, Envelopes: 4, Wraps: 1},
+		},
+		{
+			name: "without timestamps",
+			envelopes: []*events.Envelope{
+				counterEnvelope(100, 10, 0),
+				counterEnvelope(120, 10, 0),
+				counterEnvelope(110, 10, 0),
+				counterEnvelope(5, 5, 0),
+			},
+			want: Counter{First: 100, Last: 5, Increase: 25, Envelopes: 4, OutOfOrder: 1, Restarts: 1},
+		},
+	}
+
+	for _, test := range tests {
+		tracker := NewCounterTracker()
+		for _, env := range test.envelopes {
+			tracker.Add(env)
+		}
+
+		counters := tracker.Counters()
+		if len(counters) != 1 {
+			t.Errorf("%s: %d counters, want 1", test.name, len(counters))
+			continue
+		}
+		for _, got := range counters {
+			got.lastTime = 0
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("%s:\n got %+v\nwant %+v", test.name, got, test.want)
+			}
+		}
+	}
+}
+
+func TestCounterTrackerInstances(t *testing.T) {
+	script := fakecf.Merge(
+		fakecf.Counters("MetronAgent", "router", "0", "dropsondeMarshaller.sentEnvelopes", counterTags, []uint64{10, 20, 30}, time.Second),
+		fakecf.Counters("MetronAgent", "cell", "0", "dropsondeMarshaller.sentEnvelopes", counterTags, []uint64{100, 150, 10}, time.Second),
+		fakecf.CountersWithGaps("MetronAgent", "cell", "1", "dropsondeMarshaller.sentEnvelopes", counterTags, 5, 4, []int{2}, time.Second),
+	)
+
+	tracker := NewCounterTracker()
+	for _, env := range sent(script) {
+		tracker.Add(env)
+	}
+
+	// the same index on another job is another instance
+	sum := tracker.Sum()
+	want := CounterSum{Counter{Increase: 20 + 60 + 15, Envelopes: 9, Gaps: 1, Missed: 5, Restarts: 1}, 3}
+	if !reflect.DeepEqual(sum, want) {
+		t.Errorf("got %+v\nwant %+v", sum, want)
+	}
+
+	counters := tracker.Counters()
+	key := CounterKey{"MetronAgent", "cell", "0", "dropsondeMarshaller.sentEnvelopes"}
+	if c := counters[key]; c.Increase != 60 || c.Restarts != 1 {
+		t.Errorf("%s: got %+v, want an increase of 60 over 1 restart", key.Instance(), c)
+	}
+}
@@ -1,12 +1,15 @@
 package countlogs
 
 import (
+	"auditnozzle/firehose"
 	"auditnozzle/scanengine"
+	"encoding/json"
 	"fmt"
 	"github.com/cloudfoundry/sonde-go/events"
 	"io"
 	"net/http"
 	"sort"
+	"strconv"
 	"sync"
 	"time"
 )
@@ -17,6 +20,12 @@ type LogType struct {
 	name  string
 	src   string
 	count int
+
+	// looked up with the name, empty until then or if the lookup failed
+	space string
+	org   string
+
+	looking bool // the name is being looked up
 }
 
 type LogMapType map[string]*LogType
@@ -35,111 +44,222 @@ func (a LogSliceType) Less(i, j int) bool {
 	return a[i].src < a[j].src
 }
 
-type MetricCount struct {
-	startValue uint64
-	lastValue  uint64
-	nowValue   uint64
-	count      uint64
-	missed     int
-	msgs       int
-}
+// the columns of the time series
+const (
+	seriesLogs = iota
+	seriesAppLogs
+	seriesDropped
+)
 
 /******************************************************************************************/
-var (
-	CountScan            = scanengine.ScanEngine{Name: "Count Logs"}
-	TotalLogsReceived    int
-	TotalAppLogsReceived int
-	TimeLastSample       time.Time
-	CountLastSample      int
-	RateLastSecond       int
-	DroppedMessages      int
 
-	ReadLogsMap = make(LogMapType)
-	MetricMaps  = make(map[string]map[string]*MetricCount)
-	LogMutex    sync.Mutex
-)
+// Each run has its own scan and counts
+type LogCounts struct {
+	CountScan scanengine.ScanEngine
+
+	// guards everything below, the scan's go routine and the name lookups write it while reports read it
+	logMutex             sync.Mutex
+	totalLogsReceived    int
+	totalAppLogsReceived int
+	timeLastSample       time.Time
+	countLastSample      int
+	rateLastSecond       int
+	droppedMessages      int
+
+	readLogsMap LogMapType
+	counters    map[string]*CounterTracker // Metron, Doppler and Diego, see counters.go
+
+	// app=, notapp=, org= and space=, see filter.go. The logs left out are counted
+	filter         LogFilter
+	apps           *appFilter
+	filteredLogs   int
+	unresolvedLogs int
+}
+
+// A new run's empty results
+func New(f *firehose.Foundation) *LogCounts {
+	c := &LogCounts{
+		CountScan:   scanengine.ScanEngine{Name: "Count Logs", Foundation: f},
+		readLogsMap: make(LogMapType),
+		counters:    make(map[string]*CounterTracker),
+	}
+	// the Metron and Doppler counters and Doppler's "Dropped N message(s)" logs carry totals, and are few, so
+	// every one is kept and the dropped messages are exact
+	c.CountScan.Sampleable = func(msg *events.Envelope) bool {
+		return msg.GetEventType() == events.Envelope_LogMessage && msg.GetLogMessage().GetAppId() != "system"
+	}
+	c.CountScan.SeriesColumns = []scanengine.SeriesColumn{{Name: "logs"}, {Name: "APP logs"}, {Name: "dropped", Exact: true}}
+	return c
+}
+
+// The results of the foundation's latest run, empty if there hasn't been one
+func For(f *firehose.Foundation) *LogCounts {
+	if run := scanengine.LatestRun(Scanner.Name, f); run != nil {
+		return run.Results.(*LogCounts)
+	}
+	return New(f)
+}
+
+func (c *LogCounts) Engine() *scanengine.ScanEngine {
+	return &c.CountScan
+}
+
+var Scanner = scanengine.Scanner{
+	Name:    "logs",
+	Measure: "measurelogs",
+	Params:  "<app=<regex>> <notapp=<regex>> <org=<names>> <space=<names>>",
+	Reports: []scanengine.Report{
+		{Route: "reportlogs", Params: "<showguid (default no)> <series (default no)>", Write: func(r scanengine.Results, req *http.Request, res io.Writer) {
+			r.(*LogCounts).ReportCountedLogs(res, scanengine.BoolParm(req, "showguid", false))
+			r.Engine().WriteSeries(res, scanengine.BoolParm(req, "series", false))
+		}},
+		{Route: "reportlogloss", Params: "<showinstances (default no)>", Write: func(r scanengine.Results, req *http.Request, res io.Writer) {
+			r.(*LogCounts).ReportLogLoss(res, scanengine.BoolParm(req, "showinstances", false))
+		}},
+		{Route: "reportlogorgs", Params: "<showguid (default no)> <json (default no)>", Write: func(r scanengine.Results, req *http.Request, res io.Writer) {
+			r.(*LogCounts).ReportLogsByOrg(res, scanengine.BoolParm(req, "showguid", false), scanengine.BoolParm(req, "json", false))
+		}},
+	},
+	New: func(f *firehose.Foundation) scanengine.Results { return New(f) },
+	Start: func(r scanengine.Results, req *http.Request, res io.Writer) error {
+		return r.(*LogCounts).ReadAndCountLogs(req, res)
+	},
+}
 
 /******************************************************************************************/
 
-func ResetData() {
-	CountScan.Reset()
-	TotalLogsReceived = 0
-	TotalAppLogsReceived = 0
-	CountLastSample = 0
-	RateLastSecond = 0
-	DroppedMessages = 0
+func (c *LogCounts) ResetData() {
+	c.CountScan.Reset()
 
-	LogMutex.Lock()
+	c.logMutex.Lock()
 	{
-		ReadLogsMap = make(LogMapType)
-		MetricMaps = make(map[string]map[string]*MetricCount)
+		c.totalLogsReceived = 0
+		c.totalAppLogsReceived = 0
+		c.countLastSample = 0
+		c.rateLastSecond = 0
+		c.droppedMessages = 0
+		c.filter = LogFilter{}
+		c.apps = nil
+		c.filteredLogs = 0
+		c.unresolvedLogs = 0
+		c.readLogsMap = make(LogMapType)
+		c.counters = make(map[string]*CounterTracker)
 	}
-	LogMutex.Unlock()
+	c.logMutex.Unlock()
 
 }
-func ReadAndCountLogs(req *http.Request, res io.Writer) {
+func (c *LogCounts) ReadAndCountLogs(req *http.Request, res io.Writer) error {
 
-	if err := CountScan.Start(req, res); err != nil {
-		return
+	// the parameters are checked before a filter lists the apps, which can take a while
+	err := scanengine.CheckParams(req)
+	var filter LogFilter
+	if err == nil {
+		filter, err = GetLogFilter(req)
+	}
+	if err == nil {
+		err = c.setFilter(filter)
+	}
+	if err != nil {
+		fmt.Fprintf(res, "%s: %v\n", c.CountScan.Name, err)
+		return err
+	}
+
+	if err := c.CountScan.Start(req, res); err != nil {
+		return err
 	}
 
-	// Set up the interval that is used to do rate per second
-	TimeLastSample = time.Now()
+	// The interval that is used to do rate per second starts at the first message
+	c.logMutex.Lock()
+	c.timeLastSample = time.Time{}
+	c.logMutex.Unlock()
 
 	go func() {
-		CountScan.Run(CountIterator)
+		c.CountScan.Run(c.CountIterator)
 	}()
-
+	return nil
 }
 
-func CountIterator(msg *events.Envelope) {
+func (c *LogCounts) CountIterator(msg *events.Envelope) bool {
 
 	if msg.GetEventType() == events.Envelope_CounterEvent {
-		ProcessCounterMetricMessage(msg)
-		return
+		c.ProcessCounterMetricMessage(msg)
+		return true
 	}
 
 	if msg.GetEventType() == events.Envelope_LogMessage {
-		ProcessLogMessage(msg)
-		return
+		return c.ProcessLogMessage(msg)
 	}
+	return false
 }
 
-/*****************************************************************************************/
+// A continued run keeps its filter, and can't be given a different one. The apps are listed again after a
+// restart, the lookups aren't saved
+func (c *LogCounts) setFilter(filter LogFilter) error {
+	c.logMutex.Lock()
+	current, apps := c.filter, c.apps
+	c.logMutex.Unlock()
 
-func ProcessCounterMetricMessage(msg *events.Envelope) {
-	mp := FindCounterMetricMapEntry(msg)
-	if mp == nil {
-		return
+	if c.CountScan.Runtime() > 0 {
+		if filter.Active() && filter.String() != current.String() {
+			return fmt.Errorf("run counts %q, continue it with the same filters or none", current.String())
+		}
+		filter = current
+	}
+	if !filter.Active() || apps != nil {
+		return nil
 	}
 
-	index := msg.GetIndex()
-	total := msg.GetCounterEvent().GetTotal()
-	delta := msg.GetCounterEvent().GetDelta()
+	apps, err := newAppFilter(filter, c.CountScan.Foundation)
+	if err != nil {
+		return err
+	}
 
-	LogMutex.Lock()
-	defer LogMutex.Unlock()
+	c.logMutex.Lock()
+	c.filter, c.apps = filter, apps
+	c.logMutex.Unlock()
+	return nil
+}
 
-	fmt.Println("metric", msg.GetCounterEvent().GetName(), total, delta)
+// Whether the filter, if there is one, counts the app's logs. The ones left out are counted here
+func (c *LogCounts) countApp(guid string) bool {
+	c.logMutex.Lock()
+	apps := c.apps
+	c.logMutex.Unlock()
 
-	p, ok := mp[index]
-	if ok == false {
-		m := MetricCount{total, total, total, delta, 0, 1}
-		mp[index] = &m
-		return
+	if apps == nil || guid == "system" {
+		return true
 	}
 
-	//detect if we missed a metric message
-	if p.lastValue+delta != total {
-		p.missed++
+	counted, known := apps.check(guid)
+	if counted {
+		return true
 	}
-	p.msgs++
-	p.lastValue = p.nowValue
-	p.nowValue = total
 
+	c.logMutex.Lock()
+	if known {
+		c.filteredLogs++
+	} else {
+		c.unresolvedLogs++
+	}
+	c.logMutex.Unlock()
+	return false
 }
 
-func FindCounterMetricMapEntry(msg *events.Envelope) map[string]*MetricCount {
+/*****************************************************************************************/
+
+func (c *LogCounts) ProcessCounterMetricMessage(msg *events.Envelope) {
+	tracker := c.FindCounterTracker(msg)
+	if tracker == nil {
+		return
+	}
+
+	c.logMutex.Lock()
+	defer c.logMutex.Unlock()
+
+	tracker.Add(msg)
+}
+
+func (c *LogCounts) FindCounterTracker(msg *events.Envelope) *CounterTracker {
 	var origin string
 
 	name := msg.GetCounterEvent().GetName()
@@ -148,7 +268,7 @@ func FindCounterMetricMapEntry(msg *events.Envelope) map[string]*MetricCount {
 
 	// Diego doesn't yet support tags
 	if name == "logSenderTotalMessagesRead" && origin == "rep" {
-		return GetMetricMap("Diego")
+		return c.GetCounterTracker("Diego")
 	}
 
 	// Metron and doppler support tags, so only look at CounterEvents that are tagged as log count metrics
@@ -157,41 +277,46 @@ func FindCounterMetricMapEntry(msg *events.Envelope) map[string]*MetricCount {
 	}
 
 	if name == "listeners.receivedEnvelopes" && origin == "DopplerServer" {
-		return GetMetricMap("Doppler")
+		return c.GetCounterTracker("Doppler")
 	}
 	if name == "dropsondeMarshaller.sentEnvelopes" && origin == "MetronAgent" {
-		return GetMetricMap("Metron")
+		return c.GetCounterTracker("Metron")
 	}
 
 	return nil
 }
 
-func GetMetricMap(index string) map[string]*MetricCount {
+func (c *LogCounts) GetCounterTracker(hop string) *CounterTracker {
 
-	// *change*
-	LogMutex.Lock()
-	defer LogMutex.Unlock()
+	c.logMutex.Lock()
+	defer c.logMutex.Unlock()
 
-	mc, ok := MetricMaps[index]
-	if ok == true {
-		return mc
+	t, ok := c.counters[hop]
+	if ok {
+		return t
 	}
 
-	var me = make(map[string]*MetricCount)
-	MetricMaps[index] = me
-	return me
+	t = NewCounterTracker()
+	c.counters[hop] = t
+	return t
 }
 
 /*****************************************************************************************/
 
-func ProcessLogMessage(msg *events.Envelope) {
+// Returns false for a log the filter leaves out
+func (c *LogCounts) ProcessLogMessage(msg *events.Envelope) bool {
 
-	ProcessLogTiming()
-	guid, name, src := FixupLogMessage(msg)
-	InsertLogMessageInTable(guid, src, name)
+	if !c.countApp(msg.GetLogMessage().GetAppId()) {
+		return false
+	}
+
+	c.ProcessLogTiming()
+	guid, name, src := c.FixupLogMessage(msg)
+	c.InsertLogMessageInTable(guid, src, name)
+	return true
 }
 
-func FixupLogMessage(msg *events.Envelope) (string, string, string) {
+func (c *LogCounts) FixupLogMessage(msg *events.Envelope) (string, string, string) {
 	var name string
 
 	guid := msg.GetLogMessage().GetAppId()
@@ -201,55 +326,118 @@ func FixupLogMessage(msg *events.Envelope) (string, string, string) {
 		src = "==="
 	}
 
-	if src == "APP" {
-		TotalAppLogsReceived++
-	}
-
+	var dropped int
 	if guid == "system" {
-		var cnt int
-
-		n, _ := fmt.Sscanf(string(msg.GetLogMessage().GetMessage()), "Dropped %d message(s) from MetronAgent to Doppler", &cnt)
+		n, _ := fmt.Sscanf(string(msg.GetLogMessage().GetMessage()), "Dropped %d message(s) from MetronAgent to Doppler", &dropped)
 		if n == 1 {
 			name = "system: dropped messages"
-			DroppedMessages += cnt
 		} else {
 			name = "system: unknown message"
 		}
 	}
 
+	c.logMutex.Lock()
+	if src == "APP" {
+		c.totalAppLogsReceived++
+	}
+	c.droppedMessages += dropped
+	c.logMutex.Unlock()
+
+	if src == "APP" {
+		c.CountScan.Record(seriesAppLogs, 1)
+	}
+	if dropped > 0 {
+		c.CountScan.Record(seriesDropped, dropped)
+	}
+
 	return guid, name, src
 }
 
-func ProcessLogTiming() {
-	TotalLogsReceived++
-	t := time.Now()
-	ti := t.Sub(TimeLastSample)
+func (c *LogCounts) ProcessLogTiming() {
+	t := c.CountScan.MessageTime()
+	c.CountScan.Record(seriesLogs, 1)
+
+	c.logMutex.Lock()
+	defer c.logMutex.Unlock()
+
+	c.totalLogsReceived++
+	if c.timeLastSample.IsZero() {
+		c.timeLastSample = t
+	}
+	ti := t.Sub(c.timeLastSample)
 
 	if ti > time.Second {
-		TimeLastSample = t
-		lc := TotalLogsReceived - CountLastSample
-		RateLastSecond = int(float64(lc) / float64(ti.Seconds()))
-		CountLastSample = TotalLogsReceived
+		c.timeLastSample = t
+		lc := c.totalLogsReceived - c.countLastSample
+		c.rateLastSecond = int(float64(lc) / float64(ti.Seconds()))
+		c.countLastSample = c.totalLogsReceived
 	}
 }
 
-func InsertLogMessageInTable(guid, src, name string) {
+func (c *LogCounts) InsertLogMessageInTable(guid, src, name string) {
 
 	key := guid + src
 
-	// *change*
-	LogMutex.Lock()
-	defer LogMutex.Unlock()
+	c.logMutex.Lock()
+	entry, ok := c.readLogsMap[key]
+	if ok {
+		entry.count++
+	} else {
+		entry = &LogType{guid: guid, name: name, src: src, count: 1}
+		c.readLogsMap[key] = entry
+	}
+	// a name whose lookup failed is asked for again
+	lookup := entry.name == "" && !entry.looking
+	if lookup {
+		entry.looking = true
+	}
+	c.logMutex.Unlock()
 
-	value, ok := ReadLogsMap[key]
-	if !ok {
-		entry := &LogType{guid, name, src, 1}
-		ReadLogsMap[key] = entry
-		QueueNameLookup(entry)
-		return
+	// asked for outside the lock, a cached name is filled in straight away
+	if lookup {
+		c.CountScan.Foundation.Resolver().Resolve(guid, func(app firehose.AppInfo, err error) {
+			c.setName(entry, app, err)
+		})
+	}
+}
+
+// The entry belongs to the counts and is read by reports, so it's only written under the lock. After a failed
+// lookup, or one the resolver was too busy to take, the name stays empty until the app's next log asks again
+func (c *LogCounts) setName(entry *LogType, app firehose.AppInfo, err error) {
+	c.logMutex.Lock()
+	defer c.logMutex.Unlock()
+
+	entry.looking = false
+	switch {
+	case err == firehose.ErrAppNotFound:
+		entry.name = "guid: " + entry.guid
+	case err == nil:
+		entry.name, entry.space, entry.org = app.Name, app.Space, app.Org
+	}
+}
+
+// The entries sorted, copied so they can be printed after the lock is released. Caller holds logMutex
+func (c *LogCounts) copyLogs() LogSliceType {
+	var sl LogSliceType
+
+	for _, l := range c.readLogsMap {
+		entry := *l
+		sl = append(sl, &entry)
 	}
-	value.count++
 
+	sort.Sort(sl)
+	return sl
+}
+
+// The logs from "system", which are never sampled. caller holds logMutex
+func (c *LogCounts) systemLogs() int {
+	n := 0
+	for _, l := range c.readLogsMap {
+		if l.guid == "system" {
+			n += l.count
+		}
+	}
+	return n
 }
 
 func SortLogs(logList LogMapType) LogSliceType {
@@ -265,51 +453,52 @@ func SortLogs(logList LogMapType) LogSliceType {
 
 /******************************************************************************************/
 
-func ReportCountedLogs(ow io.Writer, showGuid bool) {
+func (c *LogCounts) ReportCountedLogs(ow io.Writer, showGuid bool) {
 
-	CountScan.WriteStatus(ow)
+	c.CountScan.WriteStatus(ow)
 
-	LogMutex.Lock()
-	mapLen := len(ReadLogsMap)
-	LogMutex.Unlock()
+	/*************************************************************************************************/
+	c.logMutex.Lock()
 
-	if mapLen == 0 {
+	if len(c.readLogsMap) == 0 {
+		c.logMutex.Unlock()
 		fmt.Fprintln(ow, "No log data collected")
 		return
 	}
 
-	fmt.Fprintf(ow, "Total logs messages: %8d APP messages: %8d\n", TotalLogsReceived, TotalAppLogsReceived)
+	logList := c.copyLogs()
+	totalLogs, totalAppLogs, systemLogs := c.totalLogsReceived, c.totalAppLogsReceived, c.systemLogs()
+	rateLastSecond, dropped := c.rateLastSecond, c.droppedMessages
+	filter, apps, filtered, unresolved := c.filter, c.apps, c.filteredLogs, c.unresolvedLogs
 
+	c.logMutex.Unlock()
 	/*************************************************************************************************/
-	LogMutex.Lock()
-
-	logList := SortLogs(ReadLogsMap)
-
-	// This is all the data reported by the app name lookup channel logic
-	// needs to be in a mutex because the variables all need to be consistent
-	lookupCnt := TotalNameLookupCount
-	inProcessCnt := NumberOfNamesInProcess
-	aveQueueMs := int((TotalNameQueueTime.Seconds() / float64(TotalNameLookupCount)) * 1000)
-	maxQueueMs := int(MaxNameQueueTime.Seconds() * 1000)
-	minQueueMs := int(MinNameQueueTime.Seconds() * 1000)
-	aveLookupMs := int((TotalNameLookupTime.Seconds() / float64(TotalNameLookupCount)) * 1000)
-	maxLookupMs := int(MaxNameLookupTime.Seconds() * 1000)
-	minLookupMs := int(MinNameLookupTime.Seconds() * 1000)
-	maxEnqueue := MaxNumberOfNamesInProcess
-
-	LogMutex.Unlock()
-	/*************************************************************************************************/
 
-	PrintLogMetricStats(ow, "Diego")
-	PrintLogMetricStats(ow, "Metron")
-	PrintLogMetricStats(ow, "Doppler")
+	scan := &c.CountScan
+	scan.WriteSampling(ow)
+	if filter.Active() {
+		failed := 0
+		if apps != nil {
+			failed = apps.failures()
+		}
+		WriteFilter(ow, filter, scan.Estimate(filtered).String(), scan.Estimate(unresolved).String(), failed)
+	}
+	fmt.Fprintf(ow, "Total logs messages: %8s APP messages: %8s\n", scan.Estimate(totalLogs-systemLogs).Plus(systemLogs), scan.Estimate(totalAppLogs))
+
+	c.PrintLogMetricStats(ow, "Diego")
+	c.PrintLogMetricStats(ow, "Metron")
+	c.PrintLogMetricStats(ow, "Doppler")
 
-	fmt.Fprintln(ow, lookupCnt, "names, ave lookup", aveLookupMs, "max/min", maxLookupMs, minLookupMs, "ave queue", aveQueueMs, "max/min", maxQueueMs, minQueueMs, "queued", inProcessCnt, "max", maxEnqueue)
-	fmt.Fprintf(ow, "rate last second %5d total dropped messages %d\n", RateLastSecond, DroppedMessages)
+	scan.Foundation.Resolver().WriteStatus(ow)
+	fmt.Fprintf(ow, "rate last second %5s total dropped messages %d\n", scan.Scale(rateLastSecond).Short(), dropped)
 
 	for _, l := range logList {
 
-		fmt.Fprintf(ow, "%8d %5s %s", l.count, l.src, l.name)
+		count := scan.Estimate(l.count).Short()
+		if l.guid == "system" {
+			count = strconv.Itoa(l.count)
+		}
+		fmt.Fprintf(ow, "%8s %5s %s", count, l.src, l.name)
 
 		if showGuid {
 			fmt.Fprintf(ow, "| %s", l.guid)
@@ -319,115 +508,272 @@ func ReportCountedLogs(ow io.Writer, showGuid bool) {
 
 }
 
-func PrintLogMetricStats(ow io.Writer, name string) {
+func (c *LogCounts) PrintLogMetricStats(ow io.Writer, name string) {
 
-	// *change*
-	LogMutex.Lock()
-	mm, ok := MetricMaps[name]
-	LogMutex.Unlock()
+	var sum CounterSum
 
+	c.logMutex.Lock()
+	t, ok := c.counters[name]
 	if ok {
-		fmt.Fprintf(ow, "%8s [%2d]:", name, len(mm))
-		var count uint64
-		var missed int
-		var msgs int
-
-		for _, mp := range mm {
-			count += mp.count
-			missed += mp.missed
-			msgs += mp.msgs
-		}
-		fmt.Fprintf(ow, " %8d [%2d|%8d]", count, missed, msgs)
+		sum = t.Sum()
+	}
+	c.logMutex.Unlock()
 
+	if ok {
+		fmt.Fprintf(ow, "%8s [%2d]:", name, sum.Instances)
+		fmt.Fprintf(ow, " %8d [%2d|%8d]", sum.Increase, sum.Gaps, sum.Envelopes)
+		if problems := sum.Problems(); problems != "" {
+			fmt.Fprintf(ow, " %s", problems)
+		}
 	}
 	fmt.Fprintln(ow)
 }
 
-/***************************************************************************************************************************/
-
-type NameLookup struct {
-	LogEntry        *LogType
-	EnqueueTime     time.Time
-	StartLookupTime time.Time
+/******************************************************************************************/
+// combining the counts from several app instances sharing the firehose subscription
+
+type LogEntry struct {
+	Guid  string
+	Name  string
+	Src   string
+	Count int
+	Space string
+	Org   string
 }
 
-var (
-	NumberOfNamesInProcess    int
-	MaxNumberOfNamesInProcess int
-	TotalNameLookupTime       time.Duration
-	MinNameLookupTime         time.Duration
-	MaxNameLookupTime         time.Duration
-	TotalNameQueueTime        time.Duration
-	MinNameQueueTime          time.Duration
-	MaxNameQueueTime          time.Duration
-	TotalNameLookupCount      int
-)
+type LogsSnapshot struct {
+	TotalLogsReceived    int
+	TotalAppLogsReceived int
+	DroppedMessages      int
+	Filter               LogFilter
+	FilteredLogs         int
+	UnresolvedLogs       int
+	Logs                 []LogEntry
+}
 
-var LogNameChannel chan NameLookup = make(chan NameLookup, 20000)
+func (c *LogCounts) Snapshot() LogsSnapshot {
+	c.logMutex.Lock()
+	defer c.logMutex.Unlock()
+
+	snapshot := LogsSnapshot{
+		TotalLogsReceived:    c.totalLogsReceived,
+		TotalAppLogsReceived: c.totalAppLogsReceived,
+		DroppedMessages:      c.droppedMessages,
+		Filter:               c.filter,
+		FilteredLogs:         c.filteredLogs,
+		UnresolvedLogs:       c.unresolvedLogs,
+	}
 
-// Send off the name - the manipulations of the globals need to be protected by a mutex. However, the *one* caller of this function
-// does it from within a mutex. So we don't project it here. But that is fragile...
-func QueueNameLookup(l *LogType) {
-	var nl NameLookup
+	for _, l := range c.readLogsMap {
+		snapshot.Logs = append(snapshot.Logs, LogEntry{l.guid, l.name, l.src, l.count, l.space, l.org})
+	}
+	return snapshot
+}
 
-	nl.LogEntry = l
-	nl.EnqueueTime = time.Now()
+// Saved across a restart as a snapshot. Names still being looked up are saved empty
+func (c *LogCounts) SaveData() ([]byte, error) {
+	return json.Marshal(c.Snapshot())
+}
 
-	LogNameChannel <- nl
+func (c *LogCounts) RestoreData(data []byte) error {
+	var snapshot LogsSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return err
+	}
 
-	// LogMutex.Lock()
-	{
-		NumberOfNamesInProcess++
-		if NumberOfNamesInProcess > MaxNumberOfNamesInProcess {
-			MaxNumberOfNamesInProcess = NumberOfNamesInProcess
-		}
+	c.logMutex.Lock()
+	defer c.logMutex.Unlock()
+
+	c.totalLogsReceived = snapshot.TotalLogsReceived
+	c.totalAppLogsReceived = snapshot.TotalAppLogsReceived
+	c.droppedMessages = snapshot.DroppedMessages
+	c.filter = snapshot.Filter
+	c.filter.compile()
+	c.filteredLogs = snapshot.FilteredLogs
+	c.unresolvedLogs = snapshot.UnresolvedLogs
+	for _, l := range snapshot.Logs {
+		c.readLogsMap[l.Guid+l.Src] = &LogType{guid: l.Guid, name: l.Name, src: l.Src, count: l.Count, space: l.Space, org: l.Org}
 	}
-	// LogMutex.Unlock()
+	return nil
 }
 
-func ProcessNameLookup() {
+func ReportCountedLogsCombined(ow io.Writer, snapshots []LogsSnapshot, showGuid bool) {
+	var totalLogs, totalAppLogs, dropped, filtered, unresolved int
 
-	for {
-		nl := <-LogNameChannel
+	combined := combineLogs(snapshots)
+	filters := make(map[string]bool)
 
-		nl.StartLookupTime = time.Now()
+	for _, snapshot := range snapshots {
+		totalLogs += snapshot.TotalLogsReceived
+		totalAppLogs += snapshot.TotalAppLogsReceived
+		dropped += snapshot.DroppedMessages
+		filtered += snapshot.FilteredLogs
+		unresolved += snapshot.UnresolvedLogs
+		filters[snapshot.Filter.String()] = true
+	}
 
-		if nl.LogEntry.name == "" {
-			nl.LogEntry.name = CountScan.AppName(nl.LogEntry.guid)
-		}
+	if len(combined) == 0 {
+		fmt.Fprintln(ow, "No log data collected")
+		return
+	}
 
-		if nl.LogEntry.name == "" {
-			nl.LogEntry.name = "guid: " + nl.LogEntry.guid
-		}
+	if len(filters) > 1 {
+		fmt.Fprintln(ow, "WARNING: the instances counted with different filters")
+	}
+	if len(snapshots) > 0 && snapshots[0].Filter.Active() {
+		WriteFilter(ow, snapshots[0].Filter, fmt.Sprint(filtered), fmt.Sprint(unresolved), 0)
+	}
+	fmt.Fprintf(ow, "Total logs messages: %8d APP messages: %8d\n", totalLogs, totalAppLogs)
+	fmt.Fprintf(ow, "total dropped messages %d\n", dropped)
 
-		t := time.Now()
-		queueTime := t.Sub(nl.EnqueueTime)
-		processTime := t.Sub(nl.StartLookupTime)
+	for _, l := range SortLogs(combined) {
 
-		LogMutex.Lock()
-		{
-			TotalNameLookupCount++
+		fmt.Fprintf(ow, "%8d %5s %s", l.count, l.src, l.name)
 
-			TotalNameQueueTime += queueTime
-			if MaxNameQueueTime < queueTime {
-				MaxNameQueueTime = queueTime
-			}
-			if MinNameQueueTime == 0 || MinNameQueueTime > queueTime {
-				MinNameQueueTime = queueTime
-			}
+		if showGuid {
+			fmt.Fprintf(ow, "| %s", l.guid)
+		}
+		fmt.Fprintln(ow)
+	}
+}
+
+// The entries of every instance added up. An instance may not have looked up a name the others have
+func combineLogs(snapshots []LogsSnapshot) LogMapType {
+	combined := make(LogMapType)
 
-			TotalNameLookupTime += processTime
-			if MaxNameLookupTime < processTime {
-				MaxNameLookupTime = processTime
+	for _, snapshot := range snapshots {
+		for _, l := range snapshot.Logs {
+			entry, ok := combined[l.Guid+l.Src]
+			if !ok {
+				combined[l.Guid+l.Src] = &LogType{guid: l.Guid, name: l.Name, src: l.Src, count: l.Count, space: l.Space, org: l.Org}
+				continue
 			}
-			if MinNameLookupTime == 0 || MinNameLookupTime > processTime {
-				MinNameLookupTime = processTime
+			entry.count += l.Count
+			if entry.name == "" {
+				entry.name = l.Name
 			}
+			if entry.org == "" {
+				entry.space, entry.org = l.Space, l.Org
+			}
+		}
+	}
+	return combined
+}
+
+/******************************************************************************************/
+// comparing foundations
 
-			NumberOfNamesInProcess--
+// Log rates, dropped messages and the Metron/Doppler log counters side by side
+func ReportLogComparison(ow io.Writer, names []string, counts []*LogCounts) {
+
+	for i, c := range counts {
+		fmt.Fprintf(ow, "%-12s ", names[i])
+		c.CountScan.WriteStatus(ow)
+	}
+
+	fmt.Fprintf(ow, "%-24s|", "")
+	for _, name := range names {
+		fmt.Fprintf(ow, "%15.15s |", name)
+	}
+	fmt.Fprintln(ow)
+
+	// each foundation's counters read together, the scans may still be running
+	var totals []logTotals
+	for _, c := range counts {
+		totals = append(totals, c.totals())
+	}
+
+	rows := []struct {
+		label string
+		value func(t logTotals) string
+	}{
+		{"log messages", func(t logTotals) string { return t.logs.Short() }},
+		{"APP messages", func(t logTotals) string { return t.appLogs.Short() }},
+		{"logs/sec over run", logTotals.rateStr},
+		{"rate last second", func(t logTotals) string { return t.rateLastSecond.Short() }},
+		{"apps and sources", func(t logTotals) string { return strconv.Itoa(t.sources) }},
+		{"dropped messages", func(t logTotals) string { return t.dropped.Short() }},
+		{"dropped % of logs", logTotals.droppedStr},
+		{"Metron sent", func(t logTotals) string { return t.counters["Metron"] }},
+		{"Doppler received", func(t logTotals) string { return t.counters["Doppler"] }},
+		{"Diego read", func(t logTotals) string { return t.counters["Diego"] }},
+	}
+
+	for _, row := range rows {
+		fmt.Fprintf(ow, "%-24s|", row.label)
+		for _, t := range totals {
+			fmt.Fprintf(ow, "%15s |", row.value(t))
 		}
-		LogMutex.Unlock()
+		fmt.Fprintln(ow)
+	}
+}
+
+// the counts are scaled up if the run was sampled, the dropped messages are never sampled
+type logTotals struct {
+	logs           scanengine.Estimate
+	appLogs        scanengine.Estimate
+	rateLastSecond scanengine.Estimate
+	dropped        scanengine.Estimate
+	sources        int
+	runtime        time.Duration
+	counters       map[string]string
+}
+
+func (c *LogCounts) totals() logTotals {
+	t := logTotals{
+		runtime:  c.CountScan.Runtime(),
+		counters: make(map[string]string),
+	}
+
+	for _, name := range []string{"Metron", "Doppler", "Diego"} {
+		t.counters[name] = c.counterStr(name)
+	}
+
+	c.logMutex.Lock()
+	logs, appLogs, rate, dropped := c.totalLogsReceived, c.totalAppLogsReceived, c.rateLastSecond, c.droppedMessages
+	systemLogs := c.systemLogs()
+	t.sources = len(c.readLogsMap)
+	c.logMutex.Unlock()
+
+	t.logs = c.CountScan.Estimate(logs - systemLogs).Plus(systemLogs)
+	t.appLogs = c.CountScan.Estimate(appLogs)
+	t.rateLastSecond = c.CountScan.Scale(rate)
+	t.dropped = scanengine.Estimate{Value: float64(dropped), Low: float64(dropped), High: float64(dropped)}
+	return t
+}
+
+func (t logTotals) rateStr() string {
+	if t.runtime <= 0 {
+		return "--"
+	}
+	return fmt.Sprintf("%s%.1f", estimateMark(t.logs), t.logs.Value/t.runtime.Seconds())
+}
+
+func (t logTotals) droppedStr() string {
+	total := t.logs.Value + t.dropped.Value
+	if total == 0 {
+		return "--"
+	}
+	return fmt.Sprintf("%s%.2f", estimateMark(t.logs), 100*t.dropped.Value/total)
+}
 
+func estimateMark(e scanengine.Estimate) string {
+	if e.Sampled {
+		return "~"
+	}
+	return ""
+}
+
+// The summed counts of one of the log counter metrics, and how many instances reported it
+func (c *LogCounts) counterStr(name string) string {
+	c.logMutex.Lock()
+	defer c.logMutex.Unlock()
+
+	t, ok := c.counters[name]
+	if !ok {
+		return "--"
 	}
 
+	sum := t.Sum()
+	return fmt.Sprintf("%d [%d]", sum.Increase, sum.Instances)
 }
@@ -0,0 +1,160 @@
+package countlogs
+
+import (
+	"auditnozzle/fakecf"
+	"auditnozzle/firehose"
+	"auditnozzle/scanengine"
+	"auditnozzle/scantest"
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func waitReport(t *testing.T, run *scanengine.Run, route, query string, want ...[]string) string {
+	t.Helper()
+	return scantest.WaitReport(t, Scanner, run, route, query, want...)
+}
+
+var logTags = map[string]string{"event_type": "LogMessage"}
+
+// A scan of the fake firehose through to the reports: log counts with names looked up, the org grouping
+// and the Metron and Doppler counters
+func TestMeasureAndReportLogs(t *testing.T) {
+	chatty, quiet := fakecf.DefaultApps[0], fakecf.DefaultApps[1]
+	server, f := scantest.StartFakeCF(t, fakecf.Merge(
+		fakecf.LogMessages(chatty.Guid, "APP", 30, 5*time.Millisecond),
+		fakecf.LogMessages(chatty.Guid, "RTR", 10, 10*time.Millisecond),
+		fakecf.LogMessages(quiet.Guid, "APP", 5, 20*time.Millisecond),
+		fakecf.Concat(fakecf.Pause(50*time.Millisecond), fakecf.DroppedMessages(12)),
+		fakecf.CountersWithGaps("MetronAgent", "metron", "0", "dropsondeMarshaller.sentEnvelopes", logTags, 20, 5, []int{2}, 20*time.Millisecond),
+		fakecf.CountersWithGaps("DopplerServer", "doppler", "0", "listeners.receivedEnvelopes", logTags, 20, 5, nil, 20*time.Millisecond),
+	))
+	defer server.Close()
+
+	// 46 logs and 9 counters
+	run := scantest.Measure(t, Scanner, f, "runtime=30s&count=55")
+	scantest.WaitEnded(t, run)
+	if reason := run.Results.Engine().StopReason(); reason != "count reached" {
+		t.Errorf("run ended with %q, want count reached", reason)
+	}
+
+	waitReport(t, run, "reportlogs", "",
+		[]string{"Total", "logs", "messages:", "46", "APP", "messages:", "35"},
+		[]string{"Metron", "[", "1]:", "80", "[", "1|", "4]", "1", "gaps", "missed", "20"},
+		[]string{"Doppler", "[", "1]:", "80", "[", "0|", "5]"},
+		[]string{"30", "APP", "chatty-app"},
+		[]string{"10", "RTR", "chatty-app"},
+		[]string{"5", "APP", "quiet-app"},
+		[]string{"1", "DOP", "system:", "dropped", "messages"},
+	)
+	waitReport(t, run, "reportlogorgs", "",
+		[]string{"45", "97.8%", "org", "demo"},
+		[]string{"45", "97.8%", "space", "dev"},
+		[]string{"40", "87.0%", "chatty-app"},
+		[]string{"1", "2.2%", "org", "system"},
+	)
+	waitReport(t, run, "reportlogloss", "showinstances=true",
+		[]string{"sent", "by", "Metrons", "80", "1,", "0", "resets"},
+		[]string{"received", "by", "Dopplers", "80", "0.00%", "1,", "0", "resets"},
+		[]string{"reported", "dropped", "by", "Doppler", "12"},
+		[]string{"Metron", "metron/0", "80", "from", "20", "to", "100,", "4", "counter", "envelopes,", "1", "gaps", "missed", "20"},
+	)
+}
+
+// Doppler's dropped message reports are never sampled, so their total is exact while the logs are scaled up
+func TestSampledDroppedExact(t *testing.T) {
+	chatty := fakecf.DefaultApps[0]
+	server, f := scantest.StartFakeCF(t, fakecf.Merge(
+		fakecf.LogMessages(chatty.Guid, "APP", 40, 5*time.Millisecond),
+		fakecf.Concat(fakecf.Pause(20*time.Millisecond), fakecf.Repeat(fakecf.DroppedMessages(12), 3)),
+		fakecf.Counters("DopplerServer", "doppler", "0", "listeners.receivedEnvelopes", logTags, []uint64{20, 40}, 20*time.Millisecond),
+	))
+	defer server.Close()
+
+	// every other app log, the three dropped reports and the two counters
+	run := scantest.Measure(t, Scanner, f, "runtime=30s&count=25&sample=1in2")
+	scantest.WaitEnded(t, run)
+
+	waitReport(t, run, "reportlogs", "",
+		[]string{"~40", "APP", "chatty-app"},
+		[]string{"3", "DOP", "system:", "dropped", "messages"},
+	)
+	waitReport(t, run, "reportlogloss", "",
+		[]string{"reported", "dropped", "by", "Doppler", "36"},
+		[]string{"received", "by", "this", "nozzle", "~43", "-115.00%"},
+	)
+	waitReport(t, run, "reportlogorgs", "",
+		[]string{"~3", "7.0%", "org", "system"},
+	)
+}
+
+// Apps left out by the filter are counted, not listed
+func TestMeasureLogsFiltered(t *testing.T) {
+	chatty, quiet := fakecf.DefaultApps[0], fakecf.DefaultApps[1]
+	server, f := scantest.StartFakeCF(t, fakecf.Merge(
+		fakecf.LogMessages(chatty.Guid, "APP", 20, 5*time.Millisecond),
+		fakecf.LogMessages(quiet.Guid, "APP", 5, 10*time.Millisecond),
+	))
+	defer server.Close()
+
+	run := scantest.Measure(t, Scanner, f, "runtime=30s&count=5&app=^quiet")
+	scantest.WaitEnded(t, run)
+
+	text := waitReport(t, run, "reportlogs", "",
+		[]string{"Total", "logs", "messages:", "5", "APP", "messages:", "5"},
+		[]string{"5", "APP", "quiet-app"},
+	)
+	if strings.Contains(text, "chatty-app") {
+		t.Errorf("reportlogs lists an app the filter leaves out:\n%s", text)
+	}
+}
+
+// A bad parameter is reported before the filter lists the apps
+func TestMeasureLogsBadParamFiltered(t *testing.T) {
+	f := &firehose.Foundation{
+		Name:        "unreachable",
+		Credentials: firehose.Credentials{ApiEndpoint: "http://127.0.0.1:1", UserName: "admin", Password: "admin"},
+	}
+	firehose.SetFoundations(f.Name, f)
+
+	var out bytes.Buffer
+	_, err := scanengine.NewRun(Scanner, f, httptest.NewRequest("GET", "/measurelogs?app=^quiet&runtime=10", nil), &out)
+	if err == nil || !strings.Contains(err.Error(), "runtime") {
+		t.Errorf("started with runtime=10, got %v: %s", err, out.String())
+	}
+}
+
+// A failed name lookup leaves the name empty, and the app's next log looks it up again
+func TestNameLookupRetried(t *testing.T) {
+	f := &firehose.Foundation{
+		Name:        "unreachable-names",
+		Credentials: firehose.Credentials{ApiEndpoint: "http://127.0.0.1:1", UserName: "admin", Password: "admin"},
+	}
+	firehose.SetFoundations(f.Name, f)
+	c := New(f)
+	quiet := fakecf.DefaultApps[1]
+
+	entry := func() LogType {
+		c.logMutex.Lock()
+		defer c.logMutex.Unlock()
+		return *c.readLogsMap[quiet.Guid+"APP"]
+	}
+
+	c.InsertLogMessageInTable(quiet.Guid, "APP", "")
+	for deadline := time.Now().Add(10 * time.Second); entry().looking; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the lookup against an unreachable cloud controller didn't fail")
+		}
+	}
+	if name := entry().name; name != "" {
+		t.Errorf("after a failed lookup the name is %q, want it empty", name)
+	}
+
+	f.Resolver().Add([]firehose.AppInfo{{Guid: quiet.Guid, Name: quiet.Name}})
+	c.InsertLogMessageInTable(quiet.Guid, "APP", "")
+	if l := entry(); l.name != quiet.Name || l.count != 2 {
+		t.Errorf("after the next log the name is %q with %d logs, want %s with 2", l.name, l.count, quiet.Name)
+	}
+}
@@ -0,0 +1,205 @@
+package countlogs
+
+import (
+	"auditnozzle/firehose"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+/********************************************************************************************************
+* measurelogs can count the logs of some apps only:
+*
+*   app=<regex>      apps whose name matches
+*   notapp=<regex>   leaving out apps whose name matches
+*   org=<names>      apps in these orgs, comma separated
+*   space=<names>    apps in these spaces
+*
+* The apps are listed from the cloud controller, with their space and org, when the scan starts. An app first
+* seen later is asked for from the foundation's resolver, and its logs aren't counted until it has been looked
+* up; the report shows how many that was. An app the cloud controller doesn't have is never counted, a lookup
+* that failed, or was turned away by a busy resolver, is tried again with the app's next log. Logs from
+* "system", such as the dropped message reports, aren't from an app and are always counted
+ */
+
+type LogFilter struct {
+	App    string
+	NotApp string
+	Orgs   []string
+	Spaces []string
+
+	app    *regexp.Regexp
+	notApp *regexp.Regexp
+}
+
+func GetLogFilter(req *http.Request) (LogFilter, error) {
+	f := LogFilter{
+		App:    req.FormValue("app"),
+		NotApp: req.FormValue("notapp"),
+		Orgs:   nameList(req.FormValue("org")),
+		Spaces: nameList(req.FormValue("space")),
+	}
+	return f, f.compile()
+}
+
+func nameList(parm string) []string {
+	var names []string
+	for _, name := range strings.Split(parm, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func (f *LogFilter) compile() error {
+	var err error
+	if f.App != "" {
+		if f.app, err = regexp.Compile(f.App); err != nil {
+			return fmt.Errorf("app=%s: %v", f.App, err)
+		}
+	}
+	if f.NotApp != "" {
+		if f.notApp, err = regexp.Compile(f.NotApp); err != nil {
+			return fmt.Errorf("notapp=%s: %v", f.NotApp, err)
+		}
+	}
+	return nil
+}
+
+func (f LogFilter) Active() bool {
+	return f.App != "" || f.NotApp != "" || len(f.Orgs) > 0 || len(f.Spaces) > 0
+}
+
+// e.g. app=^billing- org=prod,dev
+func (f LogFilter) String() string {
+	var parms []string
+	if f.App != "" {
+		parms = append(parms, "app="+f.App)
+	}
+	if f.NotApp != "" {
+		parms = append(parms, "notapp="+f.NotApp)
+	}
+	if len(f.Orgs) > 0 {
+		parms = append(parms, "org="+strings.Join(f.Orgs, ","))
+	}
+	if len(f.Spaces) > 0 {
+		parms = append(parms, "space="+strings.Join(f.Spaces, ","))
+	}
+	return strings.Join(parms, " ")
+}
+
+func (f LogFilter) Matches(app firehose.AppInfo) bool {
+	if f.app != nil && !f.app.MatchString(app.Name) {
+		return false
+	}
+	if f.notApp != nil && f.notApp.MatchString(app.Name) {
+		return false
+	}
+	if len(f.Orgs) > 0 && !contains(f.Orgs, app.Org) {
+		return false
+	}
+	if len(f.Spaces) > 0 && !contains(f.Spaces, app.Space) {
+		return false
+	}
+	return true
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+// The logs the filter left out, the apps first seen during the scan are still being looked up when their
+// logs come in
+func WriteFilter(ow io.Writer, f LogFilter, filtered, unresolved string, failed int) {
+	fmt.Fprintf(ow, "Counting %s, not counted: %s logs of other apps, %s of apps being looked up\n", f, filtered, unresolved)
+	if failed > 0 {
+		fmt.Fprintf(ow, "WARNING: %d app lookups failed, those apps' logs aren't counted until a lookup succeeds\n", failed)
+	}
+}
+
+/******************************************************************************************/
+
+// Which apps' logs a run's filter counts, by app guid
+type appFilter struct {
+	filter   LogFilter
+	resolver *firehose.Resolver
+
+	mutex   sync.Mutex
+	counted map[string]bool
+	pending map[string]bool
+	failed  int
+}
+
+// Lists every app on the foundation, which can take a while on a big one. The resolver gets the list too, so
+// the counts don't look the names up again
+func newAppFilter(filter LogFilter, f *firehose.Foundation) (*appFilter, error) {
+	apps, err := f.ListAppInfo()
+	if err != nil {
+		return nil, fmt.Errorf("listing apps for %s: %v", filter, err)
+	}
+	f.Resolver().Add(apps)
+
+	a := &appFilter{
+		filter:   filter,
+		resolver: f.Resolver(),
+		counted:  make(map[string]bool),
+		pending:  make(map[string]bool),
+	}
+	for _, app := range apps {
+		a.counted[app.Guid] = filter.Matches(app)
+	}
+	return a, nil
+}
+
+// Whether the app's logs are counted, and whether that is known yet. An unknown app is asked for from the
+// resolver
+func (a *appFilter) check(guid string) (counted, known bool) {
+	a.mutex.Lock()
+	if counted, ok := a.counted[guid]; ok {
+		a.mutex.Unlock()
+		return counted, true
+	}
+	asked := a.pending[guid]
+	a.pending[guid] = true
+	a.mutex.Unlock()
+
+	if !asked {
+		a.resolver.Resolve(guid, func(app firehose.AppInfo, err error) { a.resolved(guid, app, err) })
+	}
+
+	// the resolver may have had it cached
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	counted, known = a.counted[guid]
+	return counted, known
+}
+
+// An app that isn't found isn't counted. After any other error the app stays unknown, so its next log asks
+// for it again
+func (a *appFilter) resolved(guid string, app firehose.AppInfo, err error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	delete(a.pending, guid)
+	if err != nil && err != firehose.ErrAppNotFound {
+		a.failed++
+		return
+	}
+	a.counted[guid] = err == nil && a.filter.Matches(app)
+}
+
+// Lookups that failed, other than of deleted apps
+func (a *appFilter) failures() int {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.failed
+}
@@ -0,0 +1,47 @@
+package countlogs
+
+import (
+	"auditnozzle/firehose"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// A lookup that fails leaves the app unknown, so its next log asks for it again
+func TestAppFilterRetriesFailedLookup(t *testing.T) {
+	f := &firehose.Foundation{
+		Name:        "unreachable-filter",
+		Credentials: firehose.Credentials{ApiEndpoint: "http://127.0.0.1:1", UserName: "admin", Password: "admin"},
+	}
+	firehose.SetFoundations(f.Name, f)
+
+	filter, err := GetLogFilter(httptest.NewRequest("GET", "/measurelogs?app=^quiet", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &appFilter{filter: filter, resolver: f.Resolver(), counted: make(map[string]bool), pending: make(map[string]bool)}
+	quiet := firehose.AppInfo{Guid: "22222222-2222-2222-2222-222222222222", Name: "quiet-app"}
+
+	if _, known := a.check(quiet.Guid); known {
+		t.Fatal("an app first seen was known before it was looked up")
+	}
+	for deadline := time.Now().Add(10 * time.Second); a.failures() == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the lookup against an unreachable cloud controller didn't fail")
+		}
+	}
+
+	a.mutex.Lock()
+	_, known := a.counted[quiet.Guid]
+	pending := a.pending[quiet.Guid]
+	a.mutex.Unlock()
+	if known || pending {
+		t.Errorf("after a failed lookup the app is known %v, pending %v, want neither", known, pending)
+	}
+
+	// the next log asks again, and gets it from the resolver this time
+	f.Resolver().Add([]firehose.AppInfo{quiet})
+	if counted, known := a.check(quiet.Guid); !counted || !known {
+		t.Errorf("after the retry the app is counted %v, known %v, want both", counted, known)
+	}
+}
@@ -0,0 +1,102 @@
+package countlogs
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+/********************************************************************************************************
+* reportlogloss follows the run's log envelopes through the three hops to this nozzle: the ones every Metron
+* sent (dropsondeMarshaller.sentEnvelopes), the ones every Doppler received (listeners.receivedEnvelopes) and
+* the log messages the nozzle received, with the loss at each hop.
+*
+* Each instance's counter is followed from the first total the run saw to the last, so an instance counts from
+* its first counter envelope, and the windows of the counters and of the nozzle's own count differ by up to a
+* counter interval at each end. Restarts, wraps, duplicates and envelopes out of order are told apart as in
+* counters.go, so the counts over a restart are added and the reset counted. Dopplers log the envelopes they
+* know were lost on the way from Metron as "Dropped N message(s) from MetronAgent to Doppler", their total is
+* shown with that hop. With several app instances sharing the subscription, this nozzle only receives its share
+* and the last hop shows that as loss
+ */
+
+// A counter summed over every instance reporting it, and each instance's
+type hopCount struct {
+	CounterSum
+	counters map[CounterKey]Counter
+}
+
+// caller holds logMutex
+func (c *LogCounts) hopCount(name string) hopCount {
+	t, ok := c.counters[name]
+	if !ok {
+		return hopCount{}
+	}
+	return hopCount{t.Sum(), t.Counters()}
+}
+
+// e.g. 0.36%, negative when more arrived than the counters say were sent
+func lossStr(sent, received float64) string {
+	if sent == 0 {
+		return "--"
+	}
+	return fmt.Sprintf("%.2f%%", 100*(sent-received)/sent)
+}
+
+func (c *LogCounts) ReportLogLoss(ow io.Writer, showInstances bool) {
+
+	scan := &c.CountScan
+	scan.WriteStatus(ow)
+
+	c.logMutex.Lock()
+	metron, doppler := c.hopCount("Metron"), c.hopCount("Doppler")
+	received := c.totalLogsReceived + c.filteredLogs + c.unresolvedLogs
+	systemLogs := c.systemLogs()
+	dropped := c.droppedMessages
+	c.logMutex.Unlock()
+
+	if metron.Instances == 0 && doppler.Instances == 0 {
+		fmt.Fprintln(ow, "No Metron or Doppler log counters seen")
+		return
+	}
+
+	// the counters and the system logs, with Doppler's dropped reports, are always kept, only the nozzle's count
+	// of the other logs is scaled up for a sampled run
+	scan.WriteSampling(ow)
+	nozzle := scan.Estimate(received - systemLogs).Plus(systemLogs)
+
+	fmt.Fprintf(ow, "%-28s %14s %10s  %s\n", "log envelopes", "count", "hop loss", "instances")
+	fmt.Fprintf(ow, "%-28s %14d %10s  %d, %d resets\n", "sent by Metrons", metron.Increase, "", metron.Instances, metron.Restarts)
+	fmt.Fprintf(ow, "%-28s %14d %10s  %d, %d resets\n", "received by Dopplers", doppler.Increase,
+		lossStr(float64(metron.Increase), float64(doppler.Increase)), doppler.Instances, doppler.Restarts)
+	fmt.Fprintf(ow, "%-28s %14d\n", "  reported dropped by Doppler", dropped)
+	fmt.Fprintf(ow, "%-28s %14s %10s\n", "received by this nozzle", nozzle.Short(), lossStr(float64(doppler.Increase), nozzle.Value))
+	fmt.Fprintf(ow, "%-28s %14s %10s\n", "end to end", "", lossStr(float64(metron.Increase), nozzle.Value))
+
+	if _, bufferDropped := scan.Envelopes(); bufferDropped > 0 {
+		fmt.Fprintf(ow, "the nozzle's buffer dropped %d envelopes of every type as well, they are in the last hop's loss\n", bufferDropped)
+	}
+
+	if !showInstances {
+		return
+	}
+	for _, hop := range []struct {
+		name string
+		h    hopCount
+	}{{"Metron", metron}, {"Doppler", doppler}} {
+		var keys []CounterKey
+		for key := range hop.h.counters {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool { return keys[i].Instance() < keys[j].Instance() })
+
+		for _, key := range keys {
+			m := hop.h.counters[key]
+			fmt.Fprintf(ow, "%8s %-30s %12d from %d to %d, %d counter envelopes", hop.name, key.Instance(), m.Increase, m.First, m.Last, m.Envelopes)
+			if problems := m.Problems(); problems != "" {
+				fmt.Fprintf(ow, ", %s", problems)
+			}
+			fmt.Fprintln(ow)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package countlogs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+/********************************************************************************************************
+* reportlogorgs shows which org or space is flooding Loggregator: the counts grouped by org, then space, then
+* app, then source type, each with its share of every log counted. The space and org are looked up with the
+* app's name, so an app still being looked up, or whose lookup failed, is in the "unknown" org and space.
+* Logs from "system" have an org of their own. json=true gives the same groups as JSON
+ */
+
+const (
+	systemGroup  = "system"
+	unknownGroup = "unknown"
+)
+
+// An org, space, app or source type. Counts of a sampled run are estimates
+type LogGroup struct {
+	Name   string
+	Guid   string `json:",omitempty"` // apps only
+	Count  int64
+	Share  float64     // percent of every log counted
+	Groups []*LogGroup `json:",omitempty"`
+
+	count int  // in the sample
+	exact bool // the system logs, which are never sampled
+}
+
+type LogGroups struct {
+	Sampled bool
+	Total   int64
+	Orgs    []*LogGroup
+}
+
+// scale turns a count of the sample into an estimate of every log
+func groupLogs(logs LogSliceType, total int, sampled bool, scale func(int) int64) LogGroups {
+	system := 0
+	for _, l := range logs {
+		if l.guid == "system" {
+			system += l.count
+		}
+	}
+	groups := LogGroups{Sampled: sampled, Total: scale(total-system) + int64(system)}
+	index := make(map[string]*LogGroup)
+
+	// the group under parent, keyed by the path to it
+	child := func(parent *[]*LogGroup, key, name, guid string) *LogGroup {
+		g, ok := index[key]
+		if !ok {
+			g = &LogGroup{Name: name, Guid: guid}
+			index[key] = g
+			*parent = append(*parent, g)
+		}
+		return g
+	}
+
+	for _, l := range logs {
+		org, space := l.org, l.space
+		switch {
+		case l.guid == "system":
+			org, space = systemGroup, systemGroup
+		case org == "":
+			org, space = unknownGroup, unknownGroup
+		}
+
+		name := l.name
+		if name == "" {
+			name = "guid: " + l.guid
+		}
+
+		o := child(&groups.Orgs, org, org, "")
+		o.exact = l.guid == "system"
+		s := child(&o.Groups, org+"/"+space, space, "")
+		a := child(&s.Groups, org+"/"+space+"/"+l.guid, name, l.guid)
+		src := &LogGroup{Name: l.src, count: l.count}
+		a.Groups = append(a.Groups, src)
+
+		for _, g := range []*LogGroup{o, s, a} {
+			g.count += l.count
+		}
+	}
+
+	finishGroups(groups.Orgs, groups.Total, scale)
+	return groups
+}
+
+// Scales the counts, works out the shares and sorts each level, largest first
+func finishGroups(groups []*LogGroup, total int64, scale func(int) int64) {
+	for _, g := range groups {
+		scale := scale
+		if g.exact {
+			scale = func(n int) int64 { return int64(n) }
+		}
+		g.Count = scale(g.count)
+		if total > 0 {
+			g.Share = float64(g.Count) * 100 / float64(total)
+		}
+		finishGroups(g.Groups, total, scale)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].Count != groups[j].Count {
+			return groups[i].Count > groups[j].Count
+		}
+		return groups[i].Name < groups[j].Name
+	})
+}
+
+func writeLogGroups(ow io.Writer, groups LogGroups, showGuid bool, asJSON bool) {
+
+	if asJSON {
+		if res, ok := ow.(http.ResponseWriter); ok {
+			res.Header().Set("Content-Type", "application/json")
+		}
+		json.NewEncoder(ow).Encode(groups)
+		return
+	}
+
+	mark := ""
+	if groups.Sampled {
+		mark = "~"
+	}
+	fmt.Fprintf(ow, "Logs by org, space, app and source type, share of all %s%d logs\n", mark, groups.Total)
+
+	var write func(groups []*LogGroup, depth int)
+	write = func(groups []*LogGroup, depth int) {
+		for _, g := range groups {
+			fmt.Fprintf(ow, "%9s %5.1f%% %s", mark+fmt.Sprint(g.Count), g.Share, strings.Repeat("  ", depth))
+			switch depth {
+			case 0:
+				fmt.Fprintf(ow, "org %s", g.Name)
+			case 1:
+				fmt.Fprintf(ow, "space %s", g.Name)
+			default:
+				fmt.Fprint(ow, g.Name)
+			}
+			if showGuid && g.Guid != "" {
+				fmt.Fprintf(ow, "| %s", g.Guid)
+			}
+			fmt.Fprintln(ow)
+			write(g.Groups, depth+1)
+		}
+	}
+	write(groups.Orgs, 0)
+}
+
+/******************************************************************************************/
+
+func (c *LogCounts) ReportLogsByOrg(ow io.Writer, showGuid bool, asJSON bool) {
+
+	c.logMutex.Lock()
+	logList := c.copyLogs()
+	totalLogs := c.totalLogsReceived
+	c.logMutex.Unlock()
+
+	scan := &c.CountScan
+	scale := func(n int) int64 { return int64(math.Round(scan.Estimate(n).Value)) }
+	groups := groupLogs(logList, totalLogs, scan.Sampled(), scale)
+
+	if !asJSON {
+		scan.WriteStatus(ow)
+		if len(logList) == 0 {
+			fmt.Fprintln(ow, "No log data collected")
+			return
+		}
+		scan.WriteSampling(ow)
+	}
+	writeLogGroups(ow, groups, showGuid, asJSON)
+}
+
+func ReportLogsByOrgCombined(ow io.Writer, snapshots []LogsSnapshot, showGuid bool) {
+	var totalLogs int
+	for _, snapshot := range snapshots {
+		totalLogs += snapshot.TotalLogsReceived
+	}
+
+	combined := combineLogs(snapshots)
+	if len(combined) == 0 {
+		fmt.Fprintln(ow, "No log data collected")
+		return
+	}
+
+	exact := func(n int) int64 { return int64(n) }
+	writeLogGroups(ow, groupLogs(SortLogs(combined), totalLogs, false, exact), showGuid, false)
+}
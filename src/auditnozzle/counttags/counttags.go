@@ -1,7 +1,9 @@
 package counttags
 
 import (
+	"auditnozzle/firehose"
 	"auditnozzle/scanengine"
+	"encoding/json"
 	"fmt"
 	"github.com/cloudfoundry/sonde-go/events"
 	"io"
@@ -39,82 +41,128 @@ func (a TagSliceType) Less(i, j int) bool {
 }
 
 /******************************************************************************************/
-var (
-	TagsScan          = scanengine.ScanEngine{Name: "Count Tags"}
-	TotalMsgsReceived int
-	TotalTagsReceived int
-	ReadTagsMap       = make(TagMapType)
-	TagMutex          sync.Mutex
-)
+
+// Each run has its own scan and counts
+type TagCounts struct {
+	TagsScan scanengine.ScanEngine
+
+	// guards everything below, the scan's go routine writes it while reports read it
+	tagMutex          sync.Mutex
+	totalMsgsReceived int
+	totalTagsReceived int
+	readTagsMap       TagMapType
+}
+
+// A new run's empty results
+func New(f *firehose.Foundation) *TagCounts {
+	c := &TagCounts{
+		TagsScan:    scanengine.ScanEngine{Name: "Count Tags", Foundation: f},
+		readTagsMap: make(TagMapType),
+	}
+	c.TagsScan.Sampleable = func(*events.Envelope) bool { return true }
+	c.TagsScan.SeriesColumns = []scanengine.SeriesColumn{{Name: "tagged"}}
+	return c
+}
+
+// The results of the foundation's latest run, empty if there hasn't been one
+func For(f *firehose.Foundation) *TagCounts {
+	if run := scanengine.LatestRun(Scanner.Name, f); run != nil {
+		return run.Results.(*TagCounts)
+	}
+	return New(f)
+}
+
+func (c *TagCounts) Engine() *scanengine.ScanEngine {
+	return &c.TagsScan
+}
+
+var Scanner = scanengine.Scanner{
+	Name:    "tags",
+	Measure: "measuretags",
+	Reports: []scanengine.Report{
+		{Route: "reporttags", Params: "<showjobs (default no)> <series (default no)>", Write: func(r scanengine.Results, req *http.Request, res io.Writer) {
+			r.(*TagCounts).ReportCountedTags(res, scanengine.BoolParm(req, "showjobs", false))
+			r.Engine().WriteSeries(res, scanengine.BoolParm(req, "series", false))
+		}},
+	},
+	New: func(f *firehose.Foundation) scanengine.Results { return New(f) },
+	Start: func(r scanengine.Results, req *http.Request, res io.Writer) error {
+		return r.(*TagCounts).ReadAndCountTags(req, res)
+	},
+}
 
 /******************************************************************************************/
-func ResetData() {
-	TagsScan.Reset()
-	TotalMsgsReceived = 0
+func (c *TagCounts) ResetData() {
+	c.TagsScan.Reset()
 
-	TagMutex.Lock()
+	c.tagMutex.Lock()
 	{
-		ReadTagsMap = make(TagMapType)
+		c.totalMsgsReceived = 0
+		c.totalTagsReceived = 0
+		c.readTagsMap = make(TagMapType)
 	}
-	TagMutex.Unlock()
+	c.tagMutex.Unlock()
 
 }
 
-func ReadAndCountTags(req *http.Request, res io.Writer) {
+func (c *TagCounts) ReadAndCountTags(req *http.Request, res io.Writer) error {
 
-	if err := TagsScan.Start(req, res); err != nil {
-		return
+	if err := c.TagsScan.Start(req, res); err != nil {
+		return err
 	}
 
 	go func() {
-		TagsScan.Run(TagsIterator)
+		c.TagsScan.Run(c.TagsIterator)
 	}()
-
+	return nil
 }
 
-func TagsIterator(msg *events.Envelope) {
-
-	TotalMsgsReceived++
+func (c *TagCounts) TagsIterator(msg *events.Envelope) bool {
 
 	tags := msg.GetTags()
-	if len(tags) == 0 {
-		return
-	}
-
-	TotalTagsReceived++
 	origin := msg.GetOrigin()
 	job := msg.GetJob()
 
-	TagMutex.Lock()
-	defer TagMutex.Unlock()
+	c.tagMutex.Lock()
+	defer c.tagMutex.Unlock()
+
+	c.totalMsgsReceived++
+	if len(tags) == 0 {
+		return true
+	}
+	c.totalTagsReceived++
+	c.TagsScan.Record(0, 1)
 
 	for k, v := range tags {
 		key := origin + job + k + v
 
-		t, ok := ReadTagsMap[key]
+		t, ok := c.readTagsMap[key]
 		if !ok {
 			entry := &TagType{k, v, origin, job, 1}
-			ReadTagsMap[key] = entry
+			c.readTagsMap[key] = entry
 			continue
 		}
 		t.count++
 	}
-
+	return true
 }
 
 /******************************************************************************************/
 
-func ReportCountedTags(ow io.Writer, showJobsFlag bool) {
-	var (
-		tagList TagSliceType
-		outMap  TagMapType
-	)
+func (c *TagCounts) ReportCountedTags(ow io.Writer, showJobsFlag bool) {
+	var outMap TagMapType
 
-	TagsScan.WriteStatus(ow)
+	c.TagsScan.WriteStatus(ow)
 
-	TagMutex.Lock()
-	tmpMap := ReadTagsMap
-	TagMutex.Unlock()
+	// a copy, the scan keeps counting into the map while the report is printed
+	c.tagMutex.Lock()
+	tmpMap := make(TagMapType)
+	for key, t := range c.readTagsMap {
+		entry := *t
+		tmpMap[key] = &entry
+	}
+	totalTags, totalMsgs := c.totalTagsReceived, c.totalMsgsReceived
+	c.tagMutex.Unlock()
 
 	if len(tmpMap) == 0 {
 		fmt.Fprintln(ow, "No tag data collected")
@@ -127,7 +175,15 @@ func ReportCountedTags(ow io.Writer, showJobsFlag bool) {
 		outMap = ConsolidateTags(tmpMap)
 	}
 
-	fmt.Fprintf(ow, "Tags map %3d, tagged messages %8d out of %8d messages\n", len(outMap), TotalTagsReceived, TotalMsgsReceived)
+	c.TagsScan.WriteSampling(ow)
+	PrintTagTable(ow, outMap, showJobsFlag, totalTags, totalMsgs, c.TagsScan.Estimate)
+}
+
+// The counts are scaled by estimate, for a sampled run
+func PrintTagTable(ow io.Writer, outMap TagMapType, showJobsFlag bool, totalTags, totalMsgs int, estimate func(int) scanengine.Estimate) {
+	var tagList TagSliceType
+
+	fmt.Fprintf(ow, "Tags map %3d, tagged messages %8s out of %8s messages\n", len(outMap), estimate(totalTags), estimate(totalMsgs))
 
 	for _, t := range outMap {
 		tagList = append(tagList, t)
@@ -149,8 +205,95 @@ func ReportCountedTags(ow io.Writer, showJobsFlag bool) {
 		if showJobsFlag {
 			fmt.Fprintf(ow, "%-32s|", t.job)
 		}
-		fmt.Fprintf(ow, "%-28s|%-11s|%-18s|%4d|\n", t.origin, t.tagkey, t.tagvalue, t.count)
+		fmt.Fprintf(ow, "%-28s|%-11s|%-18s|%4s|\n", t.origin, t.tagkey, t.tagvalue, estimate(t.count).Short())
+	}
+}
+
+/******************************************************************************************/
+// combining the counts from several app instances sharing the firehose subscription
+
+type TagEntry struct {
+	Key    string
+	Value  string
+	Origin string
+	Job    string
+	Count  int
+}
+
+type TagsSnapshot struct {
+	TotalMsgsReceived int
+	TotalTagsReceived int
+	Tags              []TagEntry
+}
+
+func (c *TagCounts) Snapshot() TagsSnapshot {
+	c.tagMutex.Lock()
+	defer c.tagMutex.Unlock()
+
+	snapshot := TagsSnapshot{
+		TotalMsgsReceived: c.totalMsgsReceived,
+		TotalTagsReceived: c.totalTagsReceived,
+	}
+
+	for _, t := range c.readTagsMap {
+		snapshot.Tags = append(snapshot.Tags, TagEntry{t.tagkey, t.tagvalue, t.origin, t.job, t.count})
+	}
+	return snapshot
+}
+
+// Saved across a restart as a snapshot
+func (c *TagCounts) SaveData() ([]byte, error) {
+	return json.Marshal(c.Snapshot())
+}
+
+func (c *TagCounts) RestoreData(data []byte) error {
+	var snapshot TagsSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return err
+	}
+
+	c.tagMutex.Lock()
+	defer c.tagMutex.Unlock()
+
+	c.totalMsgsReceived = snapshot.TotalMsgsReceived
+	c.totalTagsReceived = snapshot.TotalTagsReceived
+	for _, t := range snapshot.Tags {
+		c.readTagsMap[t.Origin+t.Job+t.Key+t.Value] = &TagType{t.Key, t.Value, t.Origin, t.Job, t.Count}
+	}
+	return nil
+}
+
+func ReportCountedTagsCombined(ow io.Writer, snapshots []TagsSnapshot, showJobsFlag bool) {
+	var totalMsgs, totalTags int
+
+	combined := make(TagMapType)
+
+	for _, snapshot := range snapshots {
+		totalMsgs += snapshot.TotalMsgsReceived
+		totalTags += snapshot.TotalTagsReceived
+
+		for _, t := range snapshot.Tags {
+			key := t.Origin + t.Job + t.Key + t.Value
+
+			entry, ok := combined[key]
+			if !ok {
+				combined[key] = &TagType{t.Key, t.Value, t.Origin, t.Job, t.Count}
+				continue
+			}
+			entry.count += t.Count
+		}
 	}
+
+	if len(combined) == 0 {
+		fmt.Fprintln(ow, "No tag data collected")
+		return
+	}
+
+	if !showJobsFlag {
+		combined = ConsolidateTags(combined)
+	}
+
+	PrintTagTable(ow, combined, showJobsFlag, totalTags, totalMsgs, exact)
 }
 
 // take each set of name/index and consolidate
@@ -181,3 +324,8 @@ func ConsolidateTags(mapIn TagMapType) TagMapType {
 	return mapOut
 
 }
+
+// Counts combined from other instances are printed as they are
+func exact(count int) scanengine.Estimate {
+	return scanengine.Estimate{Value: float64(count), Low: float64(count), High: float64(count)}
+}
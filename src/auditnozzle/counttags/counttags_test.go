@@ -0,0 +1,27 @@
+package counttags
+
+import (
+	"auditnozzle/fakecf"
+	"auditnozzle/scantest"
+	"testing"
+	"time"
+)
+
+// Each origin's tags are counted, envelopes without tags are only in the total
+func TestMeasureAndReportTags(t *testing.T) {
+	server, f := scantest.StartFakeCF(t, fakecf.Merge(
+		fakecf.CountersWithGaps("MetronAgent", "metron", "0", "dropsondeMarshaller.sentEnvelopes", map[string]string{"event_type": "LogMessage"}, 20, 5, nil, 10*time.Millisecond),
+		fakecf.CountersWithGaps("DopplerServer", "doppler", "0", "listeners.receivedEnvelopes", map[string]string{"event_type": "ValueMetric"}, 20, 3, nil, 10*time.Millisecond),
+		fakecf.LogMessages(fakecf.DefaultApps[0].Guid, "APP", 10, 10*time.Millisecond),
+	))
+	defer server.Close()
+
+	run := scantest.Measure(t, Scanner, f, "runtime=30s&count=18")
+	scantest.WaitEnded(t, run)
+
+	scantest.WaitReport(t, Scanner, run, "reporttags", "",
+		[]string{"Tags", "map", "2,", "tagged", "messages", "8", "out", "of", "18", "messages"},
+		[]string{"MetronAgent", "|event_type", "|LogMessage", "|", "5|"},
+		[]string{"DopplerServer", "|event_type", "|ValueMetric", "|", "3|"},
+	)
+}
@@ -0,0 +1,52 @@
+/**********
+
+Runs the fake Cloud Foundry on this machine so the nozzle can be tried without a foundation:
+
+	go run auditnozzle/fakecf/fakecf -repeat 60
+
+then start auditnozzle with the environment it prints. With -v2 the script includes what only the RLP
+gateway sends; set ENVELOPE_SOURCE=rlp to read it.
+
+*/
+
+package main
+
+import (
+	"auditnozzle/fakecf"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+)
+
+func main() {
+
+	repeat := flag.Int("repeat", 60, "number of times to play the ten second default script")
+	v2 := flag.Bool("v2", false, "add multi-value gauges and events, sent only by the RLP gateway")
+	flag.Parse()
+
+	script := fakecf.DefaultScript()
+	if *v2 {
+		script = fakecf.DefaultV2Script()
+	}
+
+	server := fakecf.NewServer(fakecf.Repeat(script, *repeat))
+	defer server.Close()
+
+	for _, app := range fakecf.DefaultApps {
+		server.AddApp(app)
+	}
+	for _, space := range fakecf.DefaultSpaces {
+		server.AddSpace(space)
+	}
+	for _, org := range fakecf.DefaultOrgs {
+		server.AddOrg(org)
+	}
+
+	fmt.Fprintln(os.Stdout, "fake Cloud Foundry running, start auditnozzle with:")
+	fmt.Fprintf(os.Stdout, "export API_ENDPOINT=%s USER_ID=admin USER_PASSWORD=admin SKIP_SSL_VALIDATION=true PORT=8080 RLP_GATEWAY=%s\n", server.CC.URL, server.RLPGateway.URL)
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	<-interrupt
+}
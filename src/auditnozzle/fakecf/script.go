@@ -0,0 +1,293 @@
+package fakecf
+
+import (
+	"fmt"
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+	"sort"
+	"strconv"
+	"time"
+)
+
+/********************************************************************************************************
+* Scripted envelope sequences for the fake TrafficController and RLP gateway
+ */
+
+type Step struct {
+	// wait this long before sending
+	Delay time.Duration
+
+	Envelope *events.Envelope
+
+	// envelopes without a timestamp are stamped when sent, offset by Skew
+	Skew time.Duration
+
+	// a v2 envelope, as the gateway sends it as JSON, for what v1 has no envelope for. Only the RLP
+	// gateway sends these; v1 envelopes are converted for it
+	V2 map[string]interface{}
+
+	// drop the connection instead of sending an envelope
+	Disconnect bool
+}
+
+type Script []Step
+
+func Concat(scripts ...Script) Script {
+	var all Script
+	for _, s := range scripts {
+		all = append(all, s...)
+	}
+	return all
+}
+
+func Repeat(script Script, n int) Script {
+	var all Script
+	for i := 0; i < n; i++ {
+		all = append(all, script...)
+	}
+	return all
+}
+
+// Interleave scripts as if they were running at the same time, each keeping its own spacing
+func Merge(scripts ...Script) Script {
+	type timedStep struct {
+		at   time.Duration
+		step Step
+	}
+	var timed []timedStep
+
+	for _, script := range scripts {
+		var at time.Duration
+		for _, step := range script {
+			at += step.Delay
+			timed = append(timed, timedStep{at, step})
+		}
+	}
+
+	sort.SliceStable(timed, func(i, j int) bool { return timed[i].at < timed[j].at })
+
+	var merged Script
+	var last time.Duration
+	for _, t := range timed {
+		t.step.Delay = t.at - last
+		last = t.at
+		merged = append(merged, t.step)
+	}
+	return merged
+}
+
+// Shift every envelope timestamp, as if the sender's clock was off by skew
+func Skewed(script Script, skew time.Duration) Script {
+	var out Script
+	for _, step := range script {
+		step.Skew += skew
+		out = append(out, step)
+	}
+	return out
+}
+
+func Disconnect() Script {
+	return Script{{Disconnect: true}}
+}
+
+func Pause(d time.Duration) Script {
+	return Script{{Delay: d}}
+}
+
+/******************************************************************************************/
+
+// The timestamp is filled in when the step is sent, so latency measured against a script is close to zero
+func NewEnvelope(origin, job, index string, eventType events.Envelope_EventType) *events.Envelope {
+	return &events.Envelope{
+		Origin:     proto.String(origin),
+		EventType:  eventType.Enum(),
+		Deployment: proto.String("cf"),
+		Job:        proto.String(job),
+		Index:      proto.String(index),
+		Ip:         proto.String("10.0.0.1"),
+	}
+}
+
+func LogMessages(appGuid, sourceType string, n int, every time.Duration) Script {
+	var script Script
+
+	for i := 0; i < n; i++ {
+		env := NewEnvelope("DopplerServer", "doppler", "0", events.Envelope_LogMessage)
+		env.LogMessage = &events.LogMessage{
+			Message:     []byte("log line from " + appGuid),
+			MessageType: events.LogMessage_OUT.Enum(),
+			AppId:       proto.String(appGuid),
+			SourceType:  proto.String(sourceType),
+		}
+		script = append(script, Step{Delay: every, Envelope: env})
+	}
+	return script
+}
+
+// The system message Doppler sends when Metron couldn't deliver
+func DroppedMessages(count int) Script {
+	env := NewEnvelope("DopplerServer", "doppler", "0", events.Envelope_LogMessage)
+	env.LogMessage = &events.LogMessage{
+		Message:     []byte("Dropped " + strconv.Itoa(count) + " message(s) from MetronAgent to Doppler"),
+		MessageType: events.LogMessage_ERR.Enum(),
+		AppId:       proto.String("system"),
+		SourceType:  proto.String("DOP"),
+	}
+	return Script{{Envelope: env}}
+}
+
+// One counter envelope per total, as sent, with the delta from the previous total. Go back to a small total
+// to script a restart
+func Counters(origin, job, index, name string, tags map[string]string, totals []uint64, every time.Duration) Script {
+	var script Script
+	var last uint64
+
+	for i, total := range totals {
+		delta := total
+		if i > 0 && total >= last {
+			delta = total - last
+		}
+		last = total
+
+		env := NewEnvelope(origin, job, index, events.Envelope_CounterEvent)
+		env.Tags = tags
+		env.CounterEvent = &events.CounterEvent{
+			Name:  proto.String(name),
+			Delta: proto.Uint64(delta),
+			Total: proto.Uint64(total),
+		}
+		script = append(script, Step{Delay: every, Envelope: env})
+	}
+	return script
+}
+
+// totals delta, 2*delta ... with the envelopes at the positions in missing lost on the way
+func CountersWithGaps(origin, job, index, name string, tags map[string]string, delta uint64, n int, missing []int, every time.Duration) Script {
+	var totals []uint64
+	var script Script
+
+	for i := 1; i <= n; i++ {
+		totals = append(totals, uint64(i)*delta)
+	}
+
+	skip := make(map[int]bool)
+	for _, m := range missing {
+		skip[m] = true
+	}
+
+	for i, step := range Counters(origin, job, index, name, tags, totals, every) {
+		if !skip[i] {
+			script = append(script, step)
+		}
+	}
+	return script
+}
+
+func ValueMetrics(origin, job, index, name string, n int, every time.Duration) Script {
+	var script Script
+
+	for i := 0; i < n; i++ {
+		env := NewEnvelope(origin, job, index, events.Envelope_ValueMetric)
+		env.ValueMetric = &events.ValueMetric{
+			Name:  proto.String(name),
+			Value: proto.Float64(float64(i)),
+			Unit:  proto.String("count"),
+		}
+		script = append(script, Step{Delay: every, Envelope: env})
+	}
+	return script
+}
+
+// A v2 gauge carrying several values in one envelope
+func Gauges(sourceId, instanceId string, metrics map[string]float64, n int, every time.Duration) Script {
+	var script Script
+
+	for i := 0; i < n; i++ {
+		values := make(map[string]interface{})
+		for name, value := range metrics {
+			values[name] = map[string]interface{}{"unit": "count", "value": value + float64(i)}
+		}
+		script = append(script, Step{Delay: every, V2: map[string]interface{}{
+			"source_id":   sourceId,
+			"instance_id": instanceId,
+			"tags":        map[string]string{"deployment": "cf", "job": sourceId, "index": instanceId},
+			"gauge":       map[string]interface{}{"metrics": values},
+		}})
+	}
+	return script
+}
+
+func Events(sourceId, title, body string) Script {
+	return Script{{V2: map[string]interface{}{
+		"source_id": sourceId,
+		"event":     map[string]string{"title": title, "body": body},
+	}}}
+}
+
+// v2 timers for requests to an app, with the tags gorouter gives them
+func Timers(appGuid string, n int, every time.Duration) Script {
+	var script Script
+
+	start := time.Now().UnixNano()
+	for i := 0; i < n; i++ {
+		script = append(script, Step{Delay: every, V2: map[string]interface{}{
+			"source_id":   appGuid,
+			"instance_id": "0",
+			"tags": map[string]string{
+				"deployment":     "cf",
+				"job":            "router",
+				"request_id":     fmt.Sprintf("%08x-0000-4000-8000-000000000000", i+1),
+				"peer_type":      "Client",
+				"method":         "POST",
+				"uri":            "https://app.example.com/orders",
+				"remote_address": "10.0.1.2:53012",
+				"user_agent":     "curl/7.64.1",
+				"status_code":    "201",
+				"content_length": "512",
+			},
+			"timer": map[string]interface{}{
+				"name":  "http",
+				"start": strconv.FormatInt(start+int64(i)*int64(time.Millisecond), 10),
+				"stop":  strconv.FormatInt(start+int64(i+5)*int64(time.Millisecond), 10),
+			},
+		}})
+	}
+	return script
+}
+
+/******************************************************************************************/
+
+var DefaultApps = []App{
+	{Guid: "11111111-1111-1111-1111-111111111111", Name: "chatty-app", SpaceGuid: "space-1"},
+	{Guid: "22222222-2222-2222-2222-222222222222", Name: "quiet-app", SpaceGuid: "space-1"},
+}
+
+var DefaultSpaces = []Space{{Guid: "space-1", Name: "dev", OrgGuid: "org-1"}}
+
+var DefaultOrgs = []Org{{Guid: "org-1", Name: "demo"}}
+
+// Ten seconds of a small foundation: two apps logging, Metron and Doppler log counters (one with a lost
+// envelope), a value metric every second and a component whose clock is two seconds behind
+func DefaultScript() Script {
+	logTags := map[string]string{"event_type": "LogMessage"}
+
+	return Merge(
+		LogMessages(DefaultApps[0].Guid, "APP", 100, 100*time.Millisecond),
+		LogMessages(DefaultApps[1].Guid, "APP", 5, 2*time.Second),
+		LogMessages(DefaultApps[0].Guid, "RTR", 20, 500*time.Millisecond),
+		Concat(Pause(5*time.Second), DroppedMessages(12)),
+		CountersWithGaps("MetronAgent", "metron", "0", "dropsondeMarshaller.sentEnvelopes", logTags, 20, 10, []int{4}, time.Second),
+		CountersWithGaps("DopplerServer", "doppler", "0", "listeners.receivedEnvelopes", logTags, 20, 10, nil, time.Second),
+		ValueMetrics("DopplerServer", "doppler", "0", "memoryStats.numBytesAllocated", 10, time.Second),
+		Skewed(ValueMetrics("bbs", "database", "0", "LRPsRunning", 10, time.Second), -2*time.Second),
+	)
+}
+
+// The default script with what only the RLP gateway can send: a multi-value gauge and an event
+func DefaultV2Script() Script {
+	return Merge(
+		DefaultScript(),
+		Gauges("cell-1", "0", map[string]float64{"cpu": 10, "memory": 512, "disk": 1024}, 10, time.Second),
+		Concat(Pause(3*time.Second), Events("cloud_controller", "app crashed", DefaultApps[1].Name+" exited with status 1")),
+	)
+}
@@ -0,0 +1,586 @@
+package fakecf
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/********************************************************************************************************
+* A local stand in for the parts of Cloud Foundry the nozzle talks to: the cloud controller (/v2/info and the
+* app, space and org records, for cfclient), UAA (/oauth/token), TrafficController (the noaa firehose
+* websocket) and the RLP gateway (v2 envelopes as server sent events).
+*
+* Connections to the firehose with the same subscription id share one pass through the script, the way
+* Loggregator shares a subscription between its connections. The same goes for RLP connections with the same
+* shard id, which get their own pass. Close ends the passes and the connections still open
+ */
+
+var DefaultScopes = []string{"doppler.firehose", "cloud_controller.admin_read_only"}
+
+type App struct {
+	Guid      string
+	Name      string
+	SpaceGuid string
+}
+
+type Space struct {
+	Guid    string
+	Name    string
+	OrgGuid string
+}
+
+type Org struct {
+	Guid string
+	Name string
+}
+
+type Server struct {
+	CC                *httptest.Server
+	UAA               *httptest.Server
+	TrafficController *httptest.Server
+	RLPGateway        *httptest.Server
+
+	mutex         sync.Mutex
+	script        Script
+	scopes        []string
+	apps          map[string]App
+	spaces        map[string]Space
+	orgs          map[string]Org
+	tokens        map[string]bool
+	tokenCount    int
+	subscriptions map[string]chan Step
+	connections   int
+	tokenRequests int
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func NewServer(script Script) *Server {
+	s := &Server{
+		script:        script,
+		scopes:        DefaultScopes,
+		apps:          make(map[string]App),
+		spaces:        make(map[string]Space),
+		orgs:          make(map[string]Org),
+		tokens:        make(map[string]bool),
+		subscriptions: make(map[string]chan Step),
+		closed:        make(chan struct{}),
+	}
+
+	s.UAA = httptest.NewServer(http.HandlerFunc(s.serveUAA))
+	s.TrafficController = httptest.NewServer(http.HandlerFunc(s.serveFirehose))
+	s.RLPGateway = httptest.NewServer(http.HandlerFunc(s.serveRLP))
+	s.CC = httptest.NewServer(http.HandlerFunc(s.serveCC))
+	return s
+}
+
+// The script's go routines and the open connections end first, httptest waits for the handlers to return
+func (s *Server) Close() {
+	s.closeOnce.Do(func() { close(s.closed) })
+	s.CC.Close()
+	s.UAA.Close()
+	s.TrafficController.Close()
+	s.RLPGateway.Close()
+}
+
+// Points the nozzle's environment at this server
+func (s *Server) SetEnv() {
+	os.Setenv("API_ENDPOINT", s.CC.URL)
+	os.Setenv("USER_ID", "admin")
+	os.Setenv("USER_PASSWORD", "admin")
+	os.Setenv("SKIP_SSL_VALIDATION", "true")
+	os.Setenv("RLP_GATEWAY", s.RLPGateway.URL)
+}
+
+func (s *Server) AddApp(app App) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.apps[app.Guid] = app
+}
+
+func (s *Server) AddSpace(space Space) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.spaces[space.Guid] = space
+}
+
+func (s *Server) AddOrg(org Org) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.orgs[org.Guid] = org
+}
+
+func (s *Server) SetScopes(scopes ...string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.scopes = scopes
+}
+
+// Tokens handed out so far are refused from now on, as if they had expired
+func (s *Server) ExpireTokens() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.tokens = make(map[string]bool)
+}
+
+func (s *Server) Connections() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.connections
+}
+
+func (s *Server) TokenRequests() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.tokenRequests
+}
+
+/******************************************************************************************/
+// UAA
+
+func (s *Server) serveUAA(w http.ResponseWriter, r *http.Request) {
+
+	if r.URL.Path != "/oauth/token" {
+		http.NotFound(w, r)
+		return
+	}
+
+	s.mutex.Lock()
+	s.tokenCount++
+	s.tokenRequests++
+	token := FakeJWT(s.scopes, s.tokenCount)
+	s.tokens[token] = true
+	scopes := s.scopes
+	s.mutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token":  token,
+		"token_type":    "bearer",
+		"refresh_token": "refresh",
+		"expires_in":    3600,
+		"scope":         strings.Join(scopes, " "),
+	})
+}
+
+// Unsigned, but with the claims the nozzle reads
+func FakeJWT(scopes []string, serial int) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`))
+	claims, _ := json.Marshal(map[string]interface{}{
+		"scope": scopes,
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"jti":   fmt.Sprintf("fake-%d", serial),
+	})
+	return header + "." + base64.RawURLEncoding.EncodeToString(claims) + ".fake"
+}
+
+func (s *Server) validToken(r *http.Request) bool {
+	auth := r.Header.Get("Authorization")
+	if i := strings.Index(auth, " "); i >= 0 {
+		auth = auth[i+1:]
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.tokens[auth]
+}
+
+/******************************************************************************************/
+// cloud controller
+
+func (s *Server) serveCC(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.URL.Path == "/v2/info" {
+		json.NewEncoder(w).Encode(map[string]string{
+			"authorization_endpoint":   s.UAA.URL,
+			"token_endpoint":           s.UAA.URL,
+			"doppler_logging_endpoint": "ws" + strings.TrimPrefix(s.TrafficController.URL, "http"),
+		})
+		return
+	}
+
+	if !s.validToken(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// the lists are a single page. Of the queries only q=guid IN <guids>, for apps, is applied
+	switch r.URL.Path {
+	case "/v2/apps":
+		guids := guidQuery(r)
+		var resources []interface{}
+		for _, app := range s.apps {
+			if guids == nil || guids[app.Guid] {
+				resources = append(resources, s.appResource(app))
+			}
+		}
+		json.NewEncoder(w).Encode(listResponse(resources))
+		return
+	case "/v2/spaces":
+		var resources []interface{}
+		for _, space := range s.spaces {
+			resources = append(resources, s.spaceResource(space))
+		}
+		json.NewEncoder(w).Encode(listResponse(resources))
+		return
+	case "/v2/organizations":
+		var resources []interface{}
+		for _, org := range s.orgs {
+			resources = append(resources, orgResource(org))
+		}
+		json.NewEncoder(w).Encode(listResponse(resources))
+		return
+	}
+
+	if strings.HasPrefix(r.URL.Path, "/v2/apps/") {
+		guid := strings.TrimPrefix(r.URL.Path, "/v2/apps/")
+
+		app, ok := s.apps[guid]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, `{"code":100004,"description":"The app could not be found: %s","error_code":"CF-AppNotFound"}`, guid)
+			return
+		}
+		json.NewEncoder(w).Encode(s.appResource(app))
+		return
+	}
+
+	if strings.HasPrefix(r.URL.Path, "/v2/spaces/") {
+		guid := strings.TrimPrefix(r.URL.Path, "/v2/spaces/")
+
+		space, ok := s.spaces[guid]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, `{"code":40004,"description":"The app space could not be found: %s","error_code":"CF-SpaceNotFound"}`, guid)
+			return
+		}
+		json.NewEncoder(w).Encode(s.spaceResource(space))
+		return
+	}
+
+	if strings.HasPrefix(r.URL.Path, "/v2/organizations/") {
+		guid := strings.TrimPrefix(r.URL.Path, "/v2/organizations/")
+
+		org, ok := s.orgs[guid]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, `{"code":30003,"description":"The organization could not be found: %s","error_code":"CF-OrganizationNotFound"}`, guid)
+			return
+		}
+		json.NewEncoder(w).Encode(orgResource(org))
+		return
+	}
+
+	http.NotFound(w, r)
+}
+
+// nil without q=guid IN
+func guidQuery(r *http.Request) map[string]bool {
+	q := r.URL.Query().Get("q")
+	if !strings.HasPrefix(q, "guid IN ") {
+		return nil
+	}
+	guids := make(map[string]bool)
+	for _, guid := range strings.Split(strings.TrimPrefix(q, "guid IN "), ",") {
+		guids[guid] = true
+	}
+	return guids
+}
+
+func listResponse(resources []interface{}) map[string]interface{} {
+	if resources == nil {
+		resources = []interface{}{}
+	}
+	return map[string]interface{}{
+		"total_results": len(resources),
+		"total_pages":   1,
+		"next_url":      "",
+		"resources":     resources,
+	}
+}
+
+// The app with its space and org inline, as inline-relations-depth=2 gives them. Caller holds the mutex
+func (s *Server) appResource(app App) map[string]interface{} {
+	return map[string]interface{}{
+		"metadata": map[string]string{"guid": app.Guid},
+		"entity": map[string]interface{}{
+			"name":       app.Name,
+			"space_guid": app.SpaceGuid,
+			"space":      s.spaceResource(s.spaces[app.SpaceGuid]),
+		},
+	}
+}
+
+// caller holds the mutex
+func (s *Server) spaceResource(space Space) map[string]interface{} {
+	return map[string]interface{}{
+		"metadata": map[string]string{"guid": space.Guid},
+		"entity": map[string]interface{}{
+			"name":              space.Name,
+			"organization_guid": space.OrgGuid,
+			"organization":      orgResource(s.orgs[space.OrgGuid]),
+		},
+	}
+}
+
+func orgResource(org Org) map[string]interface{} {
+	return map[string]interface{}{
+		"metadata": map[string]string{"guid": org.Guid},
+		"entity":   map[string]string{"name": org.Name},
+	}
+}
+
+/******************************************************************************************/
+// TrafficController
+
+var upgrader = websocket.Upgrader{}
+
+func (s *Server) serveFirehose(w http.ResponseWriter, r *http.Request) {
+
+	if !strings.HasPrefix(r.URL.Path, "/firehose/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	// noaa turns a 401 on the handshake into an UnauthorizedError
+	if !s.validToken(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, "You are not authorized. Error: Invalid authorization")
+		return
+	}
+
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer ws.Close()
+
+	steps := s.subscription(strings.TrimPrefix(r.URL.Path, "/firehose/"), false)
+
+	s.mutex.Lock()
+	s.connections++
+	s.mutex.Unlock()
+
+	// notice the client going away
+	gone := make(chan struct{})
+	go func() {
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				close(gone)
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case step := <-steps:
+			if step.Disconnect {
+				return
+			}
+
+			data, err := proto.Marshal(stamped(step))
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "fakecf: script envelope doesn't marshal: %v\n", err)
+				return
+			}
+			if err := ws.WriteMessage(websocket.BinaryMessage, data); err != nil {
+				return
+			}
+
+		case <-gone:
+			return
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+// A copy of the step's envelope with the timestamps a real one would carry, the log message's as well
+func stamped(step Step) *events.Envelope {
+	env := *step.Envelope
+	if env.Timestamp == nil {
+		env.Timestamp = proto.Int64(time.Now().Add(step.Skew).UnixNano())
+	}
+	if env.LogMessage != nil && env.LogMessage.Timestamp == nil {
+		log := *env.LogMessage
+		log.Timestamp = env.Timestamp
+		env.LogMessage = &log
+	}
+	return &env
+}
+
+// The script for a subscription is played once, by whichever of its connections is ready, until the server
+// is closed. v2 only steps are skipped for the firehose
+func (s *Server) subscription(id string, v2 bool) chan Step {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := "firehose/" + id
+	if v2 {
+		key = "rlp/" + id
+	}
+
+	steps, ok := s.subscriptions[key]
+	if ok {
+		return steps
+	}
+
+	steps = make(chan Step)
+	s.subscriptions[key] = steps
+
+	script := s.script
+	go func() {
+		for _, step := range script {
+			select {
+			case <-time.After(step.Delay):
+			case <-s.closed:
+				return
+			}
+			if step.Envelope == nil && !step.Disconnect && (!v2 || step.V2 == nil) {
+				continue
+			}
+			select {
+			case steps <- step:
+			case <-s.closed:
+				return
+			}
+		}
+	}()
+
+	return steps
+}
+
+/******************************************************************************************/
+// RLP gateway
+
+func (s *Server) serveRLP(w http.ResponseWriter, r *http.Request) {
+
+	if r.URL.Path != "/v2/read" {
+		http.NotFound(w, r)
+		return
+	}
+
+	if !s.validToken(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	steps := s.subscription(r.URL.Query().Get("shard_id"), true)
+
+	s.mutex.Lock()
+	s.connections++
+	s.mutex.Unlock()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case step := <-steps:
+			if step.Disconnect {
+				return
+			}
+
+			v2 := step.V2
+			if v2 == nil {
+				v2 = V2FromV1(step.Envelope)
+			}
+			if _, ok := v2["timestamp"]; !ok {
+				v2["timestamp"] = strconv.FormatInt(time.Now().Add(step.Skew).UnixNano(), 10)
+			}
+
+			data, err := json.Marshal(map[string]interface{}{"batch": []interface{}{v2}})
+			if err != nil {
+				return
+			}
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+				return
+			}
+			flusher.Flush()
+
+		case <-r.Context().Done():
+			return
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+// The v2 JSON the gateway would send for a v1 envelope. 64 bit numbers are strings, as the gateway sends them
+func V2FromV1(env *events.Envelope) map[string]interface{} {
+
+	tags := map[string]string{
+		"origin":     env.GetOrigin(),
+		"deployment": env.GetDeployment(),
+		"job":        env.GetJob(),
+		"index":      env.GetIndex(),
+		"ip":         env.GetIp(),
+	}
+	for k, v := range env.GetTags() {
+		tags[k] = v
+	}
+
+	v2 := map[string]interface{}{
+		"source_id":   env.GetOrigin(),
+		"instance_id": env.GetIndex(),
+		"tags":        tags,
+	}
+	if env.Timestamp != nil {
+		v2["timestamp"] = strconv.FormatInt(env.GetTimestamp(), 10)
+	}
+
+	switch env.GetEventType() {
+	case events.Envelope_LogMessage:
+		log := env.GetLogMessage()
+		tags["source_type"] = log.GetSourceType()
+		v2["source_id"] = log.GetAppId()
+		v2["instance_id"] = log.GetSourceInstance()
+		v2["log"] = map[string]string{
+			"payload": base64.StdEncoding.EncodeToString(log.GetMessage()),
+			"type":    log.GetMessageType().String(),
+		}
+
+	case events.Envelope_CounterEvent:
+		counter := env.GetCounterEvent()
+		v2["counter"] = map[string]string{
+			"name":  counter.GetName(),
+			"delta": strconv.FormatUint(counter.GetDelta(), 10),
+			"total": strconv.FormatUint(counter.GetTotal(), 10),
+		}
+
+	case events.Envelope_ValueMetric:
+		metric := env.GetValueMetric()
+		v2["gauge"] = map[string]interface{}{
+			"metrics": map[string]interface{}{
+				metric.GetName(): map[string]interface{}{"unit": metric.GetUnit(), "value": metric.GetValue()},
+			},
+		}
+	}
+
+	return v2
+}
@@ -0,0 +1,179 @@
+package firehose
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/cloudfoundry-community/go-cfclient"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const FirehoseScope = "doppler.firehose"
+
+// Any one of these lets the resolver read app records from the cloud controller
+var NameLookupScopes = []string{"cloud_controller.admin", "cloud_controller.admin_read_only", "cloud_controller.global_auditor"}
+
+var ErrNoNameLookupScope = errors.New("credentials lack a cloud_controller read scope (" + strings.Join(NameLookupScopes, ", ") + "), app names not available")
+
+/******************************************************************************************/
+
+// Either a UAA user (password grant) or a UAA client (client_credentials grant)
+type Credentials struct {
+	ApiEndpoint       string `yaml:"api_endpoint"`
+	UserName          string `yaml:"user_id"`
+	Password          string `yaml:"user_password"`
+	ClientId          string `yaml:"client_id"`
+	ClientSecret      string `yaml:"client_secret"`
+	SkipSSLValidation bool   `yaml:"skip_ssl_validation"`
+}
+
+func CredentialsFromEnv() (Credentials, error) {
+
+	skipSSLValidation, err := strconv.ParseBool(os.Getenv("SKIP_SSL_VALIDATION"))
+	if err != nil {
+		skipSSLValidation = false
+	}
+
+	creds := Credentials{
+		ApiEndpoint:       os.Getenv("API_ENDPOINT"),
+		UserName:          os.Getenv("USER_ID"),
+		Password:          os.Getenv("USER_PASSWORD"),
+		ClientId:          os.Getenv("CLIENT_ID"),
+		ClientSecret:      os.Getenv("CLIENT_SECRET"),
+		SkipSSLValidation: skipSSLValidation,
+	}
+
+	if err := creds.Validate(); err != nil {
+		return creds, errors.New("Must set environment variables API_ENDPOINT and either CLIENT_ID, CLIENT_SECRET or USER_ID, USER_PASSWORD")
+	}
+	return creds, nil
+}
+
+func (c Credentials) Validate() error {
+	if c.ApiEndpoint == "" || !c.IsClient() && (c.UserName == "" || c.Password == "") {
+		return errors.New("need an API endpoint and either a client id and secret or a user id and password")
+	}
+	return nil
+}
+
+func (c Credentials) IsClient() bool {
+	return c.ClientId != "" && c.ClientSecret != ""
+}
+
+func (c Credentials) String() string {
+	if c.IsClient() {
+		return "client " + c.ClientId
+	}
+	return "user " + c.UserName
+}
+
+// cfclient uses the client_credentials grant when a client id is set, and the password grant otherwise
+func (c Credentials) Config() cfclient.Config {
+	config := cfclient.Config{
+		ApiAddress:        c.ApiEndpoint,
+		SkipSslValidation: c.SkipSSLValidation,
+	}
+
+	if c.IsClient() {
+		config.ClientID = c.ClientId
+		config.ClientSecret = c.ClientSecret
+	} else {
+		config.Username = c.UserName
+		config.Password = c.Password
+	}
+	return config
+}
+
+// A token straight from UAA with the same grant cfclient uses, rather than the one cfclient has cached.
+// Returned as "bearer <token>", as cfclient returns it
+func (c Credentials) NewToken(tokenEndpoint string) (string, error) {
+
+	httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: c.SkipSSLValidation}}}
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, httpClient)
+	tokenURL := strings.TrimRight(tokenEndpoint, "/") + "/oauth/token"
+
+	var token *oauth2.Token
+	var err error
+	if c.IsClient() {
+		config := clientcredentials.Config{ClientID: c.ClientId, ClientSecret: c.ClientSecret, TokenURL: tokenURL}
+		token, err = config.Token(ctx)
+	} else {
+		config := oauth2.Config{ClientID: "cf", Endpoint: oauth2.Endpoint{TokenURL: tokenURL}}
+		token, err = config.PasswordCredentialsToken(ctx, c.UserName, c.Password)
+	}
+	if err != nil {
+		return "", err
+	}
+	return "bearer " + token.AccessToken, nil
+}
+
+/******************************************************************************************/
+// scope checks
+
+// Reads the scope claim out of a UAA access token. The signature isn't checked, UAA has already done that
+// for us and we only use the result to give a better error message
+func TokenScopes(token string) ([]string, error) {
+
+	token = strings.TrimSpace(token)
+	if i := strings.Index(token, " "); i >= 0 {
+		token = token[i+1:]
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("token is not a JWT")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, err
+	}
+
+	var claims struct {
+		Scope []string `json:"scope"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, err
+	}
+	return claims.Scope, nil
+}
+
+func HasScope(scopes []string, wanted ...string) bool {
+	for _, s := range scopes {
+		for _, w := range wanted {
+			if s == w {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// The firehose scope is required. A missing cloud controller read scope only costs us the app names,
+// so it is returned as a warning instead
+func CheckScopes(creds Credentials, token string) (warning error, err error) {
+
+	scopes, err := TokenScopes(token)
+	if err != nil {
+		// not a token we can read, let TrafficController decide
+		fmt.Fprintf(os.Stderr, "unable to read scopes from token: %s\n", err)
+		return nil, nil
+	}
+
+	if !HasScope(scopes, FirehoseScope) {
+		return nil, fmt.Errorf("%s does not have the %s authority needed to read the firehose (has: %s)", creds, FirehoseScope, strings.Join(scopes, " "))
+	}
+
+	if !HasScope(scopes, NameLookupScopes...) {
+		return fmt.Errorf("%s: %s", creds, ErrNoNameLookupScope), nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,295 @@
+package firehose
+
+import (
+	"fmt"
+	"github.com/cloudfoundry/sonde-go/events"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/********************************************************************************************************
+* All scanners on a foundation share one upstream firehose subscription. Every envelope read from it is offered to each
+* subscriber's own buffer; a subscriber that can't keep up loses envelopes (and counts them) rather than
+* slowing down the others.
+*
+* The subscription can be opened over several connections (shards). Loggregator splits the envelopes for a
+* subscription id between every connection using it, including connections from other instances of this app.
+* The connections are to the v1 firehose or, with envelope_source rlp, the v2 RLP gateway
+ */
+
+const (
+	SubscriberBufferSize  = 10000
+	DefaultSubscriptionId = "auditnozzle"
+)
+
+type Subscription struct {
+	Name      string
+	StartTime time.Time
+
+	hub         *Hub
+	msgChan     chan *events.Envelope
+	connections []Upstream
+	received    uint64
+	dropped     uint64
+
+	// unix nanos of the first envelope dropped since the buffer last had room, 0 when it has room
+	fullSince int64
+	fullTime  int64
+}
+
+type Hub struct {
+	mutex       sync.RWMutex
+	foundation  *Foundation
+	connections []Upstream
+	subscribers []*Subscription
+	opening     *hubOpening
+}
+
+// Set while the first subscriber opens the upstream, which is done without holding the hub's lock. Others
+// subscribing meanwhile wait on done and share the outcome
+type hubOpening struct {
+	done chan struct{}
+	err  error
+}
+
+/******************************************************************************************/
+
+// The upstream connection is opened by the first subscriber and closed when the last one leaves. Opening
+// authenticates and dials every shard, the lock is only taken to publish the connections, so status and
+// the other foundations' subscribers aren't held up
+func (h *Hub) Subscribe(name string) (*Subscription, error) {
+	h.mutex.Lock()
+	for len(h.connections) == 0 {
+		if opening := h.opening; opening != nil {
+			h.mutex.Unlock()
+			<-opening.done
+			if opening.err != nil {
+				return nil, opening.err
+			}
+			h.mutex.Lock()
+			continue
+		}
+
+		opening := &hubOpening{done: make(chan struct{})}
+		h.opening = opening
+		h.mutex.Unlock()
+
+		connections, err := h.open()
+
+		h.mutex.Lock()
+		h.opening = nil
+		opening.err = err
+		close(opening.done)
+		if err != nil {
+			h.mutex.Unlock()
+			return nil, err
+		}
+		h.connections = connections
+		for _, conn := range connections {
+			go h.broadcast(conn)
+		}
+	}
+	defer h.mutex.Unlock()
+
+	sub := &Subscription{
+		Name:        name,
+		StartTime:   time.Now(),
+		hub:         h,
+		msgChan:     make(chan *events.Envelope, SubscriberBufferSize),
+		connections: h.connections,
+	}
+
+	// copy on write, broadcast() reads the slice without holding the lock for the whole fan out
+	subscribers := make([]*Subscription, len(h.subscribers), len(h.subscribers)+1)
+	copy(subscribers, h.subscribers)
+	h.subscribers = append(subscribers, sub)
+
+	fmt.Fprintf(os.Stdout, "%s subscribed to %s firehose %s, %d subscribers\n", name, h.foundation.Name, h.foundation.SubscriptionId, len(h.subscribers))
+
+	return sub, nil
+}
+
+// Opens every shard, or none of them. Called without the mutex
+func (h *Hub) open() ([]Upstream, error) {
+
+	var connections []Upstream
+	for i := 0; i < h.foundation.Shards; i++ {
+		conn, err := openUpstream(h.foundation, i)
+		if err != nil {
+			for _, opened := range connections {
+				opened.Close()
+			}
+			return nil, err
+		}
+		connections = append(connections, conn)
+	}
+	return connections, nil
+}
+
+// Returned as an interface only when the open succeeded, so a failure is never a non-nil Upstream
+func openUpstream(f *Foundation, shard int) (Upstream, error) {
+	if f.EnvelopeSource == "rlp" {
+		conn, err := OpenRLP(f, shard)
+		if err != nil {
+			return nil, err
+		}
+		return conn, nil
+	}
+
+	conn, err := OpenFirehose(f, shard)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// caller holds the mutex
+func (h *Hub) close() {
+	for _, conn := range h.connections {
+		conn.Close()
+	}
+	h.connections = nil
+}
+
+func (h *Hub) Unsubscribe(sub *Subscription) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	var subscribers []*Subscription
+	for _, s := range h.subscribers {
+		if s != sub {
+			subscribers = append(subscribers, s)
+		}
+	}
+	h.subscribers = subscribers
+
+	fmt.Fprintf(os.Stdout, "%s unsubscribed from %s firehose, %d subscribers\n", sub.Name, h.foundation.Name, len(h.subscribers))
+
+	if len(h.subscribers) == 0 && len(h.connections) != 0 {
+		fmt.Fprintf(os.Stdout, "Closing %s firehose %s\n", h.foundation.Name, h.foundation.SubscriptionId)
+		h.close()
+	}
+}
+
+func (h *Hub) WriteStatus(ow io.Writer) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	if h.opening != nil {
+		fmt.Fprintf(ow, "%s: firehose connecting\n", h.foundation.Name)
+		return
+	}
+	if len(h.connections) == 0 {
+		fmt.Fprintf(ow, "%s: firehose not connected\n", h.foundation.Name)
+		return
+	}
+
+	fmt.Fprintf(ow, "%s: %s %s, %d shard(s), %d subscriber(s)\n", h.foundation.Name, h.foundation.EnvelopeSource, h.foundation.SubscriptionId, len(h.connections), len(h.subscribers))
+	for _, conn := range h.connections {
+		fmt.Fprintf(ow, "  %-30s envelopes %10d disconnects %d\n", conn.Label(), conn.Received(), len(conn.Disconnects()))
+	}
+}
+
+/******************************************************************************************/
+
+// A fixed id, instead of a random one per connection, is what lets the subscription be sharded, both over
+// several connections from this instance and over every instance of the app. Without a config file, set by
+// FIREHOSE_SUBSCRIPTION_ID and FIREHOSE_SHARDS
+func SubscriptionIdFromEnv() string {
+	id := os.Getenv("FIREHOSE_SUBSCRIPTION_ID")
+	if id == "" {
+		id = DefaultSubscriptionId
+	}
+	return id
+}
+
+func ShardsFromEnv() int {
+	shards, err := strconv.Atoi(os.Getenv("FIREHOSE_SHARDS"))
+	if err != nil || shards < 1 {
+		shards = 1
+	}
+	return shards
+}
+
+func (h *Hub) broadcast(conn Upstream) {
+
+	for msg := range conn.Messages() {
+
+		h.mutex.RLock()
+		subscribers := h.subscribers
+		h.mutex.RUnlock()
+
+		for _, sub := range subscribers {
+			sub.offer(msg)
+		}
+	}
+}
+
+/******************************************************************************************/
+
+func (s *Subscription) offer(msg *events.Envelope) {
+	atomic.AddUint64(&s.received, 1)
+
+	select {
+	case s.msgChan <- msg:
+		if since := atomic.LoadInt64(&s.fullSince); since != 0 && atomic.CompareAndSwapInt64(&s.fullSince, since, 0) {
+			atomic.AddInt64(&s.fullTime, time.Now().UnixNano()-since)
+		}
+	default:
+		atomic.AddUint64(&s.dropped, 1)
+		atomic.CompareAndSwapInt64(&s.fullSince, 0, time.Now().UnixNano())
+	}
+}
+
+func (s *Subscription) Messages() <-chan *events.Envelope {
+	return s.msgChan
+}
+
+func (s *Subscription) Close() {
+	s.hub.Unsubscribe(s)
+}
+
+func (s *Subscription) Received() uint64 {
+	return atomic.LoadUint64(&s.received)
+}
+
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// The time the buffer was full, including a stretch that hasn't ended yet
+func (s *Subscription) Blocked() time.Duration {
+	blocked := atomic.LoadInt64(&s.fullTime)
+	if since := atomic.LoadInt64(&s.fullSince); since != 0 {
+		blocked += time.Now().UnixNano() - since
+	}
+	return time.Duration(blocked)
+}
+
+// Only the part of each upstream disconnect that fell inside this subscription
+func (s *Subscription) Disconnects() []Disconnect {
+	var list []Disconnect
+
+	for _, conn := range s.connections {
+		for _, d := range conn.Disconnects() {
+			end := d.Time.Add(d.Gap)
+			if end.Before(s.StartTime) {
+				continue
+			}
+			if d.Time.Before(s.StartTime) {
+				d.Gap = end.Sub(s.StartTime)
+				d.Time = s.StartTime
+			}
+			list = append(list, d)
+		}
+	}
+	return list
+}
+
+func (s *Subscription) Shards() int {
+	return len(s.connections)
+}
@@ -0,0 +1,356 @@
+package firehose
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/********************************************************************************************************
+* Capture files hold raw firehose envelopes so an incident can be analysed again after it has passed.
+*
+* Each record is
+*   uvarint   length of the rest of the record
+*   int64     receive time, unix nanoseconds, big endian
+*   bytes     the events.Envelope protobuf
+ */
+
+const (
+	maxCaptureRecord = 16 * 1024 * 1024
+
+	// every capture file has it, so they can be told apart from the rest of the temp dir
+	CaptureExt = ".pb"
+)
+
+// Capture files are kept in CAPTURE_DIR, or the temp dir. Only the base of the name is used so a request
+// can't write outside of it, and the extension is added if it's missing
+func CapturePath(name string) string {
+	name = filepath.Base(name)
+	if filepath.Ext(name) != CaptureExt {
+		name += CaptureExt
+	}
+	return filepath.Join(captureDir(), name)
+}
+
+func captureDir() string {
+	dir := os.Getenv("CAPTURE_DIR")
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	return dir
+}
+
+// The capture files in the capture dir, leaving out everything else that is kept there
+func CaptureFiles() ([]os.FileInfo, error) {
+	files, err := ioutil.ReadDir(captureDir())
+	if err != nil {
+		return nil, err
+	}
+
+	var captures []os.FileInfo
+	for _, f := range files {
+		if !f.IsDir() && filepath.Ext(f.Name()) == CaptureExt {
+			captures = append(captures, f)
+		}
+	}
+	return captures, nil
+}
+
+/******************************************************************************************/
+
+type CaptureWriter struct {
+	Name    string
+	Count   int
+	Bytes   int64
+	Skipped int
+	file    *os.File
+	writer  *bufio.Writer
+	lenBuf  [binary.MaxVarintLen64]byte
+	timeBuf [8]byte
+}
+
+func CreateCapture(name string) (*CaptureWriter, error) {
+	f, err := os.Create(CapturePath(name))
+	if err != nil {
+		return nil, err
+	}
+	return &CaptureWriter{Name: f.Name(), file: f, writer: bufio.NewWriter(f)}, nil
+}
+
+// An envelope that won't marshal is left out of the capture, which can carry on
+type MarshalError struct {
+	Err error
+}
+
+func (e *MarshalError) Error() string {
+	return fmt.Sprintf("envelope doesn't marshal: %v", e.Err)
+}
+
+// Returns a *MarshalError for an envelope that was skipped, any other error is the file's
+func (c *CaptureWriter) Write(msg *events.Envelope, received time.Time) error {
+
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		c.Skipped++
+		return &MarshalError{err}
+	}
+
+	n := binary.PutUvarint(c.lenBuf[:], uint64(len(data)+len(c.timeBuf)))
+	binary.BigEndian.PutUint64(c.timeBuf[:], uint64(received.UnixNano()))
+
+	if _, err := c.writer.Write(c.lenBuf[:n]); err != nil {
+		return err
+	}
+	if _, err := c.writer.Write(c.timeBuf[:]); err != nil {
+		return err
+	}
+	if _, err := c.writer.Write(data); err != nil {
+		return err
+	}
+
+	c.Count++
+	c.Bytes += int64(n + len(c.timeBuf) + len(data))
+	return nil
+}
+
+func (c *CaptureWriter) Close() error {
+	if err := c.writer.Flush(); err != nil {
+		c.file.Close()
+		return err
+	}
+	return c.file.Close()
+}
+
+/******************************************************************************************/
+
+type CaptureReader struct {
+	file   *os.File
+	reader *bufio.Reader
+}
+
+func OpenCapture(name string) (*CaptureReader, error) {
+	f, err := os.Open(CapturePath(name))
+	if err != nil {
+		return nil, err
+	}
+	return &CaptureReader{file: f, reader: bufio.NewReader(f)}, nil
+}
+
+// Returns io.EOF after the last record
+func (r *CaptureReader) Read() (*events.Envelope, time.Time, error) {
+
+	length, err := binary.ReadUvarint(r.reader)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if length < 8 || length > maxCaptureRecord {
+		return nil, time.Time{}, fmt.Errorf("corrupt capture record of length %d", length)
+	}
+
+	record := make([]byte, length)
+	if _, err := io.ReadFull(r.reader, record); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, time.Time{}, err
+	}
+
+	received := time.Unix(0, int64(binary.BigEndian.Uint64(record[:8])))
+
+	msg := &events.Envelope{}
+	if err := proto.Unmarshal(record[8:], msg); err != nil {
+		return nil, time.Time{}, err
+	}
+	return msg, received, nil
+}
+
+func (r *CaptureReader) Close() error {
+	return r.file.Close()
+}
+
+// Time between the first and last record in a capture file
+func CaptureSpan(name string) (first time.Time, last time.Time, count int, err error) {
+
+	r, err := OpenCapture(name)
+	if err != nil {
+		return
+	}
+	defer r.Close()
+
+	for {
+		var received time.Time
+		_, received, err = r.Read()
+		if err == io.EOF {
+			err = nil
+			return
+		}
+		if err != nil {
+			return
+		}
+		if count == 0 {
+			first = received
+		}
+		last = received
+		count++
+	}
+}
+
+/******************************************************************************************/
+// replaying a capture file as a Source
+
+type Replay struct {
+	Name     string
+	Realtime bool
+	First    time.Time
+	Last     time.Time
+
+	msgChan  chan *events.Envelope
+	mutex    sync.Mutex
+	times    map[*events.Envelope]time.Time
+	received uint64
+	blocked  int64
+	err      error
+	closed   chan struct{}
+	once     sync.Once
+}
+
+// A realtime replay keeps the spacing the envelopes were captured with, otherwise they are sent as fast as
+// the scanner takes them. Messages() is closed at the end of the file
+func OpenReplay(name string, realtime bool) (*Replay, error) {
+
+	first, last, count, err := CaptureSpan(name)
+	if err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		return nil, errors.New("capture file " + name + " is empty")
+	}
+
+	reader, err := OpenCapture(name)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Replay{
+		Name:     name,
+		Realtime: realtime,
+		First:    first,
+		Last:     last,
+		msgChan:  make(chan *events.Envelope, 100),
+		times:    make(map[*events.Envelope]time.Time),
+		closed:   make(chan struct{}),
+	}
+
+	go r.run(reader)
+
+	return r, nil
+}
+
+func (r *Replay) run(reader *CaptureReader) {
+	defer close(r.msgChan)
+	defer reader.Close()
+
+	start := time.Now()
+
+	for {
+		msg, received, err := reader.Read()
+		if err != nil {
+			if err != io.EOF {
+				fmt.Fprintf(os.Stderr, "replay %s: %v\n", r.Name, err)
+				r.mutex.Lock()
+				r.err = err
+				r.mutex.Unlock()
+			}
+			return
+		}
+
+		if r.Realtime {
+			wait := start.Add(received.Sub(r.First)).Sub(time.Now())
+			if wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-r.closed:
+					return
+				}
+			}
+		}
+
+		r.mutex.Lock()
+		r.times[msg] = received
+		r.mutex.Unlock()
+
+		// a replay waits for the scanner rather than dropping envelopes
+		select {
+		case r.msgChan <- msg:
+		default:
+			waitStart := time.Now()
+			select {
+			case r.msgChan <- msg:
+			case <-r.closed:
+				return
+			}
+			atomic.AddInt64(&r.blocked, int64(time.Since(waitStart)))
+		}
+		atomic.AddUint64(&r.received, 1)
+	}
+}
+
+func (r *Replay) Messages() <-chan *events.Envelope {
+	return r.msgChan
+}
+
+func (r *Replay) ReceiveTime(msg *events.Envelope) time.Time {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	t, ok := r.times[msg]
+	if !ok {
+		return time.Now()
+	}
+	delete(r.times, msg)
+	return t
+}
+
+func (r *Replay) Span() time.Duration {
+	return r.Last.Sub(r.First)
+}
+
+func (r *Replay) Err() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.err
+}
+
+func (r *Replay) Received() uint64 {
+	return atomic.LoadUint64(&r.received)
+}
+
+func (r *Replay) Dropped() uint64 {
+	return 0
+}
+
+func (r *Replay) Blocked() time.Duration {
+	return time.Duration(atomic.LoadInt64(&r.blocked))
+}
+
+func (r *Replay) Disconnects() []Disconnect {
+	return nil
+}
+
+func (r *Replay) Shards() int {
+	return 1
+}
+
+func (r *Replay) Close() {
+	r.once.Do(func() { close(r.closed) })
+}
@@ -0,0 +1,56 @@
+package firehose
+
+import (
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Only the capture files are listed, not whatever else shares the capture dir
+func TestCaptureFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "capture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv("CAPTURE_DIR", dir)
+	defer os.Unsetenv("CAPTURE_DIR")
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "other.log"), []byte("not a capture"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "sub.pb"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := CreateCapture("incident")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(&events.Envelope{Origin: proto.String("test"), EventType: events.Envelope_LogMessage.Enum()}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := CaptureFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name() != "incident.pb" {
+		var names []string
+		for _, f := range files {
+			names = append(names, f.Name())
+		}
+		t.Errorf("capture files %v, want [incident.pb]", names)
+	}
+
+	if _, _, count, err := CaptureSpan("incident.pb"); err != nil || count != 1 {
+		t.Errorf("incident.pb has %d envelopes, %v, want 1", count, err)
+	}
+}
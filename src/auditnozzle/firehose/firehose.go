@@ -4,88 +4,109 @@ import (
 	"crypto/tls"
 	"errors"
 	"fmt"
-	"github.com/cloudfoundry-community/go-cfclient"
 	"github.com/cloudfoundry/noaa/consumer"
+	noaaerrors "github.com/cloudfoundry/noaa/errors"
 	"github.com/cloudfoundry/sonde-go/events"
-	"github.com/nu7hatch/gouuid"
 	"os"
-	"strconv"
 )
 
-var CfClientObj *cfclient.Client
+/******************************************************************************************/
 
-func OpenFirehose(firehoseSubscriptionId string) (<-chan *events.Envelope, error) {
-
-	var err error
-
-	apiEndpoint := os.Getenv("API_ENDPOINT")
-	userName := os.Getenv("USER_ID")
-	password := os.Getenv("USER_PASSWORD")
-	skipSSLValidation, err := strconv.ParseBool(os.Getenv("SKIP_SSL_VALIDATION"))
-	if err != nil {
-		skipSSLValidation = false
-	}
-
-	if apiEndpoint == "" || userName == "" || password == "" {
-		return nil, errors.New("Must set environment variables API_ENDPOINT, USER_ID, USER_PASSWORD")
-	}
+// The v1 firehose websocket, through TrafficController
+type Connection struct {
+	link
+	connection *consumer.Consumer
+}
 
-	fmt.Fprintf(os.Stdout, "Authenticating API:%s Credentials:%s Skip_SSL %t\n", apiEndpoint, userName, skipSSLValidation)
+/******************************************************************************************/
 
-	c := cfclient.Config{
-		ApiAddress:        apiEndpoint,
-		Username:          userName,
-		Password:          password,
-		SkipSslValidation: skipSSLValidation,
-	}
+// Connections opened with the same subscription id share the firehose between them (Loggregator sends each
+// envelope to only one of them), so each is a shard of the subscription
+func OpenFirehose(f *Foundation, shard int) (*Connection, error) {
 
-	CfClientObj, err = cfclient.NewClient(&c)
+	token, err := f.Authenticate()
 	if err != nil {
 		return nil, err
 	}
 
-	fmt.Fprintf(os.Stdout, "Opening Firehose api %s\n", CfClientObj.Endpoint.DopplerEndpoint)
+	client := f.Client()
+	fmt.Fprintf(os.Stdout, "Opening Firehose api %s\n", client.Endpoint.DopplerEndpoint)
 
-	connection := consumer.New(CfClientObj.Endpoint.DopplerEndpoint, &tls.Config{InsecureSkipVerify: c.SkipSslValidation}, nil)
+	connection := consumer.New(client.Endpoint.DopplerEndpoint, &tls.Config{InsecureSkipVerify: f.SkipSSLValidation}, nil)
 
 	connection.SetDebugPrinter(ConsoleDebugPrinter{})
 
-	u, err := uuid.NewV4()
-	if err == nil {
-		firehoseSubscriptionId += u.String()
-	}
+	fmt.Fprintf(os.Stdout, "Connecting to firehose with subscriptionID %s shard %d\n", f.SubscriptionId, shard)
 
-	fmt.Fprintf(os.Stdout, "Connecting to firehose with subscriptionID %s\n", firehoseSubscriptionId)
-
-	token, err := CfClientObj.GetToken()
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "failure getting token: %s\n", err)
-		return nil, err
+	conn := &Connection{
+		link:       newLink(f.SubscriptionId, shard, token, f),
+		connection: connection,
 	}
 
-	msgChan, errorChan := connection.Firehose(firehoseSubscriptionId, token)
-
-	// Dont understand this one - why a go routine? - but if not, it hangs - should return err instead of exit
-	//
-	go func() {
-		for err := range errorChan {
-			fmt.Fprintf(os.Stderr, "Error starting firehose:%v\n", err.Error())
-			os.Exit(-1)
-		}
-	}()
+	// the connection is kept open by its own go routine, which reconnects with backoff whenever
+	// Doppler/TrafficController drops it, rather than ending every running scanner
+	go conn.run("Firehose", conn.stream, func(err error) bool {
+		_, ok := err.(*noaaerrors.UnauthorizedError)
+		return ok
+	})
 
 	fmt.Fprintln(os.Stdout, "Firehose opened")
 
-	return msgChan, nil
+	return conn, nil
 }
 
-func AppName(guid string) (string, error) {
+func (c *Connection) stream() error {
+	msgChan, errorChan := c.connection.FirehoseWithoutReconnect(c.SubscriptionId, c.Token())
+	return c.forward(msgChan, errorChan)
+}
 
-	app, err := CfClientObj.AppByGuid(guid)
-	return app.Name, err
+// Pass messages on until the connection reports an error or closes its channels
+func (c *Connection) forward(msgChan <-chan *events.Envelope, errorChan <-chan error) error {
+
+	flowing := false
+
+	for {
+		select {
+		case msg, ok := <-msgChan:
+			if !ok {
+				return errors.New("firehose closed the connection")
+			}
+			if !flowing {
+				c.recordReconnect()
+				flowing = true
+			}
+			if !c.deliver(msg) {
+				return nil
+			}
+
+		case err, ok := <-errorChan:
+			if !ok {
+				errorChan = nil
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+		case <-c.closed:
+			return nil
+		}
+	}
+}
 
+// Stops reconnecting and closes the websocket. Messages() is closed once the run loop has finished
+func (c *Connection) Close() {
+	if c.closeLink() {
+		c.connection.Close()
+	}
 }
 
+func (c *Connection) Label() string {
+	return fmt.Sprintf("firehose %s shard %d", c.SubscriptionId, c.Shard)
+}
+
+/******************************************************************************************/
+
 type ConsoleDebugPrinter struct{}
 
 func (c ConsoleDebugPrinter) Print(title, dump string) {
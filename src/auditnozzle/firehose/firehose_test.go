@@ -0,0 +1,288 @@
+package firehose
+
+import (
+	"auditnozzle/fakecf"
+	"bytes"
+	"fmt"
+	"github.com/cloudfoundry/sonde-go/events"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testFoundation(server *fakecf.Server, source string) *Foundation {
+	f := &Foundation{
+		Name:           "test",
+		Credentials:    Credentials{ApiEndpoint: server.CC.URL, UserName: "admin", Password: "admin"},
+		SubscriptionId: "test",
+		EnvelopeSource: source,
+		RLPGateway:     server.RLPGateway.URL,
+	}
+	f.setDefaults()
+	return f
+}
+
+// n envelopes, failing the test if they don't all arrive in time
+func receive(t *testing.T, messages <-chan *events.Envelope, n int) []*events.Envelope {
+	t.Helper()
+
+	var list []*events.Envelope
+	timeout := time.After(10 * time.Second)
+	for len(list) < n {
+		select {
+		case msg, ok := <-messages:
+			if !ok {
+				t.Fatalf("messages closed after %d of %d envelopes", len(list), n)
+			}
+			list = append(list, msg)
+		case <-timeout:
+			t.Fatalf("received %d of %d envelopes", len(list), n)
+		}
+	}
+	return list
+}
+
+// Fails the test if the upstream's messages aren't closed soon after it is
+func waitClosed(t *testing.T, messages <-chan *events.Envelope) {
+	t.Helper()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-messages:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("messages not closed after Close")
+		}
+	}
+}
+
+func countTypes(list []*events.Envelope) map[events.Envelope_EventType]int {
+	types := make(map[events.Envelope_EventType]int)
+	for _, env := range list {
+		types[env.GetEventType()]++
+	}
+	return types
+}
+
+var logTags = map[string]string{"event_type": "LogMessage"}
+
+func TestOpenFirehose(t *testing.T) {
+	guid := fakecf.DefaultApps[0].Guid
+	server := fakecf.NewServer(fakecf.Merge(
+		fakecf.LogMessages(guid, "APP", 10, 10*time.Millisecond),
+		fakecf.CountersWithGaps("MetronAgent", "metron", "0", "dropsondeMarshaller.sentEnvelopes", logTags, 20, 5, nil, 20*time.Millisecond),
+	))
+	defer server.Close()
+
+	conn, err := OpenFirehose(testFoundation(server, "firehose"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	list := receive(t, conn.Messages(), 15)
+	types := countTypes(list)
+	if types[events.Envelope_LogMessage] != 10 || types[events.Envelope_CounterEvent] != 5 {
+		t.Errorf("got %v, want 10 log messages and 5 counters", types)
+	}
+	for _, env := range list {
+		if env.GetTimestamp() == 0 {
+			t.Errorf("envelope without a timestamp: %v", env)
+		}
+		if env.GetEventType() == events.Envelope_LogMessage && env.GetLogMessage().GetAppId() != guid {
+			t.Errorf("log from %s, want %s", env.GetLogMessage().GetAppId(), guid)
+		}
+	}
+
+	if conn.Received() != 15 {
+		t.Errorf("received %d, want 15", conn.Received())
+	}
+	if d := conn.Disconnects(); len(d) != 0 {
+		t.Errorf("disconnects %v, want none", d)
+	}
+
+	conn.Close()
+	waitClosed(t, conn.Messages())
+}
+
+// The upstream reconnects by itself and carries on with the subscription, and the gap is recorded
+func TestFirehoseReconnects(t *testing.T) {
+	guid := fakecf.DefaultApps[0].Guid
+	server := fakecf.NewServer(fakecf.Concat(
+		fakecf.LogMessages(guid, "APP", 5, 10*time.Millisecond),
+		fakecf.Disconnect(),
+		fakecf.LogMessages(guid, "RTR", 5, 10*time.Millisecond),
+	))
+	defer server.Close()
+
+	conn, err := OpenFirehose(testFoundation(server, "firehose"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	list := receive(t, conn.Messages(), 10)
+	if src := list[9].GetLogMessage().GetSourceType(); src != "RTR" {
+		t.Errorf("last log from %s, want RTR", src)
+	}
+
+	d := conn.Disconnects()
+	if len(d) != 1 || d[0].Open || d[0].Gap <= 0 {
+		t.Errorf("disconnects %+v, want one closed gap", d)
+	}
+	if server.Connections() != 2 {
+		t.Errorf("%d connections, want 2", server.Connections())
+	}
+}
+
+// Every scanner's subscription gets every envelope, and the upstream is closed with the last one
+func TestHubSubscribers(t *testing.T) {
+	server := fakecf.NewServer(fakecf.LogMessages(fakecf.DefaultApps[0].Guid, "APP", 20, 10*time.Millisecond))
+	defer server.Close()
+
+	f := testFoundation(server, "firehose")
+	first, err := f.Subscribe("first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := f.Subscribe("second")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receive(t, first.Messages(), 20)
+	receive(t, second.Messages(), 20)
+	if first.Dropped() != 0 || second.Dropped() != 0 {
+		t.Errorf("dropped %d and %d, want none", first.Dropped(), second.Dropped())
+	}
+
+	conn := first.connections[0]
+	first.Close()
+	second.Close()
+	waitClosed(t, conn.Messages())
+}
+
+// The hub's lock isn't held while the first subscriber logs in and dials, a second subscriber waits for that
+// open and shares its connection
+func TestHubSubscribeWhileOpening(t *testing.T) {
+	server := fakecf.NewServer(fakecf.LogMessages(fakecf.DefaultApps[0].Guid, "APP", 20, 10*time.Millisecond))
+	defer server.Close()
+
+	// the cloud controller answers once released
+	asked := make(chan struct{}, 10)
+	release := make(chan struct{})
+	target, _ := url.Parse(server.CC.URL)
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	cc := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		asked <- struct{}{}
+		<-release
+		proxy.ServeHTTP(res, req)
+	}))
+	defer cc.Close()
+
+	f := testFoundation(server, "firehose")
+	f.ApiEndpoint = cc.URL
+
+	subs := make(chan *Subscription, 2)
+	subscribe := func(name string) {
+		sub, err := f.Subscribe(name)
+		if err != nil {
+			t.Error(err)
+		}
+		subs <- sub
+	}
+	go subscribe("first")
+	<-asked
+	go subscribe("second")
+
+	status := make(chan string)
+	go func() {
+		var out bytes.Buffer
+		f.Hub().WriteStatus(&out)
+		status <- out.String()
+	}()
+	select {
+	case text := <-status:
+		if !strings.Contains(text, "connecting") {
+			t.Errorf("status while opening: %s", text)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("status waited for the firehose to open")
+	}
+
+	close(release)
+	first, second := <-subs, <-subs
+	if first == nil || second == nil {
+		t.FailNow()
+	}
+	defer first.Close()
+	defer second.Close()
+
+	if first.connections[0] != second.connections[0] {
+		t.Error("subscribers opened separate connections")
+	}
+	receive(t, first.Messages(), 20)
+	receive(t, second.Messages(), 20)
+}
+
+type countingRefresher struct {
+	refreshed, fetched int
+}
+
+func (r *countingRefresher) RefreshAuthToken() (string, error) {
+	r.refreshed++
+	return fmt.Sprintf("bearer cached-%d", r.refreshed), nil
+}
+
+func (r *countingRefresher) NewAuthToken() (string, error) {
+	r.fetched++
+	return fmt.Sprintf("bearer new-%d", r.fetched), nil
+}
+
+// A refused token is replaced with a new one rather than the cached one, which the firehose would refuse again
+func TestRefreshTokenWhenRefused(t *testing.T) {
+	refresher := &countingRefresher{}
+	conn := &Connection{}
+	conn.token = "bearer first"
+	conn.SetTokenRefresher(refresher)
+
+	conn.RefreshToken(false)
+	if got := conn.Token(); got != "bearer cached-1" {
+		t.Errorf("token %q after a disconnect, want the cached one", got)
+	}
+
+	conn.RefreshToken(true)
+	if got := conn.Token(); got != "bearer new-1" {
+		t.Errorf("token %q after it was refused, want a new one", got)
+	}
+	if refresher.refreshed != 1 || refresher.fetched != 1 {
+		t.Errorf("%d cached and %d new tokens asked for, want 1 of each", refresher.refreshed, refresher.fetched)
+	}
+}
+
+func TestNewToken(t *testing.T) {
+	uaa := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.URL.Path != "/oauth/token" || r.Form.Get("grant_type") != "password" || r.Form.Get("username") != "admin" {
+			http.Error(w, "bad token request", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"access_token":"fresh","token_type":"bearer","expires_in":600}`)
+	}))
+	defer uaa.Close()
+
+	token, err := Credentials{UserName: "admin", Password: "admin"}.NewToken(uaa.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "bearer fresh" {
+		t.Errorf("token %q, want bearer fresh", token)
+	}
+}
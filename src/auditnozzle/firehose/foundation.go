@@ -0,0 +1,421 @@
+package firehose
+
+import (
+	"fmt"
+	"github.com/cloudfoundry-community/go-cfclient"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/********************************************************************************************************
+* The foundations the nozzle can audit. CONFIG_FILE names a YAML file listing them:
+*
+*   default: prod
+*   foundations:
+*   - name: prod
+*     api_endpoint: https://api.sys.prod.example.com
+*     client_id: auditnozzle
+*     client_secret: secret
+*   - name: staging
+*     api_endpoint: https://api.sys.staging.example.com
+*     user_id: admin
+*     user_password: admin
+*     skip_ssl_validation: true
+*     shards: 2
+*     envelope_source: rlp
+*
+* Without a config file there is one foundation, "default", read from the environment variables as before.
+* Every foundation has its own cloud controller client and its own shared subscription
+ */
+
+const DefaultFoundationName = "default"
+
+type Foundation struct {
+	Name           string `yaml:"name"`
+	Credentials    `yaml:",inline"`
+	SubscriptionId string `yaml:"subscription_id"`
+	Shards         int    `yaml:"shards"`
+	EnvelopeSource string `yaml:"envelope_source"`
+	RLPGateway     string `yaml:"rlp_gateway"`
+
+	configErr         error
+	hub               *Hub
+	mutex             sync.Mutex
+	authMutex         sync.Mutex
+	client            *cfclient.Client
+	nameLookupAllowed bool
+	resolver          *Resolver
+}
+
+type Config struct {
+	Default     string        `yaml:"default"`
+	Foundations []*Foundation `yaml:"foundations"`
+}
+
+var (
+	foundations       = make(map[string]*Foundation)
+	defaultFoundation string
+	foundationsMutex  sync.RWMutex
+)
+
+/******************************************************************************************/
+
+func LoadConfig() error {
+
+	path := os.Getenv("CONFIG_FILE")
+	if path == "" {
+		SetFoundations(DefaultFoundationName, FoundationFromEnv())
+		return nil
+	}
+
+	config, err := ReadConfig(path)
+	if err != nil {
+		return err
+	}
+
+	SetFoundations(config.Default, config.Foundations...)
+	fmt.Fprintf(os.Stdout, "Read %d foundations from %s, default %s\n", len(config.Foundations), path, config.Default)
+	return nil
+}
+
+func ReadConfig(path string) (Config, error) {
+	var config Config
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("%s: %v", path, err)
+	}
+
+	if len(config.Foundations) == 0 {
+		return config, fmt.Errorf("%s: no foundations listed", path)
+	}
+
+	names := make(map[string]bool)
+	for _, f := range config.Foundations {
+		if f.Name == "" {
+			return config, fmt.Errorf("%s: every foundation needs a name", path)
+		}
+		if names[f.Name] {
+			return config, fmt.Errorf("%s: foundation %s listed twice", path, f.Name)
+		}
+		names[f.Name] = true
+
+		if err := f.Credentials.Validate(); err != nil {
+			return config, fmt.Errorf("%s: foundation %s: %v", path, f.Name, err)
+		}
+		f.setDefaults()
+	}
+
+	if config.Default == "" {
+		config.Default = config.Foundations[0].Name
+	}
+	if !names[config.Default] {
+		return config, fmt.Errorf("%s: default foundation %s is not listed", path, config.Default)
+	}
+	return config, nil
+}
+
+// The single foundation used when there is no config file. Bad credentials are reported when a scan starts,
+// as they were before there was a config file
+func FoundationFromEnv() *Foundation {
+	creds, err := CredentialsFromEnv()
+
+	f := &Foundation{
+		Name:           DefaultFoundationName,
+		Credentials:    creds,
+		SubscriptionId: SubscriptionIdFromEnv(),
+		Shards:         ShardsFromEnv(),
+		EnvelopeSource: EnvelopeSourceFromEnv(),
+		RLPGateway:     os.Getenv("RLP_GATEWAY"),
+		configErr:      err,
+	}
+	f.setDefaults()
+	return f
+}
+
+func (f *Foundation) setDefaults() {
+	if f.SubscriptionId == "" {
+		f.SubscriptionId = DefaultSubscriptionId
+	}
+	if f.Shards < 1 {
+		f.Shards = 1
+	}
+	if strings.ToLower(f.EnvelopeSource) == "rlp" {
+		f.EnvelopeSource = "rlp"
+	} else {
+		f.EnvelopeSource = "firehose"
+	}
+	f.nameLookupAllowed = true
+	f.hub = &Hub{foundation: f}
+	f.resolver = newResolver(f)
+}
+
+func SetFoundations(defaultName string, list ...*Foundation) {
+	foundationsMutex.Lock()
+	defer foundationsMutex.Unlock()
+
+	foundations = make(map[string]*Foundation)
+	for _, f := range list {
+		if f.hub == nil {
+			f.setDefaults()
+		}
+		foundations[f.Name] = f
+	}
+	defaultFoundation = defaultName
+}
+
+/******************************************************************************************/
+
+// An empty name is the default foundation
+func LookupFoundation(name string) (*Foundation, error) {
+	foundationsMutex.RLock()
+	defer foundationsMutex.RUnlock()
+
+	if name == "" {
+		name = defaultFoundation
+	}
+
+	f, ok := foundations[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown foundation %s, configured: %s", name, strings.Join(foundationNames(), ", "))
+	}
+	return f, nil
+}
+
+// foundation=<name>, or the default
+func FoundationFromRequest(req *http.Request) (*Foundation, error) {
+	return LookupFoundation(req.FormValue("foundation"))
+}
+
+func DefaultFoundation() *Foundation {
+	f, _ := LookupFoundation("")
+	return f
+}
+
+func Foundations() []*Foundation {
+	foundationsMutex.RLock()
+	defer foundationsMutex.RUnlock()
+
+	var list []*Foundation
+	for _, name := range foundationNames() {
+		list = append(list, foundations[name])
+	}
+	return list
+}
+
+// caller holds foundationsMutex
+func foundationNames() []string {
+	var names []string
+	for name := range foundations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+/******************************************************************************************/
+
+// Logs in to the cloud controller and UAA, and checks the token can read the firehose. The client is made
+// by the first call, the shards opening after it share it and only get its token, refreshed if it expired
+func (f *Foundation) Authenticate() (string, error) {
+
+	if f.configErr != nil {
+		return "", f.configErr
+	}
+	if err := f.Credentials.Validate(); err != nil {
+		return "", fmt.Errorf("foundation %s: %v", f.Name, err)
+	}
+
+	f.authMutex.Lock()
+	defer f.authMutex.Unlock()
+
+	fmt.Fprintf(os.Stdout, "Authenticating %s API:%s Credentials:%s Skip_SSL %t\n", f.Name, f.ApiEndpoint, f.Credentials, f.SkipSSLValidation)
+
+	client := f.Client()
+	if client == nil {
+		c := f.Config()
+
+		var err error
+		client, err = cfclient.NewClient(&c)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	token, err := client.GetToken()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failure getting token for %s: %s\n", f.Name, err)
+		return "", err
+	}
+
+	warning, err := CheckScopes(f.Credentials, token)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return "", err
+	}
+	if warning != nil {
+		fmt.Fprintln(os.Stderr, warning)
+	}
+
+	f.mutex.Lock()
+	f.client = client
+	f.nameLookupAllowed = warning == nil
+	f.mutex.Unlock()
+
+	return token, nil
+}
+
+// A new token from UAA for the firehose, when the one the client has cached was refused. The client keeps
+// its own for the cloud controller
+func (f *Foundation) NewToken() (string, error) {
+	client := f.Client()
+	if client == nil {
+		return f.Authenticate()
+	}
+
+	token, err := f.Credentials.NewToken(client.Endpoint.TokenEndpoint)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failure getting a new token for %s: %s\n", f.Name, err)
+		return "", err
+	}
+	return token, nil
+}
+
+// nil until a scan has opened the foundation's firehose
+func (f *Foundation) Client() *cfclient.Client {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.client
+}
+
+/******************************************************************************************/
+// apps with their space and org, see resolver.go
+
+type AppInfo struct {
+	Guid      string
+	Name      string
+	SpaceGuid string
+	Space     string
+	OrgGuid   string
+	Org       string
+}
+
+// A replay doesn't open the firehose, so the foundation is logged in to here if it hasn't been yet
+func (f *Foundation) ccClient() (*cfclient.Client, error) {
+
+	if f.Client() == nil {
+		if _, err := f.Authenticate(); err != nil {
+			return nil, err
+		}
+	}
+
+	f.mutex.Lock()
+	client, allowed := f.client, f.nameLookupAllowed
+	f.mutex.Unlock()
+
+	if !allowed {
+		return nil, ErrNoNameLookupScope
+	}
+	return client, nil
+}
+
+// Every app on the foundation. The orgs, spaces and apps are listed once each rather than asking for every
+// app's space and org
+func (f *Foundation) ListAppInfo() ([]AppInfo, error) {
+
+	client, err := f.ccClient()
+	if err != nil {
+		return nil, err
+	}
+
+	orgs, err := client.ListOrgs()
+	if err != nil {
+		return nil, err
+	}
+	spaces, err := client.ListSpaces()
+	if err != nil {
+		return nil, err
+	}
+	apps, err := client.ListAppsByQuery(url.Values{})
+	if err != nil {
+		return nil, err
+	}
+
+	orgNames := make(map[string]string)
+	for _, org := range orgs {
+		orgNames[org.Guid] = org.Name
+	}
+	spacesByGuid := make(map[string]cfclient.Space)
+	for _, space := range spaces {
+		spacesByGuid[space.Guid] = space
+	}
+
+	var list []AppInfo
+	for _, app := range apps {
+		space := spacesByGuid[app.SpaceGuid]
+		list = append(list, AppInfo{
+			Guid:      app.Guid,
+			Name:      app.Name,
+			SpaceGuid: app.SpaceGuid,
+			Space:     space.Name,
+			OrgGuid:   space.OrganizationGuid,
+			Org:       orgNames[space.OrganizationGuid],
+		})
+	}
+	return list, nil
+}
+
+// The apps with these guids, with the space and org the cloud controller returns inline, in one query. An
+// app missing from the map wasn't found
+func (f *Foundation) ListAppInfoByGuid(guids []string) (map[string]AppInfo, error) {
+
+	client, err := f.ccClient()
+	if err != nil {
+		return nil, err
+	}
+
+	query := url.Values{}
+	query.Set("q", "guid IN "+strings.Join(guids, ","))
+	query.Set("inline-relations-depth", "2")
+	query.Set("results-per-page", "100")
+
+	apps, err := client.ListAppsByQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	found := make(map[string]AppInfo)
+	for _, app := range apps {
+		space := app.SpaceData.Entity
+		found[app.Guid] = AppInfo{
+			Guid:      app.Guid,
+			Name:      app.Name,
+			SpaceGuid: app.SpaceGuid,
+			Space:     space.Name,
+			OrgGuid:   space.OrganizationGuid,
+			Org:       space.OrgData.Entity.Name,
+		}
+	}
+	return found, nil
+}
+
+func (f *Foundation) Resolver() *Resolver {
+	return f.resolver
+}
+
+func (f *Foundation) Hub() *Hub {
+	return f.hub
+}
+
+func (f *Foundation) Subscribe(name string) (*Subscription, error) {
+	return f.hub.Subscribe(name)
+}
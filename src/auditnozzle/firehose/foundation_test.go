@@ -0,0 +1,36 @@
+package firehose
+
+import (
+	"auditnozzle/fakecf"
+	"sync"
+	"testing"
+)
+
+// Shards opening together log in with one client, which the resolver then uses too
+func TestAuthenticateSharesClient(t *testing.T) {
+	server := fakecf.NewServer(nil)
+	defer server.Close()
+
+	f := testFoundation(server, "firehose")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := f.Authenticate(); err != nil {
+				t.Error(err)
+			}
+			f.ccClient()
+		}()
+	}
+	wg.Wait()
+
+	client := f.Client()
+	if _, err := f.Authenticate(); err != nil {
+		t.Fatal(err)
+	}
+	if f.Client() != client {
+		t.Error("Authenticate replaced the foundation's client")
+	}
+}
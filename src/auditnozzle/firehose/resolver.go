@@ -0,0 +1,266 @@
+package firehose
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+/********************************************************************************************************
+* Every scanner on a foundation gets app names, spaces and orgs from the foundation's resolver. A guid asked
+* for is queued rather than looked up on the spot, so a scan never waits on the cloud controller; a few
+* workers take up to 50 guids at a time from the queue and ask for them in one /v2/apps?q=guid IN query.
+*
+* Apps found are cached for 10m. An app the cloud controller doesn't have, most likely deleted, is cached as
+* not found for 2m, so its logs don't send a query each time. A failed query isn't cached, the next request
+* for those apps tries again. Expired apps are swept from the cache once a minute.
+*
+* At most 10000 guids wait to be looked up. A guid already waiting is answered with the others, a new one
+* asked for while the queue is full is answered straight away with ErrResolverBusy and can be asked for again
+* later
+ */
+
+const (
+	resolverWorkers     = 4
+	resolverBatch       = 50
+	resolverTTL         = 10 * time.Minute
+	resolverNotFoundTTL = 2 * time.Minute
+	resolverSweep       = time.Minute
+	resolverMaxQueue    = 10000
+)
+
+var (
+	ErrAppNotFound  = errors.New("app not found, it may have been deleted")
+	ErrResolverBusy = errors.New("too many apps waiting to be looked up")
+)
+
+type Resolver struct {
+	foundation *Foundation
+
+	mutex   sync.Mutex
+	work    *sync.Cond
+	cache   map[string]resolved
+	waiting map[string][]waiter
+	queue   []string
+	started bool
+	swept   time.Time
+
+	lookups    int // apps asked for from the cloud controller
+	batches    int
+	failures   int
+	cacheHits  int
+	notFound   int // answered from the not found cache
+	busy       int // not queued, the queue was full
+	maxWaiting int
+	queueTime  timing
+	lookupTime timing // of each batch
+}
+
+type resolved struct {
+	app      AppInfo
+	notFound bool
+	expires  time.Time
+}
+
+type waiter struct {
+	done   func(AppInfo, error)
+	queued time.Time
+}
+
+// Shortest, longest and average
+type timing struct {
+	n     int
+	total time.Duration
+	min   time.Duration
+	max   time.Duration
+}
+
+func (t *timing) add(d time.Duration) {
+	t.n++
+	t.total += d
+	if t.min == 0 || d < t.min {
+		t.min = d
+	}
+	if d > t.max {
+		t.max = d
+	}
+}
+
+// e.g. ave 120ms max/min 300ms 80ms
+func (t timing) String() string {
+	var ave time.Duration
+	if t.n > 0 {
+		ave = t.total / time.Duration(t.n)
+	}
+	ms := func(d time.Duration) int64 { return int64(d / time.Millisecond) }
+	return fmt.Sprintf("ave %dms max/min %dms %dms", ms(ave), ms(t.max), ms(t.min))
+}
+
+func newResolver(f *Foundation) *Resolver {
+	r := &Resolver{
+		foundation: f,
+		cache:      make(map[string]resolved),
+		waiting:    make(map[string][]waiter),
+	}
+	r.work = sync.NewCond(&r.mutex)
+	return r
+}
+
+/******************************************************************************************/
+
+// done gets the app, or ErrAppNotFound or the error looking it up. It is called straight away for a cached
+// app, otherwise from a worker, so the caller mustn't hold a lock done takes
+func (r *Resolver) Resolve(guid string, done func(AppInfo, error)) {
+	r.mutex.Lock()
+	r.sweep()
+
+	if c, ok := r.cache[guid]; ok && time.Now().Before(c.expires) {
+		if c.notFound {
+			r.notFound++
+		} else {
+			r.cacheHits++
+		}
+		r.mutex.Unlock()
+
+		if c.notFound {
+			done(AppInfo{Guid: guid}, ErrAppNotFound)
+		} else {
+			done(c.app, nil)
+		}
+		return
+	}
+
+	// a guid already queued, or being looked up, gets the same answer
+	if _, ok := r.waiting[guid]; !ok {
+		if len(r.waiting) >= resolverMaxQueue {
+			r.busy++
+			r.mutex.Unlock()
+			done(AppInfo{Guid: guid}, ErrResolverBusy)
+			return
+		}
+		r.queue = append(r.queue, guid)
+	}
+	r.waiting[guid] = append(r.waiting[guid], waiter{done, time.Now()})
+	if len(r.waiting) > r.maxWaiting {
+		r.maxWaiting = len(r.waiting)
+	}
+
+	if !r.started {
+		r.started = true
+		for i := 0; i < resolverWorkers; i++ {
+			go r.worker()
+		}
+	}
+	r.work.Signal()
+	r.mutex.Unlock()
+}
+
+// Apps already listed, such as by the log filters, so their names don't need looking up again
+func (r *Resolver) Add(apps []AppInfo) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.sweep()
+	expires := time.Now().Add(resolverTTL)
+	for _, app := range apps {
+		r.cache[app.Guid] = resolved{app: app, expires: expires}
+	}
+}
+
+// Drops the expired apps, at most once every resolverSweep. Caller holds the mutex
+func (r *Resolver) sweep() {
+	now := time.Now()
+	if now.Sub(r.swept) < resolverSweep {
+		return
+	}
+	r.swept = now
+
+	for guid, c := range r.cache {
+		if now.After(c.expires) {
+			delete(r.cache, guid)
+		}
+	}
+}
+
+func (r *Resolver) worker() {
+	for {
+		r.mutex.Lock()
+		for len(r.queue) == 0 {
+			r.work.Wait()
+		}
+		n := len(r.queue)
+		if n > resolverBatch {
+			n = resolverBatch
+		}
+		guids := append([]string(nil), r.queue[:n]...)
+		r.queue = r.queue[n:]
+		r.mutex.Unlock()
+
+		start := time.Now()
+		apps, err := r.foundation.ListAppInfoByGuid(guids)
+		took := time.Since(start)
+
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: looking up %d apps: %v\n", r.foundation.Name, len(guids), err)
+		}
+
+		// the waiters are answered once the lock is released
+		var answers []func()
+
+		r.mutex.Lock()
+		r.lookups += len(guids)
+		r.batches++
+		r.lookupTime.add(took)
+		if err != nil {
+			r.failures++
+		}
+
+		for _, guid := range guids {
+			app, found := apps[guid]
+			lookupErr := err
+			if err == nil {
+				c := resolved{app: app, expires: start.Add(resolverTTL)}
+				if !found {
+					c = resolved{app: AppInfo{Guid: guid}, notFound: true, expires: start.Add(resolverNotFoundTTL)}
+					lookupErr = ErrAppNotFound
+				}
+				r.cache[guid] = c
+				app = c.app
+			} else {
+				app = AppInfo{Guid: guid}
+			}
+
+			for _, w := range r.waiting[guid] {
+				r.queueTime.add(start.Sub(w.queued))
+				done := w.done
+				answers = append(answers, func() { done(app, lookupErr) })
+			}
+			delete(r.waiting, guid)
+		}
+		r.mutex.Unlock()
+
+		for _, answer := range answers {
+			answer()
+		}
+	}
+}
+
+/******************************************************************************************/
+
+func (r *Resolver) WriteStatus(ow io.Writer) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	fmt.Fprintf(ow, "%d names looked up in %d batches (%d failed), lookup %s, queue %s, queued %d max %d, %d turned away, %d from cache, %d not found, %d cached\n",
+		r.lookups, r.batches, r.failures, r.lookupTime, r.queueTime, len(r.waiting), r.maxWaiting, r.busy, r.cacheHits, r.notFound, len(r.cache))
+}
+
+// Whether anything has been asked for, /status leaves out a resolver that hasn't been used
+func (r *Resolver) Used() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.started || len(r.cache) > 0
+}
@@ -0,0 +1,51 @@
+package firehose
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Without workers taking from it, the queue fills up and new guids are turned away
+func TestResolverQueueFull(t *testing.T) {
+	r := newResolver(&Foundation{Name: "test"})
+	r.started = true
+
+	for i := 0; i < resolverMaxQueue; i++ {
+		r.Resolve(fmt.Sprintf("guid-%d", i), func(app AppInfo, err error) {
+			t.Fatalf("%s answered before it was looked up: %v", app.Guid, err)
+		})
+	}
+
+	var busy error
+	r.Resolve("one-more", func(app AppInfo, err error) { busy = err })
+	if busy != ErrResolverBusy {
+		t.Errorf("a new guid asked for with the queue full got %v, want ErrResolverBusy", busy)
+	}
+
+	r.Resolve("guid-0", func(app AppInfo, err error) {
+		t.Errorf("a guid already waiting was answered straight away: %v", err)
+	})
+	if n := len(r.waiting["guid-0"]); n != 2 {
+		t.Errorf("%d waiting for guid-0, want 2", n)
+	}
+	if len(r.queue) != resolverMaxQueue {
+		t.Errorf("%d queued, want %d", len(r.queue), resolverMaxQueue)
+	}
+}
+
+func TestResolverSweep(t *testing.T) {
+	r := newResolver(&Foundation{Name: "test"})
+	r.cache["expired"] = resolved{app: AppInfo{Guid: "expired"}, expires: time.Now().Add(-time.Second)}
+
+	r.Add([]AppInfo{{Guid: "listed", Name: "listed-app"}})
+	if _, ok := r.cache["expired"]; ok {
+		t.Error("expired app still cached")
+	}
+
+	var name string
+	r.Resolve("listed", func(app AppInfo, err error) { name = app.Name })
+	if name != "listed-app" {
+		t.Errorf("listed app resolved as %q", name)
+	}
+}
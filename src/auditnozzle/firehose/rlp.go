@@ -0,0 +1,435 @@
+package firehose
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/********************************************************************************************************
+* Loggregator v2 envelopes from the Reverse Log Proxy gateway (HTTP server sent events, JSON), converted to the
+* v1 envelopes the scanners read.
+*
+*   Log     -> LogMessage, app id from source_id
+*   Counter -> CounterEvent
+*   Gauge   -> one ValueMetric per value
+*   Timer   -> HttpStartStop, the request from gorouter's tags. Every field is required, so a missing tag
+*              gets the zero value
+*   Event   -> Error, with the title and body as the message
+*
+* Information v1 has no place for is kept as tags: source_id and instance_id on every envelope, and for a
+* gauge carrying several values, gauge_values lists the names of all of them
+ */
+
+const (
+	SourceIdTag    = "source_id"
+	InstanceIdTag  = "instance_id"
+	GaugeValuesTag = "gauge_values"
+	V2EventTag     = "v2_event"
+)
+
+// The v1 firehose websocket, or the v2 RLP gateway. Without a config file, set by ENVELOPE_SOURCE
+func EnvelopeSourceFromEnv() string {
+	if strings.ToLower(os.Getenv("ENVELOPE_SOURCE")) == "rlp" {
+		return "rlp"
+	}
+	return "firehose"
+}
+
+/******************************************************************************************/
+
+type RLPConnection struct {
+	link
+	Gateway string
+	client  *http.Client
+}
+
+// The gateway is the foundation's rlp_gateway (RLP_GATEWAY), or log-stream on the same system domain as doppler
+func OpenRLP(f *Foundation, shard int) (*RLPConnection, error) {
+
+	token, err := f.Authenticate()
+	if err != nil {
+		return nil, err
+	}
+
+	client := f.Client()
+	gateway, err := RLPGateway(f.RLPGateway, client.Endpoint.DopplerEndpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Fprintf(os.Stdout, "Connecting to RLP gateway %s with shard id %s shard %d\n", gateway, f.SubscriptionId, shard)
+
+	conn := &RLPConnection{
+		link:    newLink(f.SubscriptionId, shard, token, f),
+		Gateway: gateway,
+		client: &http.Client{
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: f.SkipSSLValidation}},
+		},
+	}
+
+	go conn.run("RLP gateway", conn.stream, func(err error) bool {
+		return err == ErrRLPUnauthorized
+	})
+
+	return conn, nil
+}
+
+func RLPGateway(gateway, dopplerEndpoint string) (string, error) {
+
+	if gateway != "" {
+		return strings.TrimRight(gateway, "/"), nil
+	}
+
+	u, err := url.Parse(dopplerEndpoint)
+	if err != nil || !strings.HasPrefix(u.Hostname(), "doppler.") {
+		return "", errors.New("unable to work out the RLP gateway from " + dopplerEndpoint + ", set the RLP gateway")
+	}
+	return "https://log-stream." + strings.TrimPrefix(u.Hostname(), "doppler."), nil
+}
+
+var ErrRLPUnauthorized = errors.New("RLP gateway refused the token")
+
+func (c *RLPConnection) stream() error {
+
+	query := url.Values{}
+	query.Set("shard_id", c.SubscriptionId)
+	for _, t := range []string{"log", "counter", "gauge", "timer", "event"} {
+		query.Set(t, "")
+	}
+
+	req, err := http.NewRequest("GET", c.Gateway+"/v2/read?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", c.Token())
+	req.Header.Set("Accept", "text/event-stream")
+
+	// closing the upstream cancels the request, which ends the read below
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req = req.WithContext(ctx)
+	go func() {
+		select {
+		case <-c.closed:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return ErrRLPUnauthorized
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("RLP gateway returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), maxCaptureRecord)
+
+	var data bytes.Buffer
+	flowing := false
+
+	for scanner.Scan() {
+		line := scanner.Bytes()
+
+		// a blank line ends an event
+		if len(line) == 0 {
+			if data.Len() > 0 {
+				if !flowing {
+					c.recordReconnect()
+					flowing = true
+				}
+				if !c.deliverBatch(data.Bytes()) {
+					return nil
+				}
+				data.Reset()
+			}
+			continue
+		}
+
+		if bytes.HasPrefix(line, []byte("data:")) {
+			if data.Len() > 0 {
+				data.WriteByte('\n')
+			}
+			data.Write(bytes.TrimSpace(line[len("data:"):]))
+		}
+	}
+
+	if c.isClosed() {
+		return nil
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return errors.New("RLP gateway closed the stream")
+}
+
+func (c *RLPConnection) deliverBatch(data []byte) bool {
+
+	var batch V2Batch
+	if err := json.Unmarshal(data, &batch); err != nil {
+		// heartbeats and anything else that isn't a batch
+		return true
+	}
+
+	for _, v2 := range batch.Batch {
+		for _, env := range ConvertV2(v2) {
+			if !c.deliver(env) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (c *RLPConnection) Close() {
+	c.closeLink()
+}
+
+func (c *RLPConnection) Label() string {
+	return fmt.Sprintf("rlp %s shard %d", c.SubscriptionId, c.Shard)
+}
+
+/******************************************************************************************/
+// v2 envelopes as JSON. 64 bit numbers come as strings
+
+type V2Batch struct {
+	Batch []V2Envelope `json:"batch"`
+}
+
+type V2Envelope struct {
+	Timestamp  jsonInt64         `json:"timestamp"`
+	SourceId   string            `json:"source_id"`
+	InstanceId string            `json:"instance_id"`
+	Tags       map[string]string `json:"tags"`
+	Log        *V2Log            `json:"log"`
+	Counter    *V2Counter        `json:"counter"`
+	Gauge      *V2Gauge          `json:"gauge"`
+	Timer      *V2Timer          `json:"timer"`
+	Event      *V2Event          `json:"event"`
+}
+
+type V2Log struct {
+	Payload string `json:"payload"`
+	Type    string `json:"type"`
+}
+
+type V2Counter struct {
+	Name  string    `json:"name"`
+	Delta jsonInt64 `json:"delta"`
+	Total jsonInt64 `json:"total"`
+}
+
+type V2GaugeValue struct {
+	Unit  string  `json:"unit"`
+	Value float64 `json:"value"`
+}
+
+type V2Gauge struct {
+	Metrics map[string]V2GaugeValue `json:"metrics"`
+}
+
+type V2Timer struct {
+	Name  string    `json:"name"`
+	Start jsonInt64 `json:"start"`
+	Stop  jsonInt64 `json:"stop"`
+}
+
+type V2Event struct {
+	Title string `json:"title"`
+	Body  string `json:"body"`
+}
+
+type jsonInt64 int64
+
+func (i *jsonInt64) UnmarshalJSON(b []byte) error {
+	s := strings.Trim(string(b), `"`)
+	if s == "" || s == "null" {
+		*i = 0
+		return nil
+	}
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		u, uerr := strconv.ParseUint(s, 10, 64)
+		if uerr != nil {
+			return err
+		}
+		v = int64(u)
+	}
+	*i = jsonInt64(v)
+	return nil
+}
+
+/******************************************************************************************/
+
+func ConvertV2(v2 V2Envelope) []*events.Envelope {
+
+	newEnvelope := func(eventType events.Envelope_EventType) *events.Envelope {
+		tags := make(map[string]string)
+		for k, v := range v2.Tags {
+			tags[k] = v
+		}
+		if v2.SourceId != "" {
+			tags[SourceIdTag] = v2.SourceId
+		}
+		if v2.InstanceId != "" {
+			tags[InstanceIdTag] = v2.InstanceId
+		}
+
+		origin := v2.Tags["origin"]
+		if origin == "" {
+			origin = v2.SourceId
+		}
+
+		return &events.Envelope{
+			Origin:     proto.String(origin),
+			EventType:  eventType.Enum(),
+			Timestamp:  proto.Int64(int64(v2.Timestamp)),
+			Deployment: proto.String(v2.Tags["deployment"]),
+			Job:        proto.String(v2.Tags["job"]),
+			Index:      proto.String(v2.Tags["index"]),
+			Ip:         proto.String(v2.Tags["ip"]),
+			Tags:       tags,
+		}
+	}
+
+	switch {
+	case v2.Log != nil:
+		payload, err := base64.StdEncoding.DecodeString(v2.Log.Payload)
+		if err != nil {
+			payload = []byte(v2.Log.Payload)
+		}
+
+		messageType := events.LogMessage_OUT
+		if v2.Log.Type == "ERR" {
+			messageType = events.LogMessage_ERR
+		}
+
+		env := newEnvelope(events.Envelope_LogMessage)
+		env.LogMessage = &events.LogMessage{
+			Message:        payload,
+			MessageType:    messageType.Enum(),
+			Timestamp:      proto.Int64(int64(v2.Timestamp)),
+			AppId:          proto.String(v2.SourceId),
+			SourceType:     proto.String(v2.Tags["source_type"]),
+			SourceInstance: proto.String(v2.InstanceId),
+		}
+		return []*events.Envelope{env}
+
+	case v2.Counter != nil:
+		env := newEnvelope(events.Envelope_CounterEvent)
+		env.CounterEvent = &events.CounterEvent{
+			Name:  proto.String(v2.Counter.Name),
+			Delta: proto.Uint64(uint64(v2.Counter.Delta)),
+			Total: proto.Uint64(uint64(v2.Counter.Total)),
+		}
+		return []*events.Envelope{env}
+
+	case v2.Gauge != nil:
+		var names []string
+		for name := range v2.Gauge.Metrics {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		var list []*events.Envelope
+		for _, name := range names {
+			env := newEnvelope(events.Envelope_ValueMetric)
+			if len(names) > 1 {
+				env.Tags[GaugeValuesTag] = strings.Join(names, ",")
+			}
+			env.ValueMetric = &events.ValueMetric{
+				Name:  proto.String(name),
+				Value: proto.Float64(v2.Gauge.Metrics[name].Value),
+				Unit:  proto.String(v2.Gauge.Metrics[name].Unit),
+			}
+			list = append(list, env)
+		}
+		return list
+
+	case v2.Timer != nil:
+		env := newEnvelope(events.Envelope_HttpStartStop)
+		env.Tags["timer"] = v2.Timer.Name
+		env.HttpStartStop = v2HttpStartStop(v2)
+		return []*events.Envelope{env}
+
+	case v2.Event != nil:
+		env := newEnvelope(events.Envelope_Error)
+		env.Tags[V2EventTag] = "true"
+		env.Error = &events.Error{
+			Source:  proto.String(v2.SourceId),
+			Code:    proto.Int32(0),
+			Message: proto.String(v2.Event.Title + ": " + v2.Event.Body),
+		}
+		return []*events.Envelope{env}
+	}
+
+	return nil
+}
+
+func v2HttpStartStop(v2 V2Envelope) *events.HttpStartStop {
+
+	peerType := events.PeerType_Server
+	if v, ok := events.PeerType_value[v2.Tags["peer_type"]]; ok {
+		peerType = events.PeerType(v)
+	}
+	method := events.Method_GET
+	if v, ok := events.Method_value[strings.ToUpper(v2.Tags["method"])]; ok {
+		method = events.Method(v)
+	}
+	status, _ := strconv.ParseInt(v2.Tags["status_code"], 10, 32)
+	length, _ := strconv.ParseInt(v2.Tags["content_length"], 10, 64)
+
+	requestId, _ := sondeUUID(v2.Tags["request_id"])
+
+	h := &events.HttpStartStop{
+		StartTimestamp: proto.Int64(int64(v2.Timer.Start)),
+		StopTimestamp:  proto.Int64(int64(v2.Timer.Stop)),
+		RequestId:      requestId,
+		PeerType:       peerType.Enum(),
+		Method:         method.Enum(),
+		Uri:            proto.String(v2.Tags["uri"]),
+		RemoteAddress:  proto.String(v2.Tags["remote_address"]),
+		UserAgent:      proto.String(v2.Tags["user_agent"]),
+		StatusCode:     proto.Int32(int32(status)),
+		ContentLength:  proto.Int64(length),
+	}
+	if appId, ok := sondeUUID(v2.SourceId); ok {
+		h.ApplicationId = appId
+		h.InstanceId = proto.String(v2.InstanceId)
+	}
+	return h
+}
+
+// A UUID as sonde holds it, the 16 bytes as two little endian halves. Zero, and false, if s isn't a UUID
+func sondeUUID(s string) (*events.UUID, bool) {
+	b, err := hex.DecodeString(strings.Replace(s, "-", "", -1))
+	if err != nil || len(b) != 16 {
+		return &events.UUID{Low: proto.Uint64(0), High: proto.Uint64(0)}, false
+	}
+	return &events.UUID{Low: proto.Uint64(binary.LittleEndian.Uint64(b[:8])), High: proto.Uint64(binary.LittleEndian.Uint64(b[8:]))}, true
+}
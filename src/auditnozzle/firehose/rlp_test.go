@@ -0,0 +1,82 @@
+package firehose
+
+import (
+	"auditnozzle/fakecf"
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+	"testing"
+	"time"
+)
+
+// Every v2 type from the gateway converts to v1 envelopes that marshal and come back the same
+func TestConvertV2RoundTrip(t *testing.T) {
+	guid := fakecf.DefaultApps[0].Guid
+	server := fakecf.NewServer(fakecf.Merge(
+		fakecf.LogMessages(guid, "APP", 3, 10*time.Millisecond),
+		fakecf.CountersWithGaps("MetronAgent", "metron", "0", "dropsondeMarshaller.sentEnvelopes", logTags, 20, 3, nil, 10*time.Millisecond),
+		fakecf.Gauges("cell-1", "0", map[string]float64{"cpu": 10, "memory": 512}, 3, 10*time.Millisecond),
+		fakecf.Timers(guid, 3, 10*time.Millisecond),
+		fakecf.Concat(fakecf.Pause(20*time.Millisecond), fakecf.Events("cloud_controller", "app crashed", "exited with status 1")),
+	))
+	defer server.Close()
+
+	conn, err := OpenRLP(testFoundation(server, "rlp"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	list := receive(t, conn.Messages(), 16)
+	types := countTypes(list)
+	want := map[events.Envelope_EventType]int{
+		events.Envelope_LogMessage:    3,
+		events.Envelope_CounterEvent:  3,
+		events.Envelope_ValueMetric:   6,
+		events.Envelope_HttpStartStop: 3,
+		events.Envelope_Error:         1,
+	}
+	for eventType, n := range want {
+		if types[eventType] != n {
+			t.Errorf("got %v, want %v", types, want)
+			break
+		}
+	}
+
+	for _, env := range list {
+		data, err := proto.Marshal(env)
+		if err != nil {
+			t.Errorf("%s doesn't marshal: %v", env.GetEventType(), err)
+			continue
+		}
+		back := &events.Envelope{}
+		if err := proto.Unmarshal(data, back); err != nil {
+			t.Errorf("%s doesn't unmarshal: %v", env.GetEventType(), err)
+			continue
+		}
+		if !proto.Equal(env, back) {
+			t.Errorf("round trip changed %v\nto %v", env, back)
+		}
+
+		if h := env.GetHttpStartStop(); h != nil {
+			appId, _ := sondeUUID(guid)
+			if h.GetMethod() != events.Method_POST || h.GetPeerType() != events.PeerType_Client || h.GetStatusCode() != 201 ||
+				h.GetContentLength() != 512 || h.GetRequestId().GetLow() == 0 || !proto.Equal(h.GetApplicationId(), appId) {
+				t.Errorf("timer converted to %v", h)
+			}
+		}
+	}
+}
+
+// A timer without gorouter's tags still marshals, every field it needs has the zero value
+func TestConvertV2TimerWithoutTags(t *testing.T) {
+	list := ConvertV2(V2Envelope{SourceId: "router", Timer: &V2Timer{Name: "http", Start: 1, Stop: 2}})
+	if len(list) != 1 {
+		t.Fatalf("converted to %d envelopes, want 1", len(list))
+	}
+	if _, err := proto.Marshal(list[0]); err != nil {
+		t.Error(err)
+	}
+	if h := list[0].GetHttpStartStop(); h.ApplicationId != nil || h.GetMethod() != events.Method_GET {
+		t.Errorf("timer converted to %v", h)
+	}
+}
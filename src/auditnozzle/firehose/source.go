@@ -0,0 +1,29 @@
+package firehose
+
+import (
+	"github.com/cloudfoundry/sonde-go/events"
+	"time"
+)
+
+// Anything a scanner can read envelopes from: the live firehose subscription, or a replayed capture file
+type Source interface {
+	Messages() <-chan *events.Envelope
+
+	// When the envelope arrived at the nozzle. Live sources return the current time, a replay returns
+	// the time it was originally captured
+	ReceiveTime(msg *events.Envelope) time.Time
+
+	Received() uint64
+	Dropped() uint64
+
+	// How long the source was held up by a scanner not taking envelopes: the subscription's buffer was
+	// full and envelopes were dropped, or a replay waited to send
+	Blocked() time.Duration
+	Disconnects() []Disconnect
+	Shards() int
+	Close()
+}
+
+func (s *Subscription) ReceiveTime(msg *events.Envelope) time.Time {
+	return time.Now()
+}
@@ -0,0 +1,286 @@
+package firehose
+
+import (
+	"fmt"
+	"github.com/cloudfoundry/sonde-go/events"
+	"math/rand"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	MinReconnectDelay = 500 * time.Millisecond
+	MaxReconnectDelay = time.Minute
+
+	// a connection that stayed up at least this long resets the backoff
+	StableConnectionTime = 30 * time.Second
+)
+
+/********************************************************************************************************
+* An upstream is one connection to Loggregator, either the v1 firehose websocket or the v2 RLP gateway.
+* Both keep themselves open, reconnecting with backoff and a refreshed token, and record every gap
+ */
+
+type Upstream interface {
+	Messages() <-chan *events.Envelope
+	Received() uint64
+	Disconnects() []Disconnect
+	Label() string
+	Close()
+}
+
+type Disconnect struct {
+	Shard  int
+	Time   time.Time
+	Reason string
+	Gap    time.Duration
+	Open   bool
+}
+
+// The state shared by both kinds of upstream
+type link struct {
+	SubscriptionId string
+	Shard          int
+	OpenTime       time.Time
+
+	msgChan     chan *events.Envelope
+	refresher   TokenRefresher
+	token       string
+	mutex       sync.Mutex
+	disconnects []Disconnect
+	down        bool
+	received    uint64
+	closed      chan struct{}
+	closeOnce   sync.Once
+}
+
+func newLink(subscriptionId string, shard int, token string, f *Foundation) link {
+	return link{
+		SubscriptionId: subscriptionId,
+		Shard:          shard,
+		OpenTime:       time.Now(),
+		msgChan:        make(chan *events.Envelope),
+		closed:         make(chan struct{}),
+		refresher:      CfTokenRefresher{f},
+		token:          token,
+	}
+}
+
+func (l *link) Messages() <-chan *events.Envelope {
+	return l.msgChan
+}
+
+// connect streams messages into deliver() until the connection fails, and returns why. Whenever it does,
+// the gap is recorded and it is called again after a backoff
+func (l *link) run(name string, connect func() error, unauthorized func(error) bool) {
+
+	delay := MinReconnectDelay
+	lastUnauthorized := false
+
+	for {
+		connectTime := time.Now()
+
+		err := connect()
+		if l.isClosed() {
+			close(l.msgChan)
+			return
+		}
+
+		l.recordDisconnect(err)
+
+		if time.Since(connectTime) > StableConnectionTime {
+			delay = MinReconnectDelay
+		}
+
+		// A token that expired during a long run, or was revoked, shows up as an auth error. Reconnect
+		// straight away with a new one, and only back off if the new token is refused as well
+		isUnauthorized := unauthorized(err)
+		l.RefreshToken(isUnauthorized)
+		if isUnauthorized && !lastUnauthorized {
+			lastUnauthorized = true
+			fmt.Fprintf(os.Stderr, "%s %s token refused, reconnecting with refreshed token\n", name, l.SubscriptionId)
+			continue
+		}
+		lastUnauthorized = isUnauthorized
+
+		wait := Jitter(delay)
+		fmt.Fprintf(os.Stderr, "%s %s shard %d disconnected: %v, reconnecting in %s\n", name, l.SubscriptionId, l.Shard, err, wait.String())
+		select {
+		case <-time.After(wait):
+		case <-l.closed:
+			close(l.msgChan)
+			return
+		}
+
+		delay *= 2
+		if delay > MaxReconnectDelay {
+			delay = MaxReconnectDelay
+		}
+	}
+}
+
+// Returns false once the upstream has been closed
+func (l *link) deliver(msg *events.Envelope) bool {
+	atomic.AddUint64(&l.received, 1)
+
+	select {
+	case l.msgChan <- msg:
+		return true
+	case <-l.closed:
+		return false
+	}
+}
+
+func (l *link) closeLink() bool {
+	first := false
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		first = true
+	})
+	return first
+}
+
+func (l *link) isClosed() bool {
+	select {
+	case <-l.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *link) Received() uint64 {
+	return atomic.LoadUint64(&l.received)
+}
+
+// Returns a wait in the range [delay/2, delay) so that scanners don't all reconnect in lock step
+func Jitter(delay time.Duration) time.Duration {
+	half := int64(delay / 2)
+	if half <= 0 {
+		return delay
+	}
+	return time.Duration(half + rand.Int63n(half))
+}
+
+/******************************************************************************************/
+// token refresh
+
+type TokenRefresher interface {
+	// the current token, refreshed when it is close to expiry
+	RefreshAuthToken() (string, error)
+
+	// a token fetched now, for when the current one was refused before it was due to expire
+	NewAuthToken() (string, error)
+}
+
+// cfclient's token source hands back the cached token until it is close to expiry, then refreshes it with UAA.
+// It would keep handing back a token that has been refused, so a new one is fetched from UAA instead
+type CfTokenRefresher struct {
+	Foundation *Foundation
+}
+
+func (r CfTokenRefresher) RefreshAuthToken() (string, error) {
+	return r.Foundation.Client().GetToken()
+}
+
+func (r CfTokenRefresher) NewAuthToken() (string, error) {
+	return r.Foundation.NewToken()
+}
+
+func (l *link) SetTokenRefresher(r TokenRefresher) {
+	l.mutex.Lock()
+	l.refresher = r
+	l.mutex.Unlock()
+}
+
+// refused asks for a new token rather than the current one. On failure the old token is kept; the next
+// connect attempt will fail and come back here
+func (l *link) RefreshToken(refused bool) {
+	l.mutex.Lock()
+	refresher := l.refresher
+	l.mutex.Unlock()
+
+	if refresher == nil {
+		return
+	}
+
+	refresh := refresher.RefreshAuthToken
+	if refused {
+		refresh = refresher.NewAuthToken
+	}
+	token, err := refresh()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failure refreshing token: %s\n", err)
+		return
+	}
+
+	l.mutex.Lock()
+	l.token = token
+	l.mutex.Unlock()
+}
+
+func (l *link) Token() string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.token
+}
+
+/******************************************************************************************/
+
+func (l *link) recordDisconnect(err error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.down {
+		return
+	}
+
+	reason := "unknown"
+	if err != nil {
+		reason = err.Error()
+	}
+
+	l.down = true
+	l.disconnects = append(l.disconnects, Disconnect{Shard: l.Shard, Time: time.Now(), Reason: reason})
+}
+
+// The gap ends when messages start flowing again, not when the connection reopens, so each connection
+// calls this with its first message
+func (l *link) recordReconnect() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if !l.down {
+		return
+	}
+
+	d := &l.disconnects[len(l.disconnects)-1]
+	d.Gap = time.Since(d.Time)
+	l.down = false
+}
+
+// A disconnect that has not yet recovered is returned with Open set and the gap measured up to now
+func (l *link) Disconnects() []Disconnect {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	list := make([]Disconnect, len(l.disconnects))
+	copy(list, l.disconnects)
+
+	if l.down {
+		d := &list[len(list)-1]
+		d.Gap = time.Since(d.Time)
+		d.Open = true
+	}
+	return list
+}
+
+func Downtime(disconnects []Disconnect) time.Duration {
+	var total time.Duration
+	for _, d := range disconnects {
+		total += d.Gap
+	}
+	return total
+}
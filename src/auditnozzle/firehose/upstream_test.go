@@ -0,0 +1,53 @@
+package firehose
+
+import (
+	"auditnozzle/fakecf"
+	"testing"
+	"time"
+)
+
+// A token refused before it was due to expire is replaced by a new one from UAA, and the connection opened
+// with it carries on with the same subscription
+func TestReconnectWithNewToken(t *testing.T) {
+	guid := fakecf.DefaultApps[0].Guid
+	server := fakecf.NewServer(fakecf.Concat(
+		fakecf.LogMessages(guid, "APP", 5, 10*time.Millisecond),
+		fakecf.Pause(300*time.Millisecond),
+		fakecf.Disconnect(),
+		fakecf.LogMessages(guid, "RTR", 5, 10*time.Millisecond),
+	))
+	defer server.Close()
+
+	for _, source := range []string{"firehose", "rlp"} {
+		t.Run(source, func(t *testing.T) {
+			f := testFoundation(server, source)
+			f.SubscriptionId = "token-" + source
+			conn, err := openUpstream(f, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			receive(t, conn.Messages(), 5)
+			tokens, connections := server.TokenRequests(), server.Connections()
+			server.ExpireTokens()
+
+			list := receive(t, conn.Messages(), 5)
+			for _, env := range list {
+				if src := env.GetLogMessage().GetSourceType(); src != "RTR" {
+					t.Errorf("log from %s after the reconnect, want the rest of the subscription's RTR logs", src)
+				}
+			}
+
+			if server.TokenRequests() == tokens {
+				t.Error("reconnected without fetching a new token")
+			}
+			if got := server.Connections() - connections; got != 1 {
+				t.Errorf("%d connections accepted after the token expired, want 1", got)
+			}
+			if d := conn.Disconnects(); len(d) != 1 || d[0].Open {
+				t.Errorf("disconnects %+v, want one closed gap", d)
+			}
+		})
+	}
+}
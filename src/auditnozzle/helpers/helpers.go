@@ -3,13 +3,15 @@ package helpers
 import (
 	"fmt"
 	"io"
+	"sync"
 	"time"
 )
 
 //****************************************************************************************
-// General histogram bin
+// General histogram bin, safe for a scan to insert samples while a report prints it
 
 type HistogramBin struct {
+	mutex     sync.Mutex
 	bins      []int
 	increment int
 	totalCnt  int
@@ -31,10 +33,42 @@ func NewBin(increment, max int) *HistogramBin {
 	}
 }
 
+// Clears the samples, keeping the bins
+func (h *HistogramBin) Reset() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.bins = make([]int, len(h.bins))
+	h.totalCnt = 0
+	h.totalVal = 0
+	h.numGTmax = 0
+	h.lowest = 0
+	h.highest = 0
+}
+
 func (h *HistogramBin) InsertSample(s int) {
 
 	// fmt.Println("insert", s, h.max, s/h.increment, len(h.bins))
 
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.insert(s)
+}
+
+// Several samples under one lock, for a caller that collects them first
+func (h *HistogramBin) InsertSamples(samples []int) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for _, s := range samples {
+		h.insert(s)
+	}
+}
+
+// caller holds the mutex
+func (h *HistogramBin) insert(s int) {
+
 	if s > h.highest {
 		h.highest = s
 	}
@@ -59,6 +93,9 @@ func (h *HistogramBin) InsertSample(s int) {
 
 func (h *HistogramBin) PrintBins(iow io.Writer) {
 
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
 	if h.totalCnt == 0 {
 		fmt.Fprintln(iow, "No histogram data recorded")
 		return
@@ -80,6 +117,156 @@ func (h *HistogramBin) PrintBins(iow io.Writer) {
 
 }
 
+// Exported form of a histogram, so one can be sent between app instances and merged
+type HistogramData struct {
+	Bins      []int
+	Increment int
+	TotalCnt  int
+	TotalVal  int
+	Max       int
+	NumGTmax  int
+	Lowest    int
+	Highest   int
+}
+
+func (h *HistogramBin) Data() HistogramData {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	bins := make([]int, len(h.bins))
+	copy(bins, h.bins)
+
+	return HistogramData{
+		Bins:      bins,
+		Increment: h.increment,
+		TotalCnt:  h.totalCnt,
+		TotalVal:  h.totalVal,
+		Max:       h.max,
+		NumGTmax:  h.numGTmax,
+		Lowest:    h.lowest,
+		Highest:   h.highest,
+	}
+}
+
+func (h *HistogramBin) Merge(d HistogramData) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if d.Increment != h.increment || d.Max != h.max || len(d.Bins) != len(h.bins) {
+		return fmt.Errorf("histogram %d/%d can't be merged with %d/%d", d.Increment, d.Max, h.increment, h.max)
+	}
+
+	if d.TotalCnt == 0 {
+		return nil
+	}
+
+	for i, b := range d.Bins {
+		h.bins[i] += b
+	}
+
+	if d.Highest > h.highest {
+		h.highest = d.Highest
+	}
+	if h.lowest == 0 || d.Lowest < h.lowest {
+		h.lowest = d.Lowest
+	}
+
+	h.totalCnt += d.TotalCnt
+	h.totalVal += d.TotalVal
+	h.numGTmax += d.NumGTmax
+	return nil
+}
+
+func (d HistogramData) Average() int {
+	if d.TotalCnt == 0 {
+		return 0
+	}
+	return d.TotalVal / d.TotalCnt
+}
+
+// The upper edge of the bin holding the p'th percentile (0-100) sample. If it falls among the samples over
+// the histogram's max, the highest sample is returned
+func (d HistogramData) Percentile(p float64) int {
+	if d.TotalCnt == 0 {
+		return 0
+	}
+
+	want := int(float64(d.TotalCnt)*p/100 + 0.5)
+	if want < 1 {
+		want = 1
+	}
+
+	seen := 0
+	for i, b := range d.Bins {
+		seen += b
+		if seen >= want {
+			return (i + 1) * d.Increment
+		}
+	}
+	return d.Highest
+}
+
+// Histograms with the same bins side by side, one column of percentages per name
+func PrintBinsCompared(iow io.Writer, names []string, data []HistogramData) {
+
+	if len(data) == 0 {
+		return
+	}
+	for _, d := range data[1:] {
+		if d.Increment != data[0].Increment || len(d.Bins) != len(data[0].Bins) {
+			fmt.Fprintln(iow, "histograms have different bins, can't compare")
+			return
+		}
+	}
+
+	fmt.Fprintf(iow, "|  low   |  high  |")
+	for _, name := range names {
+		fmt.Fprintf(iow, "%12.12s |", name)
+	}
+	fmt.Fprintln(iow)
+
+	for i := range data[0].Bins {
+		fmt.Fprintf(iow, "|%7d |%7d |", i*data[0].Increment, (i+1)*data[0].Increment)
+		for _, d := range data {
+			fmt.Fprintf(iow, "%11s%% |", percentStr(d.Bins[i], d.TotalCnt))
+		}
+		fmt.Fprintln(iow)
+	}
+
+	fmt.Fprintf(iow, "|  > %-12d |", data[0].Max)
+	for _, d := range data {
+		fmt.Fprintf(iow, "%11s%% |", percentStr(d.NumGTmax, d.TotalCnt))
+	}
+	fmt.Fprintln(iow)
+
+	rows := []struct {
+		label string
+		value func(HistogramData) int
+	}{
+		{"Average", HistogramData.Average},
+		{"50th", func(d HistogramData) int { return d.Percentile(50) }},
+		{"90th", func(d HistogramData) int { return d.Percentile(90) }},
+		{"99th", func(d HistogramData) int { return d.Percentile(99) }},
+		{"Max", func(d HistogramData) int { return d.Highest }},
+		{"Min", func(d HistogramData) int { return d.Lowest }},
+		{"N", func(d HistogramData) int { return d.TotalCnt }},
+	}
+	for _, row := range rows {
+		fmt.Fprintf(iow, "%-18s|", row.label)
+		for _, d := range data {
+			fmt.Fprintf(iow, "%12d |", row.value(d))
+		}
+		fmt.Fprintln(iow)
+	}
+}
+
+func percentStr(n, total int) string {
+	if total == 0 {
+		return "--"
+	}
+	return fmt.Sprintf("%.1f", 100*float64(n)/float64(total))
+}
+
 /******************************************************************************************/
 // general helpers
 
@@ -92,6 +279,19 @@ func TimeStr(t time.Duration) string {
 
 }
 
+// e.g. 512B, 100.0KB, 20.5MB
+func BytesStr(b uint64) string {
+	switch {
+	case b >= 1<<30:
+		return fmt.Sprintf("%.1fGB", float64(b)/(1<<30))
+	case b >= 1<<20:
+		return fmt.Sprintf("%.1fMB", float64(b)/(1<<20))
+	case b >= 1<<10:
+		return fmt.Sprintf("%.1fKB", float64(b)/(1<<10))
+	}
+	return fmt.Sprintf("%dB", b)
+}
+
 func Exists(a string, list map[string]string) bool {
 	for _, b := range list {
 		if b == a {
@@ -1,48 +1,137 @@
 package latency
 
 import (
+	"auditnozzle/firehose"
 	"auditnozzle/helpers"
 	"auditnozzle/scanengine"
+	"encoding/json"
+	"fmt"
 	"github.com/cloudfoundry/sonde-go/events"
 	"io"
 	"net/http"
-	"time"
 )
 
-var MsgLatencyBin *helpers.HistogramBin = helpers.NewBin(20, 200)
-var MsgLatencyScan = scanengine.ScanEngine{Name: "Envelope Latency"}
+// Each run has its own scan and histogram. The histogram is cleared in place rather than replaced,
+// since the scan and the reports hold on to it
+type Latency struct {
+	MsgLatencyScan scanengine.ScanEngine
+	MsgLatencyBin  *helpers.HistogramBin
+}
 
-func ResetData() {
-	MsgLatencyScan.Reset()
-	MsgLatencyBin = helpers.NewBin(20, 200)
+// A new run's empty results
+func New(f *firehose.Foundation) *Latency {
+	l := &Latency{
+		MsgLatencyScan: scanengine.ScanEngine{Name: "Envelope Latency", Foundation: f},
+		MsgLatencyBin:  helpers.NewBin(20, 200),
+	}
+	l.MsgLatencyScan.Sampleable = func(*events.Envelope) bool { return true }
+	l.MsgLatencyScan.SeriesColumns = []scanengine.SeriesColumn{{Name: "latency ms", Average: true}}
+	return l
 }
 
-func MeasureLatency(req *http.Request, res io.Writer) {
+// The results of the foundation's latest run, empty if there hasn't been one
+func For(f *firehose.Foundation) *Latency {
+	if run := scanengine.LatestRun(Scanner.Name, f); run != nil {
+		return run.Results.(*Latency)
+	}
+	return New(f)
+}
 
-	if err := MsgLatencyScan.Start(req, res); err != nil {
-		return
+func (l *Latency) Engine() *scanengine.ScanEngine {
+	return &l.MsgLatencyScan
+}
+
+var Scanner = scanengine.Scanner{
+	Name:    "latency",
+	Measure: "measurelatency",
+	Reports: []scanengine.Report{
+		{Route: "reportlatency", Params: "<series (default no)>", Write: func(r scanengine.Results, req *http.Request, res io.Writer) {
+			r.(*Latency).ReportLatency(res)
+			r.Engine().WriteSeries(res, scanengine.BoolParm(req, "series", false))
+		}},
+	},
+	New: func(f *firehose.Foundation) scanengine.Results { return New(f) },
+	Start: func(r scanengine.Results, req *http.Request, res io.Writer) error {
+		return r.(*Latency).MeasureLatency(req, res)
+	},
+}
+
+func (l *Latency) ResetData() {
+	l.MsgLatencyScan.Reset()
+	l.MsgLatencyBin.Reset()
+}
+
+func (l *Latency) MeasureLatency(req *http.Request, res io.Writer) error {
+
+	if err := l.MsgLatencyScan.Start(req, res); err != nil {
+		return err
 	}
 
 	go func() {
-		MsgLatencyScan.Run(LatencyIterator)
+		l.MsgLatencyScan.Run(l.LatencyIterator)
 	}()
-
+	return nil
 }
 
-func LatencyIterator(msg *events.Envelope) {
+func (l *Latency) LatencyIterator(msg *events.Envelope) bool {
 
-	now := time.Now().UnixNano()
+	now := l.MsgLatencyScan.MessageTime().UnixNano()
 	timeSent := msg.GetTimestamp()
 
 	latency := now - timeSent
 	latencyMs := int(latency / 1e6)
 
-	MsgLatencyBin.InsertSample(latencyMs)
+	l.MsgLatencyBin.InsertSample(latencyMs)
+	l.MsgLatencyScan.Record(0, latencyMs)
+	return true
+}
+
+func (l *Latency) ReportLatency(outputWriter io.Writer) {
+	l.MsgLatencyScan.WriteStatus(outputWriter)
+	l.MsgLatencyScan.WriteSampling(outputWriter)
+	l.MsgLatencyBin.PrintBins(outputWriter)
+	l.MsgLatencyScan.WriteHistogramEstimate(outputWriter, l.Snapshot().TotalCnt)
+
+}
 
+func (l *Latency) Snapshot() helpers.HistogramData {
+	return l.MsgLatencyBin.Data()
 }
 
-func ReportLatency(outputWriter io.Writer) {
-	MsgLatencyScan.WriteStatus(outputWriter)
-	MsgLatencyBin.PrintBins(outputWriter)
+func (l *Latency) SaveData() ([]byte, error) {
+	return json.Marshal(l.Snapshot())
+}
+
+func (l *Latency) RestoreData(data []byte) error {
+	var snapshot helpers.HistogramData
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return err
+	}
+	l.MsgLatencyBin.Reset()
+	return l.MsgLatencyBin.Merge(snapshot)
+}
 
+// Histograms from several app instances sharing the firehose subscription
+func ReportLatencyCombined(outputWriter io.Writer, snapshots []helpers.HistogramData) {
+	combined := helpers.NewBin(20, 200)
+
+	for _, snapshot := range snapshots {
+		if err := combined.Merge(snapshot); err != nil {
+			fmt.Fprintln(outputWriter, err)
+			return
+		}
+	}
+	combined.PrintBins(outputWriter)
+}
+
+// The latency distributions of several foundations side by side
+func ReportLatencyComparison(outputWriter io.Writer, names []string, latencies []*Latency) {
+	var data []helpers.HistogramData
+
+	for i, l := range latencies {
+		fmt.Fprintf(outputWriter, "%-12s ", names[i])
+		l.MsgLatencyScan.WriteStatus(outputWriter)
+		data = append(data, l.Snapshot())
+	}
+	helpers.PrintBinsCompared(outputWriter, names, data)
 }
@@ -0,0 +1,31 @@
+package latency
+
+import (
+	"auditnozzle/fakecf"
+	"auditnozzle/scantest"
+	"testing"
+	"time"
+)
+
+// Envelopes stamped when they are sent arrive within the first bin, ones from a clock half a second behind
+// are past the histogram's max
+func TestMeasureAndReportLatency(t *testing.T) {
+	chatty := fakecf.DefaultApps[0]
+	server, f := scantest.StartFakeCF(t, fakecf.Merge(
+		fakecf.LogMessages(chatty.Guid, "APP", 10, 10*time.Millisecond),
+		fakecf.Skewed(fakecf.LogMessages(chatty.Guid, "RTR", 10, 10*time.Millisecond), -500*time.Millisecond),
+	))
+	defer server.Close()
+
+	run := scantest.Measure(t, Scanner, f, "runtime=30s&count=20")
+	scantest.WaitEnded(t, run)
+	if reason := run.Results.Engine().StopReason(); reason != "count reached" {
+		t.Errorf("run ended with %q, want count reached", reason)
+	}
+
+	scantest.WaitReport(t, Scanner, run, "reportlatency", "",
+		[]string{"|", "0", "|", "20", "|", "10", "|", "50", "|"},
+		[]string{"Num", "greater", "than", "max", "of", "200:", "10", "(50)"},
+		[]string{"N", "20"},
+	)
+}
@@ -1,44 +1,125 @@
 package loglength
 
 import (
+	"auditnozzle/firehose"
 	"auditnozzle/helpers"
 	"auditnozzle/scanengine"
+	"encoding/json"
+	"fmt"
 	"github.com/cloudfoundry/sonde-go/events"
 	"io"
 	"net/http"
 )
 
-var LogLengthHistBin *helpers.HistogramBin = helpers.NewBin(200, 10000)
-var LogLengthHistScan = scanengine.ScanEngine{Name: "Log Length Histogram"}
+// Each run has its own scan and histogram. The histogram is cleared in place rather than replaced,
+// since the scan and the reports hold on to it
+type LogLength struct {
+	LogLengthHistScan scanengine.ScanEngine
+	LogLengthHistBin  *helpers.HistogramBin
+}
+
+// A new run's empty results
+func New(f *firehose.Foundation) *LogLength {
+	l := &LogLength{
+		LogLengthHistScan: scanengine.ScanEngine{Name: "Log Length Histogram", Foundation: f},
+		LogLengthHistBin:  helpers.NewBin(200, 10000),
+	}
+	l.LogLengthHistScan.Sampleable = func(msg *events.Envelope) bool {
+		return msg.GetEventType() == events.Envelope_LogMessage
+	}
+	l.LogLengthHistScan.SeriesColumns = []scanengine.SeriesColumn{{Name: "log length", Average: true}}
+	return l
+}
+
+// The results of the foundation's latest run, empty if there hasn't been one
+func For(f *firehose.Foundation) *LogLength {
+	if run := scanengine.LatestRun(Scanner.Name, f); run != nil {
+		return run.Results.(*LogLength)
+	}
+	return New(f)
+}
+
+func (l *LogLength) Engine() *scanengine.ScanEngine {
+	return &l.LogLengthHistScan
+}
+
+var Scanner = scanengine.Scanner{
+	Name:    "loghist",
+	Measure: "measureloghist",
+	Reports: []scanengine.Report{
+		{Route: "reportloghist", Params: "<series (default no)>", Write: func(r scanengine.Results, req *http.Request, res io.Writer) {
+			r.(*LogLength).ReportLogHistogram(res)
+			r.Engine().WriteSeries(res, scanengine.BoolParm(req, "series", false))
+		}},
+	},
+	New: func(f *firehose.Foundation) scanengine.Results { return New(f) },
+	Start: func(r scanengine.Results, req *http.Request, res io.Writer) error {
+		return r.(*LogLength).ReadLogHistogram(req, res)
+	},
+}
 
-func ResetData() {
-	LogLengthHistBin = helpers.NewBin(200, 10000)
-	LogLengthHistScan.Reset()
+func (l *LogLength) ResetData() {
+	l.LogLengthHistScan.Reset()
+	l.LogLengthHistBin.Reset()
 }
 
-func ReadLogHistogram(req *http.Request, res io.Writer) {
+func (l *LogLength) ReadLogHistogram(req *http.Request, res io.Writer) error {
 
-	if err := LogLengthHistScan.Start(req, res); err != nil {
-		return
+	if err := l.LogLengthHistScan.Start(req, res); err != nil {
+		return err
 	}
 
 	go func() {
-		LogLengthHistScan.Run(LogHistIterator)
+		l.LogLengthHistScan.Run(l.LogHistIterator)
 	}()
+	return nil
 }
 
-func LogHistIterator(msg *events.Envelope) {
+func (l *LogLength) LogHistIterator(msg *events.Envelope) bool {
 
 	if msg.GetEventType() != events.Envelope_LogMessage {
-		return
+		return false
 	}
 
 	length := len(msg.GetLogMessage().GetMessage())
-	LogLengthHistBin.InsertSample(length)
+	l.LogLengthHistBin.InsertSample(length)
+	l.LogLengthHistScan.Record(0, length)
+	return true
+}
+
+func (l *LogLength) ReportLogHistogram(outputWriter io.Writer) {
+	l.LogLengthHistScan.WriteStatus(outputWriter)
+	l.LogLengthHistScan.WriteSampling(outputWriter)
+	l.LogLengthHistBin.PrintBins(outputWriter)
+	l.LogLengthHistScan.WriteHistogramEstimate(outputWriter, l.Snapshot().TotalCnt)
+}
+
+func (l *LogLength) Snapshot() helpers.HistogramData {
+	return l.LogLengthHistBin.Data()
+}
 
+func (l *LogLength) SaveData() ([]byte, error) {
+	return json.Marshal(l.Snapshot())
 }
 
-func ReportLogHistogram(outputWriter io.Writer) {
-	LogLengthHistScan.WriteStatus(outputWriter)
-	LogLengthHistBin.PrintBins(outputWriter)
+func (l *LogLength) RestoreData(data []byte) error {
+	var snapshot helpers.HistogramData
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return err
+	}
+	l.LogLengthHistBin.Reset()
+	return l.LogLengthHistBin.Merge(snapshot)
+}
+
+// Histograms from several app instances sharing the firehose subscription
+func ReportLogHistogramCombined(outputWriter io.Writer, snapshots []helpers.HistogramData) {
+	combined := helpers.NewBin(200, 10000)
+
+	for _, snapshot := range snapshots {
+		if err := combined.Merge(snapshot); err != nil {
+			fmt.Fprintln(outputWriter, err)
+			return
+		}
+	}
+	combined.PrintBins(outputWriter)
 }
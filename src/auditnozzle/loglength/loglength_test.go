@@ -0,0 +1,27 @@
+package loglength
+
+import (
+	"auditnozzle/fakecf"
+	"auditnozzle/scantest"
+	"testing"
+	"time"
+)
+
+// Only log messages are measured, the fake's are all 50 bytes long
+func TestMeasureAndReportLogLength(t *testing.T) {
+	server, f := scantest.StartFakeCF(t, fakecf.Merge(
+		fakecf.LogMessages(fakecf.DefaultApps[0].Guid, "APP", 20, 5*time.Millisecond),
+		fakecf.ValueMetrics("rep", "cell", "0", "CapacityTotalMemory", 10, 5*time.Millisecond),
+	))
+	defer server.Close()
+
+	run := scantest.Measure(t, Scanner, f, "runtime=30s&count=20")
+	scantest.WaitEnded(t, run)
+
+	scantest.WaitReport(t, Scanner, run, "reportloghist", "",
+		[]string{"|", "0", "|", "200", "|", "20", "|", "100", "|"},
+		[]string{"Max", "50"},
+		[]string{"Min", "50"},
+		[]string{"N", "20"},
+	)
+}
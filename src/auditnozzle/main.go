@@ -13,14 +13,10 @@ todos
 https://blog.golang.org/go-maps-in-action,
 https://golang.org/pkg/sync/#RWMutex
 
-- give a pattern and only count logs for app names with that pattern
-
 - monitor timestamp format in all the log messages
 
 - add tag monitoring to metric audit - not exactly sure what to look for - for now just capture a list of used tags and maybe which component emits them
 
-- check and tune behavior if the nozzle can't keep up - what slow consumer messages from TC and droppled log messages from Doppler should it look for? Simulate by putting delays in the read loop.
-
 - track latency of messages based on the component they are coming from - ave, min, max
 
 - consider tracking intervals of container metrics, explicitly ignored at the moment.
@@ -32,16 +28,24 @@ https://golang.org/pkg/sync/#RWMutex
 package main
 
 import (
+	"auditnozzle/capture"
+	"auditnozzle/combine"
+	"auditnozzle/compare"
 	"auditnozzle/countlogs"
 	"auditnozzle/counttags"
+	"auditnozzle/firehose"
 	"auditnozzle/latency"
 	"auditnozzle/loglength"
 	"auditnozzle/metricparser"
+	"auditnozzle/scanengine"
+	"auditnozzle/schedule"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
-	"strconv"
+	"os/signal"
+	"strings"
+	"syscall"
 )
 
 var (
@@ -60,23 +64,42 @@ func main() {
 
 	fmt.Fprintln(os.Stdout, "Starting auditnozzle\n")
 
-	http.HandleFunc("/measurelogs", countLogsResponse)
-	http.HandleFunc("/reportlogs", reportLogsResponse)
-	http.HandleFunc("/measuremetrics", auditMetricsResponse)
-	http.HandleFunc("/reportmetricintervals", reportMetricIntervalssResponse)
-	http.HandleFunc("/reportmetricdocs", reportMetricDocsResponse)
-	http.HandleFunc("/measurelatency", measureLatencyResponse)
-	http.HandleFunc("/reportlatency", reportLatencyResponse)
-	http.HandleFunc("/measureloghist", measureLogHistogramResponse)
-	http.HandleFunc("/reportloghist", reportLogHistogramResponse)
-	http.HandleFunc("/measuretags", measureTagsResponse)
-	http.HandleFunc("/reporttags", reportTagsResponse)
+	err = firehose.LoadConfig()
+	if err != nil {
+		panic(err)
+	}
+
+	// the scanners, in the order they're listed on the usage page and in /status
+	scanengine.Register(countlogs.Scanner)
+	scanengine.Register(metricparser.Scanner)
+	scanengine.Register(latency.Scanner)
+	scanengine.Register(loglength.Scanner)
+	scanengine.Register(counttags.Scanner)
+	scanengine.Register(capture.Scanner)
+
+	// the results from before a restart, saved again every SAVE_INTERVAL and when CF stops the app
+	statePath := scanengine.StatePath()
+	if err := scanengine.RestoreState(statePath); err != nil {
+		fmt.Fprintf(os.Stderr, "Restoring state from %s: %v\n", statePath, err)
+	}
+	go scanengine.SaveEvery(statePath, scanengine.SaveIntervalFromEnv())
+	go saveOnStop(statePath)
+
+	scanengine.HandleScanners(http.DefaultServeMux)
+
+	http.HandleFunc("/export", exportResponse)
+	http.HandleFunc("/combine", combineResponse)
+	http.HandleFunc("/measurecompare", measureCompareResponse)
+	http.HandleFunc("/compare", compareResponse)
+	http.HandleFunc("/schedule", scheduleResponse)
+	http.HandleFunc("/schedules", schedulesResponse)
+	http.HandleFunc("/deleteschedule", deleteScheduleResponse)
+	http.HandleFunc("/foundations", foundationsResponse)
 	http.HandleFunc("/status", statusResponse)
+	http.HandleFunc("/stop", stopResponse)
 	http.HandleFunc("/reset", resetResponse)
 	http.HandleFunc("/", defaultResponse)
 
-	go countlogs.ProcessNameLookup()
-
 	fmt.Println("listening for auditnozzle commands via curl")
 	err = http.ListenAndServe(":"+os.Getenv("PORT"), nil)
 	if err != nil {
@@ -85,111 +108,172 @@ func main() {
 
 }
 
+// CF sends SIGTERM before it stops or restages the app
+func saveOnStop(statePath string) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+
+	sig := <-signals
+	fmt.Fprintf(os.Stdout, "Received %s, saving state to %s\n", sig, statePath)
+	if err := scanengine.SaveState(statePath); err != nil {
+		fmt.Fprintf(os.Stderr, "Saving state to %s: %v\n", statePath, err)
+	}
+	os.Exit(0)
+}
+
 // ???? Why does this satisfy the interface w/o Handle type somehow involved
 func defaultResponse(res http.ResponseWriter, req *http.Request) {
 	fmt.Fprintln(res, "Supported operations:")
 	fmt.Fprintln(res, "curl <host URL>/<operation>?<parm>=<value>")
-	fmt.Fprintln(res, " measurelogs")
-	fmt.Fprintln(res, " reportlogs <showguids (default no)>")
-	fmt.Fprintln(res, " measuremetrics")
-	fmt.Fprintln(res, " reportmetricintervals <consolidated (default yes)>")
-	fmt.Fprintln(res, " reportmetrics")
-	fmt.Fprintln(res, " measurelatency")
-	fmt.Fprintln(res, " reportlatency")
-	fmt.Fprintln(res, " measureloghist")
-	fmt.Fprintln(res, " reportloghist")
-	fmt.Fprintln(res, " measuretags")
-	fmt.Fprintln(res, " reporttags <showjobs (default no)")
-	fmt.Fprintln(res, " status")
-	fmt.Fprintln(res, " reset")
-
-	fmt.Fprintln(res, "-- all scanners take runtime= flag defaults to 1m")
-	fmt.Fprintln(res, "Set ENV variables: API_ENDPOINT, USER_ID, USER_PASSWORD")
-	fmt.Fprintln(res, "Optionally set SKIP_SSL_VALIDATION")
+	scanengine.WriteUsage(res)
+	fmt.Fprintln(res, " combine report=<logs|tags|latency|loghist> <instances (default from CC)> <byorg (default no)>")
+	fmt.Fprintln(res, " export scanner=<logs|tags|latency|loghist>")
+	fmt.Fprintln(res, " measurecompare scanner=<metrics|logs|latency> <foundations (default all)>")
+	fmt.Fprintln(res, " compare <report=<metrics|logs|latency> (default all)> <foundations (default all)>")
+	fmt.Fprintln(res, " schedule scanner=<name> every=<duration>|cron=<min hour dom month dow> <foundation> <the scanner's parameters>")
+	fmt.Fprintln(res, " schedules")
+	fmt.Fprintln(res, " deleteschedule id=<schedule id>")
+	fmt.Fprintln(res, " foundations")
+	fmt.Fprintln(res, " status <foundation (default all)> <run>")
+	fmt.Fprintf(res, " stop scanner=<%s|all> or run=<id>\n", scanengine.ScannerList())
+	fmt.Fprintln(res, " reset <foundation (default all)> <run>")
+
+	fmt.Fprintln(res, "-- all scanners and reports take foundation=<name>, defaults to the default foundation")
+	fmt.Fprintln(res, "-- each scan is a new run and prints its id, scanners take run=<id> to add to a run, reports take run=<id> (default the latest)")
+	fmt.Fprintln(res, "-- finished runs expire after RUN_EXPIRY (default 24h)")
+	fmt.Fprintln(res, "-- runs are saved to STATE_DIR, a volume service or the temp dir every SAVE_INTERVAL (default 5m) and restored after a restart")
+	fmt.Fprintln(res, "-- all scanners take runtime= flag defaults to 10m")
+	fmt.Fprintln(res, "-- all scanners take count=<envelopes> and bytes=<size, e.g. 20M> to stop earlier, counting only the envelopes the scanner uses")
+	fmt.Fprintln(res, "-- logs, tags, latency and loghist take sample=<1in<N>|random:<fraction>|slice:<on>/<period>>, reports show estimates marked ~ with 95% intervals")
+	fmt.Fprintln(res, "-- logs takes app=<regex> notapp=<regex> org=<names> space=<names> to count some apps only")
+	fmt.Fprintln(res, "-- all scanners take bucket=<duration> (default 1m) for their time series, reports show a sparkline with peaks and troughs, series=true every bucket")
+	fmt.Fprintln(res, "-- all scanners take delay=<duration> to slow every envelope down, to see the rate where the scanner falls behind")
+	fmt.Fprintln(res, "-- all scanners take replay=<capture file> to read a capture instead of the firehose, pace=fast to not wait between envelopes")
+	fmt.Fprintln(res, "Set CONFIG_FILE to a YAML file listing the foundations, or for a single foundation")
+	fmt.Fprintln(res, "Set ENV variables: API_ENDPOINT and either USER_ID, USER_PASSWORD or CLIENT_ID, CLIENT_SECRET")
+	fmt.Fprintln(res, "Optionally set SKIP_SSL_VALIDATION, FIREHOSE_SUBSCRIPTION_ID, FIREHOSE_SHARDS")
+	fmt.Fprintln(res, "Set ENVELOPE_SOURCE=rlp to read v2 envelopes from the RLP gateway (RLP_GATEWAY) instead of the firehose")
 
 }
 
-//curl "auditnozzle.walnut.cf-app.com/countlogs?runtime=20s”
-func countLogsResponse(res http.ResponseWriter, req *http.Request) {
-	countlogs.ReadAndCountLogs(req, res)
+func exportResponse(res http.ResponseWriter, req *http.Request) {
+	combine.Export(req, res)
 }
 
-func reportLogsResponse(res http.ResponseWriter, req *http.Request) {
-	countlogs.ReportCountedLogs(res, GetGuidFlag(req))
+func combineResponse(res http.ResponseWriter, req *http.Request) {
+	combine.Combine(req, res)
 }
 
-func auditMetricsResponse(res http.ResponseWriter, req *http.Request) {
-	metricparser.AuditMetrics(req, res)
+func measureCompareResponse(res http.ResponseWriter, req *http.Request) {
+	compare.MeasureCompare(req, res)
 }
 
-func reportMetricIntervalssResponse(res http.ResponseWriter, req *http.Request) {
-	metricparser.ReportMetricIntervals(res, GetConsolidatedFlag(req))
+func compareResponse(res http.ResponseWriter, req *http.Request) {
+	compare.Compare(req, res)
 }
 
-func reportMetricDocsResponse(res http.ResponseWriter, req *http.Request) {
-	metricparser.ReportMetricDocs(res)
+func scheduleResponse(res http.ResponseWriter, req *http.Request) {
+	schedule.ScheduleResponse(req, res)
 }
 
-func measureLatencyResponse(res http.ResponseWriter, req *http.Request) {
-	latency.MeasureLatency(req, res)
+func schedulesResponse(res http.ResponseWriter, req *http.Request) {
+	schedule.SchedulesResponse(res)
 }
 
-func reportLatencyResponse(res http.ResponseWriter, req *http.Request) {
-	latency.ReportLatency(res)
+func deleteScheduleResponse(res http.ResponseWriter, req *http.Request) {
+	schedule.DeleteScheduleResponse(req, res)
 }
 
-func measureLogHistogramResponse(res http.ResponseWriter, req *http.Request) {
-	loglength.ReadLogHistogram(req, res)
+func foundationsResponse(res http.ResponseWriter, req *http.Request) {
+	def := firehose.DefaultFoundation()
+	for _, f := range firehose.Foundations() {
+		marker := " "
+		if f == def {
+			marker = "*"
+		}
+		fmt.Fprintf(res, "%s %-20s %-50s %-8s %s\n", marker, f.Name, f.ApiEndpoint, f.EnvelopeSource, f.Credentials)
+	}
 }
 
-func reportLogHistogramResponse(res http.ResponseWriter, req *http.Request) {
-	loglength.ReportLogHistogram(res)
+// run=<id> for one run, otherwise every run of the requested foundations
+func statusResponse(res http.ResponseWriter, req *http.Request) {
+	for _, f := range requestedFoundations(res, req) {
+		f.Hub().WriteStatus(res)
+		if f.Resolver().Used() {
+			fmt.Fprintf(res, "%s: ", f.Name)
+			f.Resolver().WriteStatus(res)
+		}
+		if runs, ok := requestedRuns(res, req, f); ok {
+			scanengine.WriteRunStatus(res, runs)
+		}
+	}
 }
 
-func measureTagsResponse(res http.ResponseWriter, req *http.Request) {
-	counttags.ReadAndCountTags(req, res)
-}
+// Ends running scans early, scanner=<name|all> or run=<id>. Their results so far stay available to the reports
+func stopResponse(res http.ResponseWriter, req *http.Request) {
+	f, ok := getFoundation(res, req)
+	if !ok {
+		return
+	}
+	runs, ok := requestedRuns(res, req, f)
+	if !ok {
+		return
+	}
 
-func reportTagsResponse(res http.ResponseWriter, req *http.Request) {
-	counttags.ReportCountedTags(res, GetShowJobsFlag(req))
-}
+	name := req.FormValue("scanner")
+	if name == "" && req.FormValue("run") != "" {
+		name = "all"
+	}
 
-func statusResponse(res http.ResponseWriter, req *http.Request) {
-	countlogs.CountScan.WriteStatus(res)
-	loglength.LogLengthHistScan.WriteStatus(res)
-	latency.MsgLatencyScan.WriteStatus(res)
-	metricparser.AuditScan.WriteStatus(res)
+	if !scanengine.StopRuns(res, runs, name) {
+		fmt.Fprintf(res, "scanner= must be one of %s or all\n", strings.Join(scanengine.ScannerNames(), ", "))
+	}
 }
 
+// Clears the results of the runs, which stay listed until they expire or are deleted
 func resetResponse(res http.ResponseWriter, req *http.Request) {
-	countlogs.ResetData()
-	loglength.ResetData()
-	latency.ResetData()
-	metricparser.ResetData()
+	for _, f := range requestedFoundations(res, req) {
+		if runs, ok := requestedRuns(res, req, f); ok {
+			scanengine.ResetRuns(runs)
+		}
+	}
 }
 
-func GetGuidFlag(req *http.Request) bool {
-	showGuids, err := strconv.ParseBool(req.FormValue("showguid"))
+// foundation=<name>, or the default foundation
+func getFoundation(res io.Writer, req *http.Request) (*firehose.Foundation, bool) {
+	f, err := firehose.FoundationFromRequest(req)
 	if err != nil {
-		showGuids = false
+		fmt.Fprintln(res, err)
+		return nil, false
 	}
-	return showGuids
+	return f, true
 }
 
-func GetConsolidatedFlag(req *http.Request) bool {
-
-	consolidatedFlag, err := strconv.ParseBool(req.FormValue("consolidated"))
-	if err != nil {
-		consolidatedFlag = true
+// foundation=<name>, or all of them. A run=<id> is on its own foundation
+func requestedFoundations(res io.Writer, req *http.Request) []*firehose.Foundation {
+	if id := req.FormValue("run"); id != "" {
+		run, err := scanengine.LookupRun(id)
+		if err != nil {
+			fmt.Fprintln(res, err)
+			return nil
+		}
+		return []*firehose.Foundation{run.Foundation}
 	}
-	return consolidatedFlag
+	if req.FormValue("foundation") == "" {
+		return firehose.Foundations()
+	}
+	if f, ok := getFoundation(res, req); ok {
+		return []*firehose.Foundation{f}
+	}
+	return nil
 }
 
-func GetShowJobsFlag(req *http.Request) bool {
-
-	showjobsFlag, err := strconv.ParseBool(req.FormValue("showjobs"))
+// run=<id>, or all the foundation's runs
+func requestedRuns(res io.Writer, req *http.Request, f *firehose.Foundation) ([]*scanengine.Run, bool) {
+	runs, err := scanengine.SelectRuns(f, req.FormValue("run"))
 	if err != nil {
-		showjobsFlag = false
+		fmt.Fprintln(res, err)
+		return nil, false
 	}
-	return showjobsFlag
+	return runs, true
 }
@@ -1,15 +1,19 @@
 package metricparser
 
 import (
+	"auditnozzle/firehose"
 	"auditnozzle/scanengine"
 	"encoding/csv"
+	"encoding/json"
 	"fmt"
 	"github.com/cloudfoundry/sonde-go/events"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -28,6 +32,10 @@ type aMetric struct {
 	SumOfAllTimes       time.Duration
 	LongestTimeBetween  time.Duration
 	ShortestTimeBetween time.Duration
+
+	// only from v2 envelopes: the source id, and the values reported alongside this one in the same gauge
+	SourceId    string
+	GaugeValues string
 }
 
 type metricSlice []*aMetric
@@ -39,54 +47,116 @@ func (a metricSlice) Less(i, j int) bool { return a[i].Origin+a[i].Name < a[j].O
 
 /******************************************************************************************/
 
-var (
-	AuditScan      = scanengine.ScanEngine{Name: "Metric Audit"}
-	ReadMetricsMap metricMap
-	MetricsMutex   sync.Mutex
-)
+// Each run has its own scan and metrics
+type MetricAudit struct {
+	AuditScan scanengine.ScanEngine
+
+	// the documented metrics, origin and name on each line
+	DocsFile string
+
+	// guards the map, the scan's go routine writes it while reports read it
+	metricsMutex   sync.Mutex
+	readMetricsMap metricMap
+}
+
+const DefaultMetricsDocFile = "/app/resources/metrics.list.example.csv"
 
-func ResetData() {
-	AuditScan.Reset()
+// A new run's empty results
+func New(f *firehose.Foundation) *MetricAudit {
+	a := &MetricAudit{
+		AuditScan:      scanengine.ScanEngine{Name: "Metric Audit", Foundation: f},
+		DocsFile:       DefaultMetricsDocFile,
+		readMetricsMap: make(metricMap),
+	}
+	a.AuditScan.UntilCondition = a.untilCondition
+	return a
+}
+
+// The results of the foundation's latest run, empty if there hasn't been one
+func For(f *firehose.Foundation) *MetricAudit {
+	if run := scanengine.LatestRun(Scanner.Name, f); run != nil {
+		return run.Results.(*MetricAudit)
+	}
+	return New(f)
+}
+
+func (a *MetricAudit) Engine() *scanengine.ScanEngine {
+	return &a.AuditScan
+}
+
+var Scanner = scanengine.Scanner{
+	Name:    "metrics",
+	Measure: "measuremetrics",
+	Params:  "<until=documented[:<times> (default 2)]>",
+	Reports: []scanengine.Report{
+		{Route: "reportmetricintervals", Params: "<consolidated (default yes)> <series (default no)>", Write: func(r scanengine.Results, req *http.Request, res io.Writer) {
+			r.(*MetricAudit).ReportMetricIntervals(res, scanengine.BoolParm(req, "consolidated", true))
+			r.Engine().WriteSeries(res, scanengine.BoolParm(req, "series", false))
+		}},
+		{Route: "reportmetricdocs", Write: func(r scanengine.Results, req *http.Request, res io.Writer) { r.(*MetricAudit).ReportMetricDocs(res) }},
+	},
+	New: func(f *firehose.Foundation) scanengine.Results { return New(f) },
+	Start: func(r scanengine.Results, req *http.Request, res io.Writer) error {
+		return r.(*MetricAudit).AuditMetrics(req, res)
+	},
+}
 
-	// *change*
-	MetricsMutex.Lock()
+func (a *MetricAudit) ResetData() {
+	a.AuditScan.Reset()
+
+	a.metricsMutex.Lock()
 	{
-		ReadMetricsMap = make(metricMap)
+		a.readMetricsMap = make(metricMap)
 	}
-	MetricsMutex.Unlock()
+	a.metricsMutex.Unlock()
 }
 
-func AuditMetrics(req *http.Request, res io.Writer) {
+func (a *MetricAudit) AuditMetrics(req *http.Request, res io.Writer) error {
+
+	// don't clear the data under a running audit, Start reports that it is already running
+	if a.AuditScan.Running() {
+		return a.AuditScan.Start(req, res)
+	}
+
+	// a bad parameter is reported before the last run's metrics are cleared
+	err := scanengine.CheckParams(req)
+	if until := req.FormValue("until"); err == nil && until != "" {
+		_, err = a.untilCondition(until)
+	}
+	if err != nil {
+		fmt.Fprintf(res, "%s: %v\n", a.AuditScan.Name, err)
+		return err
+	}
 
 	//Unlike the other monitors, this one can't run adding to history because of the time of the last emitted metric
 	//will be from the previous run. So we need to zero it each time
-	ResetData()
+	a.ResetData()
 
-	if err := AuditScan.Start(req, res); err != nil {
-		return
+	if err := a.AuditScan.Start(req, res); err != nil {
+		return err
 	}
 
 	go func() {
-		AuditScan.Run(AuditIterator)
+		a.AuditScan.Run(a.AuditIterator)
 	}()
-
+	return nil
 }
 
-func AuditIterator(msg *events.Envelope) {
+func (a *MetricAudit) AuditIterator(msg *events.Envelope) bool {
 
 	if msg.GetEventType() != events.Envelope_ValueMetric && msg.GetEventType() != events.Envelope_CounterEvent {
-		return
+		return false
 	}
 
-	timeNow := time.Now()
+	timeNow := a.AuditScan.MessageTime()
 	name := ParseMetricName(msg)
 	key := msg.GetIndex() + name
 
 	// When doing the Unlock() as a defer, is there a convention for enclosing the protected code in {}s?
-	MetricsMutex.Lock()
-	defer MetricsMutex.Unlock()
+	a.metricsMutex.Lock()
+	defer a.metricsMutex.Unlock()
 
-	metric, ok := ReadMetricsMap[key]
+	metric, ok := a.readMetricsMap[key]
 
 	if !ok {
 
@@ -98,13 +168,15 @@ func AuditIterator(msg *events.Envelope) {
 			IP:               msg.GetIp(),
 			LastTimeReceived: timeNow,
 			NumberReceived:   1,
+			SourceId:         msg.GetTags()[firehose.SourceIdTag],
+			GaugeValues:      msg.GetTags()[firehose.GaugeValuesTag],
 		}
-		ReadMetricsMap[key] = &tmpMetric
-		return
+		a.readMetricsMap[key] = &tmpMetric
+		return true
 	}
 
 	metric.UpdateTimeGap(timeNow)
-
+	return true
 }
 
 func ParseMetricName(msg *events.Envelope) string {
@@ -122,42 +194,42 @@ func ParseMetricName(msg *events.Envelope) string {
 	}
 }
 
-func NumberOfMetrics() int {
-	MetricsMutex.Lock()
-	mapLen := len(ReadMetricsMap)
-	MetricsMutex.Unlock()
+func (a *MetricAudit) NumberOfMetrics() int {
+	a.metricsMutex.Lock()
+	mapLen := len(a.readMetricsMap)
+	a.metricsMutex.Unlock()
 	return mapLen
 }
 
 /******************************************************************************************/
 
-func ReportMetricIntervals(w io.Writer, consolidatedFlag bool) {
+func (a *MetricAudit) ReportMetricIntervals(w io.Writer, consolidatedFlag bool) {
 	var printMetrics metricMap
 
-	AuditScan.WriteStatus(w)
+	a.AuditScan.WriteStatus(w)
 
-	if NumberOfMetrics() == 0 {
+	if a.NumberOfMetrics() == 0 {
 		fmt.Fprintln(w, "No metric data collected")
 		return
 	}
 
-	MetricsMutex.Lock()
+	a.metricsMutex.Lock()
 	{
 		if consolidatedFlag {
-			printMetrics = ConsolidateMetrics(ReadMetricsMap)
+			printMetrics = ConsolidateMetrics(a.readMetricsMap)
 		} else {
-			printMetrics = ReadMetricsMap
+			printMetrics = copyMetrics(a.readMetricsMap)
 		}
 	}
-	MetricsMutex.Unlock()
+	a.metricsMutex.Unlock()
 
-	PrintMetricTable(printMetrics, w)
+	a.PrintMetricTable(printMetrics, w)
 }
 
 // Job and Index only value in some cases. Print them only if Index is present
-func PrintMetricTable(metricList metricMap, w io.Writer) {
+func (a *MetricAudit) PrintMetricTable(metricList metricMap, w io.Writer) {
 
-	fmt.Fprintf(w, "-Have recorded %d metrics\n", NumberOfMetrics())
+	fmt.Fprintf(w, "-Have recorded %d metrics\n", a.NumberOfMetrics())
 	fmt.Fprintln(w, "_____________________________________________________________________________________________________________")
 	fmt.Fprintln(w, "	          Source      |                 Name                               |   num  | ave | max | min |")
 
@@ -189,6 +261,12 @@ func PrintMetricTable(metricList metricMap, w io.Writer) {
 		if aMetric.Index != "" {
 			fmt.Fprintf(w, "   %s", aMetric.IP)
 		}
+		if aMetric.SourceId != "" && aMetric.SourceId != aMetric.Origin {
+			fmt.Fprintf(w, "   source_id %s", aMetric.SourceId)
+		}
+		if aMetric.GaugeValues != "" {
+			fmt.Fprintf(w, "   gauge %s", aMetric.GaugeValues)
+		}
 
 		fmt.Fprintln(w)
 
@@ -197,6 +275,16 @@ func PrintMetricTable(metricList metricMap, w io.Writer) {
 }
 
 // take each set of name/index and consolidate
+// The scan keeps updating the metrics, so reports print a copy taken under the lock
+func copyMetrics(mapIn metricMap) metricMap {
+	mapOut := make(metricMap)
+	for key, m := range mapIn {
+		metric := *m
+		mapOut[key] = &metric
+	}
+	return mapOut
+}
+
 func ConsolidateMetrics(mapIn metricMap) metricMap {
 
 	mapOut := make(metricMap)
@@ -215,6 +303,8 @@ func ConsolidateMetrics(mapIn metricMap) metricMap {
 				SumOfAllTimes:       theMetric.SumOfAllTimes,
 				ShortestTimeBetween: theMetric.ShortestTimeBetween,
 				LongestTimeBetween:  theMetric.LongestTimeBetween,
+				SourceId:            theMetric.SourceId,
+				GaugeValues:         theMetric.GaugeValues,
 			}
 
 			mapOut[key] = tmpMetric
@@ -271,24 +361,24 @@ func (m *aMetric) UpdateTimeGap(t time.Time) {
 
 /******************************************************************************************/
 
-func ReportMetricDocs(w io.Writer) {
+func (a *MetricAudit) ReportMetricDocs(w io.Writer) {
 
-	AuditScan.WriteStatus(w)
+	a.AuditScan.WriteStatus(w)
 
-	if NumberOfMetrics() == 0 {
+	if a.NumberOfMetrics() == 0 {
 		fmt.Fprintln(w, "No metric data collected")
 		return
 	}
 
-	CSVMetrics, err := ReadCSVMetrics("/app/resources/metrics.list.example.csv")
+	CSVMetrics, err := ReadCSVMetrics(a.DocsFile)
 	if err != nil {
 		fmt.Fprintln(w, err.Error())
 		return
 	}
 
-	MetricsMutex.Lock()
-	metrics := ConsolidateMetrics(ReadMetricsMap)
-	MetricsMutex.Unlock()
+	a.metricsMutex.Lock()
+	metrics := ConsolidateMetrics(a.readMetricsMap)
+	a.metricsMutex.Unlock()
 
 	fmt.Fprintf(w, "\n\n===============> Read: %d metrics from firehose, %d metrics from CSV\n", len(metrics), len(CSVMetrics))
 
@@ -299,6 +389,97 @@ func ReportMetricDocs(w io.Writer) {
 
 }
 
+// until=documented[:N] ends the audit once every documented metric has been seen N times from one
+// instance, 2 by default so each has at least one interval. Documented names with placeholders, such as
+// failed_job_count.<VM_NAME>-<VM_INDEX>, match any metric with something in their place
+func (a *MetricAudit) untilCondition(cond string) (func() bool, error) {
+
+	name, times := cond, 2
+	if i := strings.Index(cond, ":"); i >= 0 {
+		name = cond[:i]
+		n, err := strconv.Atoi(cond[i+1:])
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("until=%s: times must be a positive number", cond)
+		}
+		times = n
+	}
+	if name != "documented" {
+		return nil, fmt.Errorf("until=%s: the metric audit supports until=documented[:<times>]", cond)
+	}
+
+	documented, err := ReadCSVMetrics(a.DocsFile)
+	if err != nil {
+		return nil, fmt.Errorf("until=%s: %v", cond, err)
+	}
+	if len(documented) == 0 {
+		return nil, fmt.Errorf("until=%s: no documented metrics in %s", cond, a.DocsFile)
+	}
+
+	var exact []string
+	patterns := make(map[string][]*regexp.Regexp)
+	for key, m := range documented {
+		if pattern := placeholderPattern(m.Name); pattern != nil {
+			patterns[m.Origin] = append(patterns[m.Origin], pattern)
+			continue
+		}
+		exact = append(exact, key)
+	}
+
+	return func() bool {
+		// the most any one instance has sent of each metric, not the sum of them
+		seen := make(map[string]int)
+		names := make(map[string][]string)
+		a.metricsMutex.Lock()
+		for _, m := range a.readMetricsMap {
+			key := m.Origin + m.Name
+			if _, ok := seen[key]; !ok {
+				names[m.Origin] = append(names[m.Origin], m.Name)
+			}
+			if m.NumberReceived > seen[key] {
+				seen[key] = m.NumberReceived
+			}
+		}
+		a.metricsMutex.Unlock()
+
+		for _, key := range exact {
+			if seen[key] < times {
+				return false
+			}
+		}
+		for origin, list := range patterns {
+			for _, pattern := range list {
+				if !seenMatching(seen, origin, names[origin], pattern, times) {
+					return false
+				}
+			}
+		}
+		return true
+	}, nil
+}
+
+// A documented name with <PLACEHOLDERS> as a pattern, nil for a plain name
+func placeholderPattern(name string) *regexp.Regexp {
+	parts := placeholder.Split(name, -1)
+	if len(parts) == 1 {
+		return nil
+	}
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+	return regexp.MustCompile("^" + strings.Join(parts, ".+") + "$")
+}
+
+var placeholder = regexp.MustCompile(`<[^<>]+>`)
+
+func seenMatching(seen map[string]int, origin string, names []string, pattern *regexp.Regexp, times int) bool {
+	for _, name := range names {
+		if pattern.MatchString(name) && seen[origin+name] >= times {
+			return true
+		}
+	}
+	return false
+}
+
 func ReadCSVMetrics(csvFilename string) (metricMap, error) {
 
 	fileData, err := ioutil.ReadFile(csvFilename)
@@ -401,3 +582,126 @@ func PrintMetrics(w io.Writer, label string, prefix string, metricList metricSli
 	}
 
 }
+
+// The metrics saved across a restart, keyed as they are while scanning
+func (a *MetricAudit) SaveData() ([]byte, error) {
+	a.metricsMutex.Lock()
+	defer a.metricsMutex.Unlock()
+	return json.Marshal(a.readMetricsMap)
+}
+
+func (a *MetricAudit) RestoreData(data []byte) error {
+	metrics := make(metricMap)
+	if err := json.Unmarshal(data, &metrics); err != nil {
+		return err
+	}
+
+	a.metricsMutex.Lock()
+	a.readMetricsMap = metrics
+	a.metricsMutex.Unlock()
+	return nil
+}
+
+/******************************************************************************************/
+// comparing foundations, e.g. a staging upgrade against production
+
+// An average interval further than this from the first foundation's is flagged
+const IntervalTolerance = 0.25
+
+func (a *MetricAudit) Consolidated() metricMap {
+	a.metricsMutex.Lock()
+	defer a.metricsMutex.Unlock()
+	return ConsolidateMetrics(a.readMetricsMap)
+}
+
+// One row per metric, with the count and average interval on each foundation. Metrics missing from a
+// foundation, and intervals that differ from the first foundation's, are marked with '!'
+func ReportMetricComparison(w io.Writer, names []string, audits []*MetricAudit) {
+
+	var maps []metricMap
+	all := make(metricMap)
+
+	for i, a := range audits {
+		fmt.Fprintf(w, "%-12s ", names[i])
+		a.AuditScan.WriteStatus(w)
+
+		m := a.Consolidated()
+		maps = append(maps, m)
+		for key, metric := range m {
+			all[key] = metric
+		}
+	}
+
+	if len(all) == 0 {
+		fmt.Fprintln(w, "No metric data collected")
+		return
+	}
+
+	fmt.Fprintf(w, "%-28s|%-52s|", "Source", "Name")
+	for _, name := range names {
+		fmt.Fprintf(w, "%15.15s |", name)
+	}
+	fmt.Fprintln(w)
+
+	missing := make([]int, len(names))
+	differs := 0
+
+	for _, metric := range sortMetrics(all) {
+		key := metric.Origin + metric.Name
+		flag := " "
+
+		fmt.Fprintf(w, "%-28s|%-52s|", metric.Origin, metric.Name)
+
+		base, baseOk := maps[0][key]
+		for i, m := range maps {
+			theMetric, ok := m[key]
+			if !ok {
+				missing[i]++
+				flag = "!"
+				fmt.Fprintf(w, "%15s |", "--")
+				continue
+			}
+
+			fmt.Fprintf(w, "%7d %s|", theMetric.NumberReceived, averageStr(theMetric))
+
+			if i > 0 && baseOk && intervalDiffers(base, theMetric) {
+				flag = "!"
+			}
+		}
+		if flag == "!" {
+			differs++
+		}
+		fmt.Fprintln(w, flag)
+	}
+
+	fmt.Fprintf(w, "%d metrics, %d differ\n", len(all), differs)
+	for i, name := range names {
+		fmt.Fprintf(w, "%-12s emits %4d, missing %4d\n", name, len(maps[i]), missing[i])
+	}
+}
+
+func averageInterval(m *aMetric) (time.Duration, bool) {
+	if m.NumberReceived < 2 {
+		return 0, false
+	}
+	return m.SumOfAllTimes / time.Duration(m.NumberReceived-1), true
+}
+
+func averageStr(m *aMetric) string {
+	ave, ok := averageInterval(m)
+	if !ok {
+		return "     -- "
+	}
+	return fmt.Sprintf("%7.1f ", ave.Seconds())
+}
+
+func intervalDiffers(base, m *aMetric) bool {
+	baseAve, ok1 := averageInterval(base)
+	ave, ok2 := averageInterval(m)
+	if !ok1 || !ok2 || baseAve == 0 {
+		return false
+	}
+
+	ratio := float64(ave) / float64(baseAve)
+	return ratio > 1+IntervalTolerance || ratio < 1-IntervalTolerance
+}
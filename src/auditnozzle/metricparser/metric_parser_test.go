@@ -0,0 +1,132 @@
+package metricparser
+
+import (
+	"auditnozzle/fakecf"
+	"auditnozzle/firehose"
+	"auditnozzle/scanengine"
+	"auditnozzle/scantest"
+	"bytes"
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A documented metrics file with the lines given, removed by the returned func
+func writeDocs(t *testing.T, docs string) (string, func()) {
+	dir, err := ioutil.TempDir("", "metricparser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "metrics.csv")
+	if err := ioutil.WriteFile(path, []byte(docs), 0600); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+// The metrics seen, and how they compare with the documented ones
+func TestMeasureAndReportMetrics(t *testing.T) {
+	docs, remove := writeDocs(t, "rep,CapacityTotalMemory\nrep,CapacityRemainingMemory\n")
+	defer remove()
+
+	server, f := scantest.StartFakeCF(t, fakecf.Merge(
+		fakecf.ValueMetrics("rep", "cell", "0", "CapacityTotalMemory", 5, 20*time.Millisecond),
+		fakecf.CountersWithGaps("MetronAgent", "metron", "0", "dropsondeMarshaller.sentEnvelopes", nil, 20, 5, nil, 20*time.Millisecond),
+		fakecf.LogMessages(fakecf.DefaultApps[0].Guid, "APP", 5, 20*time.Millisecond),
+	))
+	defer server.Close()
+
+	s := Scanner
+	s.New = func(f *firehose.Foundation) scanengine.Results {
+		a := New(f)
+		a.DocsFile = docs
+		return a
+	}
+
+	run := scantest.Measure(t, s, f, "runtime=30s&count=10")
+	scantest.WaitEnded(t, run)
+
+	// the intervals depend on how the envelopes were paced, only the counts are checked
+	text := scantest.WaitReport(t, s, run, "reportmetricintervals", "", []string{"-Have", "recorded", "2", "metrics"})
+	counts := make(map[string]string)
+	for _, line := range strings.Split(text, "\n") {
+		if fields := strings.Fields(line); len(fields) > 3 {
+			counts[fields[0]+fields[1]] = fields[3]
+		}
+	}
+	for metric, want := range map[string]string{"MetronAgent|dropsondeMarshaller.sentEnvelopes": "5|", "rep|CapacityTotalMemory": "5|"} {
+		if counts[metric] != want {
+			t.Errorf("%s counted %q, want %q:\n%s", metric, counts[metric], want, text)
+		}
+	}
+	scantest.WaitReport(t, s, run, "reportmetricdocs", "",
+		[]string{"===============>", "Read:", "2", "metrics", "from", "firehose,", "2", "metrics", "from", "CSV"},
+		[]string{"===============>", "1", "Documented", "Firehose", "Metrics:"},
+		[]string{"<", "rep", "|", "CapacityTotalMemory"},
+		[]string{"===============>", "1", "Undocumented", "Firehose", "Metrics:"},
+		[]string{">", "MetronAgent", "|", "dropsondeMarshaller.sentEnvelopes"},
+		[]string{"===============>", "1", "Unemitted", "Documented", "Metrics:"},
+		[]string{"*", "rep", "|", "CapacityRemainingMemory"},
+	)
+}
+
+func TestUntilDocumented(t *testing.T) {
+	docs, remove := writeDocs(t, "cc,requests.completed\ncc,failed_job_count.<VM_NAME>-<VM_INDEX>\n")
+	defer remove()
+
+	a := New(nil)
+	a.DocsFile = docs
+	until, err := a.untilCondition("documented")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	send := func(name, index string) {
+		a.AuditIterator(&events.Envelope{
+			Origin:      proto.String("cc"),
+			EventType:   events.Envelope_ValueMetric.Enum(),
+			Index:       proto.String(index),
+			ValueMetric: &events.ValueMetric{Name: proto.String(name), Value: proto.Float64(1), Unit: proto.String("count")},
+		})
+	}
+
+	send("requests.completed", "0")
+	send("requests.completed", "1")
+	send("failed_job_count.cc-worker-0", "0")
+	send("failed_job_count.cc-worker-0", "0")
+	if until() {
+		t.Error("met with requests.completed seen once by each of two instances")
+	}
+
+	send("requests.completed", "1")
+	if !until() {
+		t.Error("not met with every documented metric seen twice by one instance")
+	}
+}
+
+// A bad parameter leaves the last run's metrics as they were
+func TestAuditBadParamKeepsMetrics(t *testing.T) {
+	a := New(nil)
+	a.AuditIterator(&events.Envelope{
+		Origin:      proto.String("rep"),
+		EventType:   events.Envelope_ValueMetric.Enum(),
+		ValueMetric: &events.ValueMetric{Name: proto.String("CapacityTotalMemory"), Value: proto.Float64(1), Unit: proto.String("MB")},
+	})
+
+	for _, query := range []string{"runtime=10", "until=everything"} {
+		var out bytes.Buffer
+		if err := a.AuditMetrics(httptest.NewRequest("GET", "/measuremetrics?"+query, nil), &out); err == nil {
+			t.Errorf("started with %s", query)
+		}
+		if n := a.NumberOfMetrics(); n != 1 {
+			t.Errorf("%d metrics after %s, want the 1 seen before", n, query)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package scanengine
+
+import (
+	"auditnozzle/helpers"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/********************************************************************************************************
+* Every time a run's scan ends its reports are written out and kept as a snapshot, so the results of a
+* nightly scan can still be read after the run has been reset, continued, deleted or expired. The last
+* HISTORY_SIZE (default 20) snapshots are kept.
+*
+* /runs lists the snapshots after the runs, and /runs/<id>/report shows one. A run that was continued has a
+* snapshot for each scan: logs-3, logs-3.2 and so on
+ */
+
+type Snapshot struct {
+	ID         string
+	RunID      string
+	Scanner    string
+	Foundation string
+	Params     url.Values
+	Start      time.Time
+	End        time.Time
+	StopReason string
+	Reports    []SnapshotReport
+}
+
+type SnapshotReport struct {
+	Route string
+	Text  string
+}
+
+var (
+	history      []*Snapshot
+	historyMutex sync.Mutex
+
+	HistorySize = HistorySizeFromEnv()
+)
+
+func HistorySizeFromEnv() int {
+	size, err := strconv.Atoi(os.Getenv("HISTORY_SIZE"))
+	if err != nil || size < 1 {
+		size = 20
+	}
+	return size
+}
+
+/******************************************************************************************/
+
+// Called at the end of each of the run's scans
+func (r *Run) recordSnapshot() {
+
+	engine := r.Results.Engine()
+	scanner, ok := LookupScanner(r.Scanner)
+	if !ok {
+		return
+	}
+
+	snapshot := &Snapshot{
+		RunID:      r.ID,
+		Scanner:    r.Scanner,
+		Foundation: r.Foundation.Name,
+		Params:     copyParams(r.Params),
+		Start:      engine.Started(),
+		End:        engine.Ended(),
+		StopReason: engine.StopReason(),
+	}
+
+	// the reports as they would be shown with their default parameters
+	req, _ := http.NewRequest("GET", "/", nil)
+	for _, report := range scanner.Reports {
+		var text bytes.Buffer
+		report.Write(r.Results, req, &text)
+		snapshot.Reports = append(snapshot.Reports, SnapshotReport{report.Route, text.String()})
+	}
+
+	AddSnapshot(snapshot)
+}
+
+// Numbers the snapshot after the run's earlier ones, and drops the oldest beyond HistorySize
+func AddSnapshot(snapshot *Snapshot) {
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+
+	if snapshot.ID == "" {
+		n := 1
+		for _, h := range history {
+			if h.RunID == snapshot.RunID {
+				n++
+			}
+		}
+		snapshot.ID = snapshot.RunID
+		if n > 1 {
+			snapshot.ID = fmt.Sprintf("%s.%d", snapshot.RunID, n)
+		}
+	}
+
+	history = append(history, snapshot)
+	if len(history) > HistorySize {
+		history = history[len(history)-HistorySize:]
+	}
+}
+
+// Oldest first
+func History() []*Snapshot {
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+
+	list := make([]*Snapshot, len(history))
+	copy(list, history)
+	return list
+}
+
+func LookupSnapshot(id string) (*Snapshot, bool) {
+	for _, h := range History() {
+		if h.ID == id {
+			return h, true
+		}
+	}
+	return nil, false
+}
+
+func WriteHistory(ow io.Writer, list []*Snapshot) {
+	if len(list) == 0 {
+		fmt.Fprintln(ow, "No finished runs")
+		return
+	}
+
+	for _, h := range list {
+		fmt.Fprintf(ow, "%-14s %-12s %s %s %-16s %s\n", h.ID, h.Foundation, h.Start.Format(time.RFC3339), helpers.TimeStr(h.End.Sub(h.Start)), h.StopReason, paramsStr(h.Params))
+	}
+}
+
+// report=<route> for one of the scanner's reports, all of them without it
+func (h *Snapshot) WriteReport(ow io.Writer, route string) {
+	fmt.Fprintf(ow, "%s %s on %s, %s to %s, %s %s\n", h.ID, h.Scanner, h.Foundation, h.Start.Format(time.RFC3339), h.End.Format(time.RFC3339), h.StopReason, paramsStr(h.Params))
+
+	found := false
+	for _, r := range h.Reports {
+		if route != "" && route != r.Route {
+			continue
+		}
+		found = true
+		fmt.Fprintf(ow, "\n===============> %s\n", r.Route)
+		io.WriteString(ow, r.Text)
+	}
+	if !found {
+		fmt.Fprintf(ow, "no %s report in %s\n", route, h.ID)
+	}
+}
+
+/******************************************************************************************/
+
+// /runs/<id>/report: a snapshot, or the current results of a run
+func runReportResponse(res http.ResponseWriter, req *http.Request) {
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, "/runs/"), "/"), "/")
+	if len(parts) != 2 || parts[1] != "report" {
+		http.NotFound(res, req)
+		return
+	}
+	id, route := parts[0], req.FormValue("report")
+
+	if h, ok := LookupSnapshot(id); ok {
+		h.WriteReport(res, route)
+		return
+	}
+
+	run, err := LookupRun(id)
+	if err != nil {
+		fmt.Fprintln(res, err)
+		return
+	}
+	scanner, _ := LookupScanner(run.Scanner)
+	for _, r := range scanner.Reports {
+		if route == "" || route == r.Route {
+			r.Write(run.Results, req, res)
+		}
+	}
+}
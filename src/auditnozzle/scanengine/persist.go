@@ -0,0 +1,229 @@
+package scanengine
+
+import (
+	"auditnozzle/firehose"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+/********************************************************************************************************
+* The runs and the run history are saved to a file every SAVE_INTERVAL (default 5m) and when the app is
+* stopped, and read back at startup, so a restart or restage doesn't lose the results of a long scan.
+*
+* The file is auditnozzle-state.json in STATE_DIR, or on the first volume service bound to the app, or in the
+* temp dir. The temp dir survives a restart of the process but not a restage. A scan that was running when
+* the state was saved can't carry on, it is restored as finished and marked partial
+ */
+
+const stateFile = "auditnozzle-state.json"
+
+// the periodic save and the one when the app stops write the same temp file, so they take turns. The
+// whole save is held, so an older state can't be written over a newer one
+var saveMutex sync.Mutex
+
+// Results that can be saved, as JSON
+type Saver interface {
+	SaveData() ([]byte, error)
+	RestoreData(data []byte) error
+}
+
+type savedRun struct {
+	ID         string
+	Scanner    string
+	Foundation string
+	Params     url.Values
+	Created    time.Time
+	Seq        int
+	Engine     EngineState
+	Data       json.RawMessage `json:",omitempty"`
+}
+
+type savedState struct {
+	Saved   time.Time
+	RunSeq  int
+	Runs    []savedRun
+	History []*Snapshot
+}
+
+/******************************************************************************************/
+
+func StatePath() string {
+	if dir := os.Getenv("STATE_DIR"); dir != "" {
+		return filepath.Join(dir, stateFile)
+	}
+	if dir := volumeMount(); dir != "" {
+		return filepath.Join(dir, stateFile)
+	}
+	return filepath.Join(os.TempDir(), stateFile)
+}
+
+// The first writable volume mount in VCAP_SERVICES
+func volumeMount() string {
+	var services map[string][]struct {
+		VolumeMounts []struct {
+			ContainerDir string `json:"container_dir"`
+			Mode         string `json:"mode"`
+		} `json:"volume_mounts"`
+	}
+
+	if err := json.Unmarshal([]byte(os.Getenv("VCAP_SERVICES")), &services); err != nil {
+		return ""
+	}
+	for _, instances := range services {
+		for _, instance := range instances {
+			for _, mount := range instance.VolumeMounts {
+				if mount.Mode == "rw" && mount.ContainerDir != "" {
+					return mount.ContainerDir
+				}
+			}
+		}
+	}
+	return ""
+}
+
+func SaveIntervalFromEnv() time.Duration {
+	interval, err := time.ParseDuration(os.Getenv("SAVE_INTERVAL"))
+	if err != nil || interval <= 0 {
+		interval = 5 * time.Minute
+	}
+	return interval
+}
+
+/******************************************************************************************/
+
+// Written to a temp file and renamed, so a crash part way through leaves the last save in place
+func SaveState(path string) error {
+
+	saveMutex.Lock()
+	defer saveMutex.Unlock()
+
+	state := savedState{Saved: time.Now(), History: History()}
+
+	for _, run := range Runs() {
+		saved := savedRun{
+			ID:         run.ID,
+			Scanner:    run.Scanner,
+			Foundation: run.Foundation.Name,
+			Params:     run.Params,
+			Created:    run.Created,
+			Seq:        run.seq,
+			Engine:     run.Results.Engine().SaveState(),
+		}
+		if saver, ok := run.Results.(Saver); ok {
+			data, err := saver.SaveData()
+			if err != nil {
+				return fmt.Errorf("saving %s: %v", run.ID, err)
+			}
+			saved.Data = data
+		}
+		state.Runs = append(state.Runs, saved)
+	}
+
+	runsMutex.Lock()
+	state.RunSeq = runSeq
+	runsMutex.Unlock()
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Called at startup, after the scanners are registered. A missing file is not an error
+func RestoreState(path string) error {
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var state savedState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+
+	restored := 0
+	for _, saved := range state.Runs {
+		run, err := restoreRun(saved)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Not restoring run %s: %v\n", saved.ID, err)
+			continue
+		}
+
+		runsMutex.Lock()
+		runs[run.ID] = run
+		runsMutex.Unlock()
+		restored++
+	}
+
+	runsMutex.Lock()
+	if state.RunSeq > runSeq {
+		runSeq = state.RunSeq
+	}
+	runsMutex.Unlock()
+
+	historyMutex.Lock()
+	history = append(state.History, history...)
+	if len(history) > HistorySize {
+		history = history[len(history)-HistorySize:]
+	}
+	historyMutex.Unlock()
+
+	fmt.Fprintf(os.Stdout, "Restored %d runs and %d finished runs from %s, saved %s\n", restored, len(state.History), path, state.Saved.Format(time.RFC3339))
+	return nil
+}
+
+func restoreRun(saved savedRun) (*Run, error) {
+
+	scanner, ok := LookupScanner(saved.Scanner)
+	if !ok {
+		return nil, fmt.Errorf("no %s scanner", saved.Scanner)
+	}
+	f, err := firehose.LookupFoundation(saved.Foundation)
+	if err != nil {
+		return nil, err
+	}
+
+	run := &Run{
+		ID:         saved.ID,
+		Scanner:    saved.Scanner,
+		Foundation: f,
+		Params:     saved.Params,
+		Created:    saved.Created,
+		Results:    scanner.New(f),
+		seq:        saved.Seq,
+	}
+
+	if saver, ok := run.Results.(Saver); ok && len(saved.Data) > 0 {
+		if err := saver.RestoreData(saved.Data); err != nil {
+			return nil, err
+		}
+	}
+	run.Results.Engine().RestoreState(saved.Engine)
+	run.Results.Engine().SetOnStop(run.recordSnapshot)
+	return run, nil
+}
+
+// Saves every interval until the app stops
+func SaveEvery(path string, interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := SaveState(path); err != nil {
+			fmt.Fprintf(os.Stderr, "Saving state to %s: %v\n", path, err)
+		}
+	}
+}
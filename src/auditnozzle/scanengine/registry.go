@@ -0,0 +1,247 @@
+package scanengine
+
+import (
+	"auditnozzle/firehose"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/********************************************************************************************************
+* Each scanner package describes itself with a Scanner: its name, the route that starts it, its reports and
+* their parameters. main registers them, and the http routes, the usage page, /status, /stop and /reset are
+* all built from the registry, so adding a scanner doesn't mean editing each of those by hand
+ */
+
+type Scanner struct {
+	Name    string // scanner=<name> for /stop
+	Measure string // the route that starts a scan
+	Params  string // the measure route's own parameters, for the usage page
+	Reports []Report
+
+	// New makes the empty results of a run, Start starts a scan adding to them
+	New   func(f *firehose.Foundation) Results
+	Start func(r Results, req *http.Request, res io.Writer) error
+}
+
+type Report struct {
+	Route  string
+	Params string
+	Write  func(r Results, req *http.Request, res io.Writer)
+}
+
+var (
+	registry      []Scanner
+	registryMutex sync.RWMutex
+)
+
+/******************************************************************************************/
+
+// Scanners are listed on the usage page in the order they were registered
+func Register(s Scanner) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	for _, r := range registry {
+		if r.Name == s.Name {
+			panic("scanner " + s.Name + " registered twice")
+		}
+	}
+	registry = append(registry, s)
+}
+
+func Scanners() []Scanner {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+
+	list := make([]Scanner, len(registry))
+	copy(list, registry)
+	return list
+}
+
+func LookupScanner(name string) (Scanner, bool) {
+	for _, s := range Scanners() {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return Scanner{}, false
+}
+
+func ScannerNames() []string {
+	var names []string
+	for _, s := range Scanners() {
+		names = append(names, s.Name)
+	}
+	return names
+}
+
+func ScannerList() string {
+	return strings.Join(ScannerNames(), "|")
+}
+
+// The measure and report routes of every scanner, and the routes for the runs
+func HandleScanners(mux *http.ServeMux) {
+	for _, s := range Scanners() {
+		mux.HandleFunc("/"+s.Measure, measureHandler(s))
+		for _, r := range s.Reports {
+			mux.HandleFunc("/"+r.Route, reportHandler(s, r))
+		}
+	}
+	mux.HandleFunc("/runs", runsResponse)
+	mux.HandleFunc("/runs/", runReportResponse)
+	mux.HandleFunc("/deleterun", deleteRunResponse)
+}
+
+// run=<id> continues a run, otherwise foundation= (or the default) gets a new one
+func measureHandler(s Scanner) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if id := req.FormValue("run"); id != "" {
+			ContinueRun(s, id, req, res)
+			return
+		}
+
+		f, err := firehose.FoundationFromRequest(req)
+		if err != nil {
+			fmt.Fprintln(res, err)
+			return
+		}
+		NewRun(s, f, req, res)
+	}
+}
+
+func reportHandler(s Scanner, r Report) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		results, err := RequestedResults(s, req)
+		if err != nil {
+			fmt.Fprintln(res, err)
+			return
+		}
+		r.Write(results, req, res)
+	}
+}
+
+// The runs, then the snapshots of finished scans. foundation=<name> limits both to one foundation
+func runsResponse(res http.ResponseWriter, req *http.Request) {
+	runs, history := Runs(), History()
+
+	if req.FormValue("foundation") != "" {
+		f, err := firehose.FoundationFromRequest(req)
+		if err != nil {
+			fmt.Fprintln(res, err)
+			return
+		}
+		runs = FoundationRuns(f)
+
+		var kept []*Snapshot
+		for _, h := range history {
+			if h.Foundation == f.Name {
+				kept = append(kept, h)
+			}
+		}
+		history = kept
+	}
+
+	WriteRuns(res, runs)
+	fmt.Fprintln(res, "\nFinished:")
+	WriteHistory(res, history)
+}
+
+func deleteRunResponse(res http.ResponseWriter, req *http.Request) {
+	id := req.FormValue("run")
+	if id == "" {
+		fmt.Fprintln(res, errNoRun)
+		return
+	}
+	if err := DeleteRun(id); err != nil {
+		fmt.Fprintln(res, err)
+		return
+	}
+	fmt.Fprintf(res, "run %s deleted\n", id)
+}
+
+// The usage page lines for every scanner
+func WriteUsage(ow io.Writer) {
+	for _, s := range Scanners() {
+		writeOperation(ow, s.Measure, s.Params)
+		for _, r := range s.Reports {
+			writeOperation(ow, r.Route, r.Params)
+		}
+	}
+	writeOperation(ow, "runs", "<foundation (default all)>")
+	writeOperation(ow, "runs/<id>/report", "<report (default all)>")
+	writeOperation(ow, "deleterun", "run=<id>")
+}
+
+func writeOperation(ow io.Writer, route, params string) {
+	if params == "" {
+		fmt.Fprintf(ow, " %s\n", route)
+		return
+	}
+	fmt.Fprintf(ow, " %s %s\n", route, params)
+}
+
+/******************************************************************************************/
+// status, stop and reset cover every run of a foundation, or the one given with run=
+
+func SelectRuns(f *firehose.Foundation, id string) ([]*Run, error) {
+	if id == "" {
+		return FoundationRuns(f), nil
+	}
+	run, err := LookupRun(id)
+	if err != nil {
+		return nil, err
+	}
+	return []*Run{run}, nil
+}
+
+func WriteRunStatus(ow io.Writer, list []*Run) {
+	for _, run := range list {
+		fmt.Fprintf(ow, "%-14s ", run.ID)
+		run.Results.Engine().WriteStatus(ow)
+	}
+}
+
+func ResetRuns(list []*Run) {
+	for _, run := range list {
+		run.Results.ResetData()
+	}
+}
+
+// scanner=<name> or all. Returns false if the name isn't a registered scanner
+func StopRuns(ow io.Writer, list []*Run, name string) bool {
+	if _, ok := LookupScanner(name); !ok && name != "all" {
+		return false
+	}
+
+	stopped := 0
+	for _, run := range list {
+		if name != "all" && name != run.Scanner {
+			continue
+		}
+		if run.Results.Engine().Cancel() {
+			fmt.Fprintf(ow, "%s: run %s stopped\n", run.Foundation.Name, run.ID)
+			stopped++
+		}
+	}
+
+	if stopped == 0 {
+		fmt.Fprintf(ow, "no %s runs running\n", name)
+	}
+	return true
+}
+
+/******************************************************************************************/
+// parameters shared by the reports
+
+// <name>=true|false, def when it's missing or not a bool
+func BoolParm(req *http.Request, name string, def bool) bool {
+	value, err := strconv.ParseBool(req.FormValue(name))
+	if err != nil {
+		return def
+	}
+	return value
+}
@@ -0,0 +1,265 @@
+package scanengine
+
+import (
+	"auditnozzle/firehose"
+	"auditnozzle/helpers"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+/********************************************************************************************************
+* Every measure starts a run with its own results and parameters, so several people can scan at once without
+* getting "already running" or adding to each other's counts. measure<x>?run=<id> continues an existing
+* run instead, adding to its results as a second measure used to. Reports take run=<id>, and without it
+* report the foundation's latest run of that scanner.
+*
+* Finished runs are dropped RUN_EXPIRY (default 24h) after they end, or with /deleterun?run=<id>
+ */
+
+// What a scanner keeps for one run
+type Results interface {
+	Engine() *ScanEngine
+	ResetData()
+}
+
+type Run struct {
+	ID         string
+	Scanner    string
+	Foundation *firehose.Foundation
+	Params     url.Values
+	Created    time.Time
+	Results    Results
+
+	seq int
+}
+
+var (
+	runs      = make(map[string]*Run)
+	runSeq    int
+	runsMutex sync.Mutex
+
+	RunExpiry = RunExpiryFromEnv()
+)
+
+func RunExpiryFromEnv() time.Duration {
+	expiry, err := time.ParseDuration(os.Getenv("RUN_EXPIRY"))
+	if err != nil || expiry <= 0 {
+		expiry = 24 * time.Hour
+	}
+	return expiry
+}
+
+/******************************************************************************************/
+
+// Starts a new run of the scanner. The run is only kept if the scan started, Start writes why it didn't.
+// It is listed before it starts, so a scan that ends straight away is still found by its id
+func NewRun(s Scanner, f *firehose.Foundation, req *http.Request, res io.Writer) (*Run, error) {
+
+	req.ParseForm()
+
+	runsMutex.Lock()
+	runSeq++
+	run := &Run{
+		ID:         fmt.Sprintf("%s-%d", s.Name, runSeq),
+		Scanner:    s.Name,
+		Foundation: f,
+		Params:     copyParams(req.Form),
+		Created:    time.Now(),
+		Results:    s.New(f),
+		seq:        runSeq,
+	}
+	runs[run.ID] = run
+	runsMutex.Unlock()
+	run.Results.Engine().SetOnStop(run.recordSnapshot)
+
+	if err := s.Start(run.Results, req, res); err != nil {
+		runsMutex.Lock()
+		delete(runs, run.ID)
+		runsMutex.Unlock()
+		return nil, err
+	}
+
+	fmt.Fprintf(res, "run %s\n", run.ID)
+	return run, nil
+}
+
+// measure<x>?run=<id> adds another scan to a run that has finished. Errors are written to res
+func ContinueRun(s Scanner, id string, req *http.Request, res io.Writer) (*Run, error) {
+
+	run, err := LookupRun(id)
+	if err == nil && run.Scanner != s.Name {
+		err = fmt.Errorf("run %s is a %s run, not %s", id, run.Scanner, s.Name)
+	}
+	if err != nil {
+		fmt.Fprintln(res, err)
+		return nil, err
+	}
+
+	// Start writes why it couldn't start
+	if err := s.Start(run.Results, req, res); err != nil {
+		return nil, err
+	}
+
+	fmt.Fprintf(res, "run %s\n", run.ID)
+	return run, nil
+}
+
+func LookupRun(id string) (*Run, error) {
+	runsMutex.Lock()
+	defer runsMutex.Unlock()
+
+	run, ok := runs[id]
+	if !ok {
+		return nil, fmt.Errorf("no run %s, see /runs", id)
+	}
+	return run, nil
+}
+
+// The foundation's most recent run of the scanner, nil if there hasn't been one
+func LatestRun(scanner string, f *firehose.Foundation) *Run {
+	var latest *Run
+
+	for _, run := range Runs() {
+		if run.Scanner == scanner && run.Foundation == f {
+			latest = run
+		}
+	}
+	return latest
+}
+
+// The runs oldest first. Expired runs are dropped first
+func Runs() []*Run {
+	ExpireRuns()
+
+	runsMutex.Lock()
+	defer runsMutex.Unlock()
+
+	var list []*Run
+	for _, run := range runs {
+		list = append(list, run)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].seq < list[j].seq })
+	return list
+}
+
+func FoundationRuns(f *firehose.Foundation) []*Run {
+	var list []*Run
+	for _, run := range Runs() {
+		if run.Foundation == f {
+			list = append(list, run)
+		}
+	}
+	return list
+}
+
+// Stops the run if it is still scanning
+func DeleteRun(id string) error {
+
+	run, err := LookupRun(id)
+	if err != nil {
+		return err
+	}
+	run.Results.Engine().Cancel()
+
+	runsMutex.Lock()
+	delete(runs, id)
+	runsMutex.Unlock()
+	return nil
+}
+
+func ExpireRuns() {
+	runsMutex.Lock()
+	defer runsMutex.Unlock()
+
+	for id, run := range runs {
+		if run.expired() {
+			fmt.Fprintf(os.Stdout, "Run %s expired\n", id)
+			delete(runs, id)
+		}
+	}
+}
+
+func (r *Run) expired() bool {
+	engine := r.Results.Engine()
+	if engine.Running() {
+		return false
+	}
+
+	ended := engine.Ended()
+	if ended.IsZero() {
+		ended = r.Created
+	}
+	return time.Since(ended) > RunExpiry
+}
+
+/******************************************************************************************/
+
+// run=<id>, or the foundation's latest run of the scanner. Without a run the results are empty, so the
+// report says no data was collected
+func RequestedResults(s Scanner, req *http.Request) (Results, error) {
+
+	if id := req.FormValue("run"); id != "" {
+		run, err := LookupRun(id)
+		if err != nil {
+			return nil, err
+		}
+		if run.Scanner != s.Name {
+			return nil, fmt.Errorf("run %s is a %s run, not %s", id, run.Scanner, s.Name)
+		}
+		return run.Results, nil
+	}
+
+	f, err := firehose.FoundationFromRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	if run := LatestRun(s.Name, f); run != nil {
+		return run.Results, nil
+	}
+	return s.New(f), nil
+}
+
+func WriteRuns(ow io.Writer, list []*Run) {
+	if len(list) == 0 {
+		fmt.Fprintln(ow, "No runs")
+		return
+	}
+
+	for _, run := range list {
+		engine := run.Results.Engine()
+
+		state := "finished"
+		if engine.Running() {
+			state = "running"
+		} else if reason := engine.StopReason(); reason != "" {
+			state = reason
+		}
+
+		fmt.Fprintf(ow, "%-14s %-12s %s %s %-16s %s\n", run.ID, run.Foundation.Name, run.Created.Format(time.RFC3339), helpers.TimeStr(engine.Runtime()), state, paramsStr(run.Params))
+	}
+}
+
+var errNoRun = errors.New("run= is required")
+
+// the parameters that say what the run measured, not which run or foundation it is
+func paramsStr(params url.Values) string {
+	shown := copyParams(params)
+	shown.Del("run")
+	shown.Del("foundation")
+	return shown.Encode()
+}
+
+func copyParams(params url.Values) url.Values {
+	c := make(url.Values)
+	for k, v := range params {
+		c[k] = append([]string(nil), v...)
+	}
+	return c
+}
@@ -0,0 +1,230 @@
+package scanengine_test
+
+import (
+	"auditnozzle/firehose"
+	"auditnozzle/scanengine"
+	"errors"
+	"fmt"
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A scanner counting envelopes by type, with nothing of its own to get in the way of the engine's
+type typeCounts struct {
+	scan   scanengine.ScanEngine
+	mutex  sync.Mutex
+	counts map[events.Envelope_EventType]int
+}
+
+func (c *typeCounts) Engine() *scanengine.ScanEngine {
+	return &c.scan
+}
+
+func (c *typeCounts) ResetData() {
+	c.scan.Reset()
+
+	c.mutex.Lock()
+	c.counts = make(map[events.Envelope_EventType]int)
+	c.mutex.Unlock()
+}
+
+func (c *typeCounts) total() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	total := 0
+	for _, n := range c.counts {
+		total += n
+	}
+	return total
+}
+
+var typeScanner = scanengine.Scanner{
+	Name:    "types",
+	Measure: "measuretypes",
+	Reports: []scanengine.Report{
+		{Route: "reporttypes", Write: func(r scanengine.Results, req *http.Request, res io.Writer) {
+			c := r.(*typeCounts)
+			c.scan.WriteStatus(res)
+			c.mutex.Lock()
+			fmt.Fprintln(res, c.counts)
+			c.mutex.Unlock()
+		}},
+	},
+	New: func(f *firehose.Foundation) scanengine.Results {
+		return &typeCounts{scan: scanengine.ScanEngine{Name: "Types", Foundation: f}, counts: make(map[events.Envelope_EventType]int)}
+	},
+	Start: func(r scanengine.Results, req *http.Request, res io.Writer) error {
+		c := r.(*typeCounts)
+		if err := c.scan.Start(req, res); err != nil {
+			return err
+		}
+		go c.scan.Run(func(msg *events.Envelope) bool {
+			c.mutex.Lock()
+			c.counts[msg.GetEventType()]++
+			c.mutex.Unlock()
+			return true
+		})
+		return nil
+	},
+}
+
+// A capture of n log messages, every apart
+func writeCapture(t *testing.T, name string, n int, every time.Duration) {
+	w, err := firehose.CreateCapture(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		at := start.Add(time.Duration(i) * every)
+		err := w.Write(&events.Envelope{
+			Origin:    proto.String("test"),
+			EventType: events.Envelope_LogMessage.Enum(),
+			Timestamp: proto.Int64(at.UnixNano()),
+			LogMessage: &events.LogMessage{
+				Message:     []byte(fmt.Sprintf("log %d", i)),
+				MessageType: events.LogMessage_OUT.Enum(),
+				Timestamp:   proto.Int64(at.UnixNano()),
+			},
+		}, at)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func waitEnded(t *testing.T, run *scanengine.Run) {
+	t.Helper()
+
+	for deadline := time.Now().Add(10 * time.Second); run.Results.Engine().Running(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("run %s still running", run.ID)
+		}
+	}
+}
+
+// For a second, go routines keep starting runs, writing their reports, asking for their status and resetting
+// them, as people sharing the nozzle would, for go test -race to watch. Then every run is stopped and has to end
+func TestConcurrentRuns(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scanengine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv("CAPTURE_DIR", dir)
+	defer os.Unsetenv("CAPTURE_DIR")
+
+	writeCapture(t, "replay.pb", 2000, time.Millisecond)
+
+	f := &firehose.Foundation{Name: "replay"}
+	firehose.SetFoundations(f.Name, f)
+
+	var (
+		wg    sync.WaitGroup
+		mutex sync.Mutex
+		list  []*scanengine.Run
+	)
+	done := make(chan struct{})
+	time.AfterFunc(time.Second, func() { close(done) })
+
+	started := func() []*scanengine.Run {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]*scanengine.Run(nil), list...)
+	}
+
+	// keeps going until the second is up, a little apart so each run gets some envelopes
+	every := func(interval time.Duration, do func()) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				do()
+				select {
+				case <-done:
+					return
+				case <-time.After(interval):
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 3; i++ {
+		every(200*time.Millisecond, func() {
+			run, err := scanengine.NewRun(typeScanner, f, httptest.NewRequest("GET", "/measuretypes?replay=replay.pb", nil), ioutil.Discard)
+			if err == nil {
+				mutex.Lock()
+				list = append(list, run)
+				mutex.Unlock()
+			}
+		})
+	}
+
+	every(5*time.Millisecond, func() {
+		for _, run := range started() {
+			typeScanner.Reports[0].Write(run.Results, httptest.NewRequest("GET", "/reporttypes", nil), ioutil.Discard)
+		}
+	})
+
+	every(5*time.Millisecond, func() {
+		for _, run := range started() {
+			run.Results.Engine().WriteStatus(ioutil.Discard)
+		}
+		scanengine.WriteRunStatus(ioutil.Discard, scanengine.FoundationRuns(f))
+		scanengine.WriteRuns(ioutil.Discard, scanengine.Runs())
+	})
+
+	every(300*time.Millisecond, func() {
+		if list := started(); len(list) > 0 {
+			list[len(list)-1].Results.ResetData()
+		}
+	})
+
+	wg.Wait()
+
+	counted := 0
+	for _, run := range started() {
+		run.Results.Engine().Cancel()
+		waitEnded(t, run)
+		counted += run.Results.(*typeCounts).total()
+	}
+	if len(started()) == 0 || counted == 0 {
+		t.Errorf("%d runs counted %d envelopes, want some of each", len(started()), counted)
+	}
+}
+
+// The run is listed by the time its scan starts, so stopping the foundation's runs can't miss it, and is
+// dropped again if it doesn't start
+func TestRunListedWhileStarting(t *testing.T) {
+	f := &firehose.Foundation{Name: "listed"}
+	firehose.SetFoundations(f.Name, f)
+
+	var listed []*scanengine.Run
+	s := typeScanner
+	s.Start = func(r scanengine.Results, req *http.Request, res io.Writer) error {
+		listed = scanengine.FoundationRuns(f)
+		return errors.New("not starting")
+	}
+
+	if _, err := scanengine.NewRun(s, f, httptest.NewRequest("GET", "/measuretypes", nil), ioutil.Discard); err == nil {
+		t.Fatal("run started")
+	}
+	if len(listed) != 1 {
+		t.Errorf("%d runs listed while starting, want 1", len(listed))
+	}
+	if runs := scanengine.FoundationRuns(f); len(runs) != 0 {
+		t.Errorf("run %s kept after it didn't start", runs[0].ID)
+	}
+}
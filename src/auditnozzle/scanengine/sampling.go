@@ -0,0 +1,211 @@
+package scanengine
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/********************************************************************************************************
+* Sampling for foundations with more envelopes than a scanner's iterator can keep up with. The engine still
+* reads every envelope, but only passes a sample of them to the iterator:
+*
+*   sample=1in<N>              every N'th envelope
+*   sample=random:<fraction>   each envelope with that probability, e.g. random:0.05
+*   sample=slice:<on>/<period> every envelope in the first <on> of each <period>, e.g. slice:1s/10s
+*
+* Reports scale counts back up by the fraction actually kept and show them as estimates with a 95%
+* confidence interval. A scanner decides which envelopes can be sampled, see ScanEngine.Sampleable; the
+* rest, such as counters that carry totals, always go to the iterator
+ */
+
+type Sampling struct {
+	Mode     string // "1in", "random" or "slice", empty for none
+	N        uint64
+	Fraction float64
+	On       time.Duration
+	Period   time.Duration
+}
+
+func GetSampling(req *http.Request) (Sampling, error) {
+	parm := req.FormValue("sample")
+	if parm == "" {
+		return Sampling{}, nil
+	}
+
+	bad := fmt.Errorf("sample=%s must be 1in<N>, random:<fraction> or slice:<on>/<period>", parm)
+
+	switch {
+	case strings.HasPrefix(parm, "1in"):
+		n, err := strconv.ParseUint(parm[len("1in"):], 10, 64)
+		if err != nil || n < 2 {
+			return Sampling{}, bad
+		}
+		return Sampling{Mode: "1in", N: n}, nil
+
+	case strings.HasPrefix(parm, "random:"):
+		fraction, err := strconv.ParseFloat(parm[len("random:"):], 64)
+		if err != nil || fraction <= 0 || fraction >= 1 {
+			return Sampling{}, bad
+		}
+		return Sampling{Mode: "random", Fraction: fraction}, nil
+
+	case strings.HasPrefix(parm, "slice:"):
+		times := strings.SplitN(parm[len("slice:"):], "/", 2)
+		if len(times) != 2 {
+			return Sampling{}, bad
+		}
+		on, err1 := time.ParseDuration(times[0])
+		period, err2 := time.ParseDuration(times[1])
+		if err1 != nil || err2 != nil || on <= 0 || period <= on {
+			return Sampling{}, bad
+		}
+		return Sampling{Mode: "slice", On: on, Period: period}, nil
+	}
+	return Sampling{}, bad
+}
+
+func (s Sampling) String() string {
+	switch s.Mode {
+	case "1in":
+		return fmt.Sprintf("1 in %d", s.N)
+	case "random":
+		return fmt.Sprintf("random %g", s.Fraction)
+	case "slice":
+		return fmt.Sprintf("%s of every %s", s.On, s.Period)
+	}
+	return ""
+}
+
+// Whether the scan's go routine passes this envelope on. Time slices go by the message time, so a replay
+// is sliced the same way as the original
+func (s *ScanEngine) keepSample(sampling Sampling, random *rand.Rand) bool {
+	seen := atomic.AddUint64(&s.sampleSeen, 1)
+
+	keep := true
+	switch sampling.Mode {
+	case "1in":
+		keep = seen%sampling.N == 0
+	case "random":
+		keep = random.Float64() < sampling.Fraction
+	case "slice":
+		keep = time.Duration(s.messageTime.UnixNano())%sampling.Period < sampling.On
+	}
+	if keep {
+		atomic.AddUint64(&s.sampleKept, 1)
+	}
+	return keep
+}
+
+/******************************************************************************************/
+
+// A count scaled up from a sample, with its 95% confidence interval. Without sampling it is exact. A scaled
+// sum or rate has no interval, its Low and High are its Value
+type Estimate struct {
+	Value   float64
+	Low     float64
+	High    float64
+	Sampled bool
+}
+
+// The envelopes that could be sampled and the ones kept, over every scan of the run
+func (s *ScanEngine) SampleCounts() (seen, kept uint64) {
+	return atomic.LoadUint64(&s.sampleSeen), atomic.LoadUint64(&s.sampleKept)
+}
+
+func (s *ScanEngine) Sampled() bool {
+	seen, kept := s.SampleCounts()
+	return kept < seen
+}
+
+// Scales a count of sampled envelopes by the fraction kept. Each envelope is treated as kept independently,
+// so the interval is the binomial one; for time slices of bursty traffic the real spread is wider
+func (s *ScanEngine) Estimate(count int) Estimate {
+	seen, kept := s.SampleCounts()
+	if kept == seen || seen == 0 {
+		return Estimate{Value: float64(count), Low: float64(count), High: float64(count)}
+	}
+	// there can't have been more than every envelope that could be sampled
+	if kept == 0 {
+		return Estimate{High: float64(seen), Sampled: true}
+	}
+
+	p := float64(kept) / float64(seen)
+	k := float64(count)
+	e := Estimate{Value: k / p, Sampled: true}
+
+	if count == 0 {
+		// nothing in the sample, the rule of three gives the upper bound
+		e.High = 3 / p
+	} else {
+		margin := 1.96 * math.Sqrt(k*(1-p)) / p
+		e.Low = math.Max(k, e.Value-margin)
+		e.High = e.Value + margin
+	}
+	e.High = math.Min(e.High, float64(seen))
+	return e
+}
+
+// Scales a sum or rate over the sampled envelopes by the fraction kept. Unlike a count of envelopes it can be
+// more than the envelopes seen, and the binomial interval doesn't hold for it, so it is the value alone
+func (s *ScanEngine) Scale(sum int) Estimate {
+	seen, kept := s.SampleCounts()
+	if kept == seen || seen == 0 {
+		return Estimate{Value: float64(sum), Low: float64(sum), High: float64(sum)}
+	}
+	e := Estimate{Sampled: true}
+	if kept > 0 {
+		e.Value = float64(sum) * float64(seen) / float64(kept)
+	}
+	e.Low, e.High = e.Value, e.Value
+	return e
+}
+
+// The estimate with an exact count, of envelopes that aren't sampled, added
+func (e Estimate) Plus(exact int) Estimate {
+	n := float64(exact)
+	return Estimate{Value: e.Value + n, Low: e.Low + n, High: e.High + n, Sampled: e.Sampled}
+}
+
+// e.g. 1234, or ~12300 (11800-12800) for an estimate, ~12300 for a scaled sum
+func (e Estimate) String() string {
+	if !e.Sampled || e.Low == e.High {
+		return e.Short()
+	}
+	return fmt.Sprintf("~%.0f (%.0f-%.0f)", e.Value, e.Low, e.High)
+}
+
+// The number alone, ~ marking an estimate
+func (e Estimate) Short() string {
+	if !e.Sampled {
+		return strconv.FormatFloat(e.Value, 'f', 0, 64)
+	}
+	return fmt.Sprintf("~%.0f", e.Value)
+}
+
+// After a histogram of a sampled run, whose bin counts are of the sample alone
+func (s *ScanEngine) WriteHistogramEstimate(ow io.Writer, samples int) {
+	if !s.Sampled() {
+		return
+	}
+	fmt.Fprintf(ow, "Estimated N %s, the counts above are of the sample, the percentages are estimates for every envelope\n", s.Estimate(samples))
+}
+
+// A line for reports of a sampled run, saying their numbers are estimates
+func (s *ScanEngine) WriteSampling(ow io.Writer) {
+	seen, kept := s.SampleCounts()
+	if kept == seen {
+		return
+	}
+	s.mutex.Lock()
+	sampling := s.sampling
+	s.mutex.Unlock()
+
+	fmt.Fprintf(ow, "SAMPLED %s, kept %d of %d envelopes (%.2f%%): ~ numbers are estimates for every envelope, with 95%% confidence intervals\n", sampling, kept, seen, 100*float64(kept)/float64(seen))
+}
@@ -0,0 +1,23 @@
+package scanengine
+
+import "testing"
+
+// A count of envelopes can't be more than the envelopes seen, a sum or a rate over them can
+func TestEstimateAndScale(t *testing.T) {
+	s := &ScanEngine{sampleSeen: 100, sampleKept: 10}
+
+	if e := s.Estimate(10); e.Value != 100 || e.High != 100 || e.Low >= e.Value {
+		t.Errorf("Estimate(10) is %s, want 100 with the high end clamped to the 100 seen", e)
+	}
+	if e := s.Scale(500); e.Value != 5000 || e.Low != 5000 || e.High != 5000 || e.String() != "~5000" {
+		t.Errorf("Scale(500) is %s, want ~5000 without an interval", e)
+	}
+	if e := s.Estimate(5).Plus(3); e.Value != 53 || e.String() != "~53 (11-95)" {
+		t.Errorf("Estimate(5).Plus(3) is %s, want ~53 (11-95)", e)
+	}
+
+	s = &ScanEngine{sampleSeen: 100, sampleKept: 100}
+	if e := s.Scale(500); e.Sampled || e.String() != "500" {
+		t.Errorf("Scale(500) without sampling is %s, want 500", e)
+	}
+}
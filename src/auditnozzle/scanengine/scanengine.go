@@ -3,13 +3,18 @@ package scanengine
 import (
 	"auditnozzle/firehose"
 	"auditnozzle/helpers"
+	"context"
 	"errors"
 	"fmt"
 	"github.com/cloudfoundry/sonde-go/events"
 	"io"
+	"math/rand"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -18,130 +23,811 @@ import (
  */
 
 type ScanEngine struct {
-	Name           string
+	Name       string
+	Foundation *firehose.Foundation
+
+	// guards the state below, which the scan's go routine writes while http handlers read it
+	mutex          sync.Mutex
 	runtime        time.Duration
 	running        bool
-	TotalRuntime   time.Duration
-	StartTime      time.Time
-	CurrentRuntime time.Duration
-	RuntimeSoFar   time.Duration
-	firehose       <-chan *events.Envelope
+	totalRuntime   time.Duration
+	startTime      time.Time
+	endTime        time.Time
+	currentRuntime time.Duration
+	source         firehose.Source
+	replay         string
+	disconnects    []firehose.Disconnect
+	received       uint64
+	dropped        uint64
+	shards         int
+
+	// cancelled by Cancel(), or when the runtime is up
+	ctx        context.Context
+	cancel     context.CancelFunc
+	done       chan struct{}
+	stopReason string
+
+	// called when a scan ends by itself or is cancelled, see SetOnStop
+	onStop func()
+
+	// restored from a save taken while a scan was running, so the results cover less than the runtime asked for
+	partial bool
+
+	// count=, bytes= and until=, which can end a scan before its runtime is up
+	limits Limits
+	until  func() bool
+
+	// set by a scanner that supports until=, returns the check for the named condition
+	UntilCondition func(cond string) (func() bool, error)
+
+	// envelopes the iterator used this scan and their size, written by the scan's go routine
+	matched      uint64
+	matchedBytes uint64
+
+	// envelope rates, iterator times and the backlog, see throughput.go
+	delay      time.Duration
+	throughput throughput
+
+	// set by a scanner that supports sample=, true for the envelopes that can be left out. See sampling.go
+	Sampleable func(*events.Envelope) bool
+	sampling   Sampling
+	sampleSeen uint64
+	sampleKept uint64
+
+	// set by a scanner for its own columns in the time series, see series.go and Record
+	SeriesColumns []SeriesColumn
+	series        series
+
+	// only used by the scan's go routine
+	messageTime time.Time
 }
 
-type Scanner interface {
-	Start(req *http.Request, res io.Writer)
-	Stop()
-	UpdateTime()
-	Run(iterator func(*events.Envelope))
-	WriteStatus(ow io.Writer)
+/******************************************************************************************/
+
+// runtime=, 10m without it
+func GetRuntime(req *http.Request) (time.Duration, error) {
+
+	parm := req.FormValue("runtime")
+	if parm == "" {
+		return 10 * time.Minute, nil
+	}
+	runtime, err := time.ParseDuration(parm)
+	if err != nil || runtime <= 0 {
+		return 0, fmt.Errorf("runtime=%s is not a positive duration such as 30s, 10m or 2h", parm)
+	}
+	return runtime, nil
 }
 
-/******************************************************************************************/
+// Stop conditions besides the runtime, which still bounds the scan. Zero or empty for none
+type Limits struct {
+	Count uint64
+	Bytes uint64
+	Until string
+}
+
+// count=<envelopes> and bytes=<size> count only the envelopes the scanner uses, e.g. log messages for the
+// log histogram. until= is checked by the scanner, see UntilCondition
+func GetLimits(req *http.Request) (Limits, error) {
+	var limits Limits
+
+	if parm := req.FormValue("count"); parm != "" {
+		count, err := strconv.ParseUint(parm, 10, 64)
+		if err != nil || count == 0 {
+			return limits, fmt.Errorf("count=%s is not a positive number of envelopes", parm)
+		}
+		limits.Count = count
+	}
+
+	if parm := req.FormValue("bytes"); parm != "" {
+		size, err := ParseBytes(parm)
+		if err != nil {
+			return limits, err
+		}
+		limits.Bytes = size
+	}
 
-func GetRuntime(req *http.Request) time.Duration {
+	limits.Until = req.FormValue("until")
+	return limits, nil
+}
 
-	runtime, err := time.ParseDuration(req.FormValue("runtime"))
-	if runtime == 0 || err != nil {
-		runtime = 10 * time.Minute
+// A number of bytes with an optional K, M or G (or KB, MB, GB) suffix, in 1024s
+func ParseBytes(parm string) (uint64, error) {
+	num := strings.ToUpper(strings.TrimSpace(parm))
+	num = strings.TrimSuffix(num, "B")
+
+	var unit uint64 = 1
+	switch {
+	case strings.HasSuffix(num, "K"):
+		unit = 1 << 10
+	case strings.HasSuffix(num, "M"):
+		unit = 1 << 20
+	case strings.HasSuffix(num, "G"):
+		unit = 1 << 30
+	}
+	if unit > 1 {
+		num = num[:len(num)-1]
 	}
-	return runtime
+
+	size, err := strconv.ParseUint(num, 10, 64)
+	if err != nil || size == 0 {
+		return 0, fmt.Errorf("bytes=%s is not a positive size such as 500000, 100K, 20M or 1G", parm)
+	}
+	return size * unit, nil
 }
 
+// The parameters every scanner takes, checked before a scan or a schedule is started
+func CheckParams(req *http.Request) error {
+	if _, err := GetRuntime(req); err != nil {
+		return err
+	}
+	if _, err := GetDelay(req); err != nil {
+		return err
+	}
+	if _, err := GetSampling(req); err != nil {
+		return err
+	}
+	if _, err := GetBucket(req); err != nil {
+		return err
+	}
+	_, err := GetLimits(req)
+	return err
+}
+
+// A running scan is stopped first, so its go routine isn't left adding to the cleared data
 func (s *ScanEngine) Reset() {
+	s.Cancel()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
 	s.runtime = 0
 	s.running = false
-	s.TotalRuntime = 0
-	s.CurrentRuntime = 0
-	s.RuntimeSoFar = 0
+	s.totalRuntime = 0
+	s.currentRuntime = 0
+	s.endTime = time.Time{}
+	s.source = nil
+	s.replay = ""
+	s.disconnects = nil
+	s.received = 0
+	s.dropped = 0
+	s.stopReason = ""
+	s.partial = false
+	s.limits = Limits{}
+	s.delay = 0
+	s.sampling = Sampling{}
+	atomic.StoreUint64(&s.sampleSeen, 0)
+	atomic.StoreUint64(&s.sampleKept, 0)
+	s.series.reset()
+	atomic.StoreUint64(&s.matched, 0)
+	atomic.StoreUint64(&s.matchedBytes, 0)
+	s.throughput.reset(0, nil, 0, false)
 
 }
 
 func (s *ScanEngine) Start(req *http.Request, res io.Writer) error {
-	var err error
 
+	// a bad parameter is an error rather than quietly replaced by a default
+	runtime, err := GetRuntime(req)
+	var limits Limits
+	if err == nil {
+		limits, err = GetLimits(req)
+	}
+	var delay time.Duration
+	if err == nil {
+		delay, err = GetDelay(req)
+	}
+	var sampling Sampling
+	if err == nil {
+		sampling, err = GetSampling(req)
+	}
+	if err == nil && sampling.Mode != "" && s.Sampleable == nil {
+		err = fmt.Errorf("sample= is not supported by the %s scanner", s.Name)
+	}
+	var bucket time.Duration
+	if err == nil {
+		bucket, err = GetBucket(req)
+	}
+	var until func() bool
+	if err == nil {
+		until, err = s.untilCheck(limits.Until)
+	}
+	if err != nil {
+		fmt.Fprintf(res, "%s: %v\n", s.Name, err)
+		return err
+	}
+
+	s.mutex.Lock()
 	if s.running {
-		fmt.Fprintf(res, "%s scanner already running, %s into a run of %s. ", s.Name, helpers.TimeStr(s.RuntimeSoFar), helpers.TimeStr(s.CurrentRuntime))
+		fmt.Fprintf(res, "%s scanner already running, %s into a run of %s. ", s.Name, helpers.TimeStr(s.runtimeSoFar()), helpers.TimeStr(s.currentRuntime))
+		s.mutex.Unlock()
 		return errors.New("scanner already running")
 	}
 
-	s.running = true
-	s.runtime = GetRuntime(req)
-
-	fmt.Fprintf(os.Stdout, "Starting %s: runtime %s\n", s.Name, s.runtime.String())
-	fmt.Fprintf(res, "%s: runtime %s\n", s.Name, s.runtime.String())
+	// the estimates scale the whole run by one fraction, so a continued run has to be sampled the same way
+	if s.totalRuntime > 0 && sampling != s.sampling {
+		s.mutex.Unlock()
+		err := fmt.Errorf("run was sampled as %q, continue it with the same sample=", s.sampling.String())
+		if s.sampling.Mode == "" {
+			err = errors.New("run wasn't sampled, continue it without sample=")
+		}
+		fmt.Fprintf(res, "%s: %v\n", s.Name, err)
+		return err
+	}
 
-	s.CurrentRuntime = s.runtime
-	s.StartTime = time.Now()
-	s.RuntimeSoFar = 0
+	if err := s.series.start(bucket, len(s.SeriesColumns)); err != nil {
+		s.mutex.Unlock()
+		fmt.Fprintf(res, "%s: %v\n", s.Name, err)
+		return err
+	}
 
-	s.firehose, err = firehose.OpenFirehose("auditnozzle-" + strings.Replace(s.Name, " ", "-", -1))
+	s.running = true
+	s.runtime = runtime
+	s.sampling = sampling
+	s.limits = limits
+	s.until = until
+	s.delay = delay
+	s.stopReason = ""
+	s.mutex.Unlock()
+	atomic.StoreUint64(&s.matched, 0)
+	atomic.StoreUint64(&s.matchedBytes, 0)
+
+	// not under the lock, opening the firehose can take a while and status should still answer
+	source, err := s.OpenSource(req, res)
 	if err != nil {
 		fmt.Fprintln(res, err)
 		fmt.Fprintln(os.Stderr, err)
+		s.mutex.Lock()
 		s.running = false
+		s.mutex.Unlock()
 		return err
 	}
 
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// a reset while the source was opening leaves nothing to run for
+	if !s.running {
+		source.Close()
+		fmt.Fprintf(res, "%s: reset while starting\n", s.Name)
+		return errors.New("scanner reset while starting")
+	}
+
+	s.source = source
+	s.shards = source.Shards()
+	s.startTime = time.Now()
+	s.throughput.reset(s.delay, helpers.NewBin(iterBinSize, iterBinMax), cap(source.Messages()), s.replay == "")
+
+	// the timeout is set after OpenSource, which can change the runtime for a replay
+	s.ctx, s.cancel = context.WithTimeout(context.Background(), s.runtime)
+	s.done = make(chan struct{})
+
+	bench := ""
+	if s.sampling.Mode != "" {
+		bench = ", sampled " + s.sampling.String()
+	}
+	if s.delay > 0 {
+		bench += ", benchmark delay " + s.delay.String()
+	}
+	fmt.Fprintf(os.Stdout, "Starting %s: runtime %s%s%s\n", s.Name, s.runtime.String(), s.limits, bench)
+	fmt.Fprintf(res, "%s: runtime %s%s%s\n", s.Name, s.runtime.String(), s.limits, bench)
+
+	s.currentRuntime = s.runtime
+
 	return nil
 }
 
+// The check for until=<cond>, nil without one
+func (s *ScanEngine) untilCheck(cond string) (func() bool, error) {
+	if cond == "" {
+		return nil, nil
+	}
+	if s.UntilCondition == nil {
+		return nil, fmt.Errorf("until= is not supported by the %s scanner", s.Name)
+	}
+	return s.UntilCondition(cond)
+}
+
+// e.g. ", stop after 1000 envelopes or after 20.0MB or until documented"
+func (l Limits) String() string {
+	var conds []string
+	if l.Count > 0 {
+		conds = append(conds, fmt.Sprintf("after %d envelopes", l.Count))
+	}
+	if l.Bytes > 0 {
+		conds = append(conds, "after "+helpers.BytesStr(l.Bytes))
+	}
+	if l.Until != "" {
+		conds = append(conds, "until "+l.Until)
+	}
+	if len(conds) == 0 {
+		return ""
+	}
+	return ", stop " + strings.Join(conds, " or ")
+}
+
+// replay=<capture file> reads a saved capture instead of the firehose, with pace=fast to read it as quickly
+// as the scanner can. Without a runtime= the replay runs to the end of the file
+func (s *ScanEngine) OpenSource(req *http.Request, res io.Writer) (firehose.Source, error) {
+
+	replayName := req.FormValue("replay")
+
+	s.mutex.Lock()
+	s.replay = replayName
+	s.mutex.Unlock()
+
+	if replayName == "" {
+		sub, err := s.Foundation.Subscribe(s.Name)
+		if err != nil {
+			return nil, err
+		}
+		return sub, nil
+	}
+
+	replay, err := firehose.OpenReplay(replayName, req.FormValue("pace") != "fast")
+	if err != nil {
+		return nil, err
+	}
+
+	if req.FormValue("runtime") == "" {
+		s.mutex.Lock()
+		s.runtime = replay.Span() + time.Minute
+		s.mutex.Unlock()
+	}
+
+	fmt.Fprintf(res, "%s: replaying %s, %s captured at %s\n", s.Name, replayName, helpers.TimeStr(replay.Span()), replay.First.Format(time.RFC3339))
+	return replay, nil
+}
+
+// Closing the source unsubscribes from the foundation's firehose, which is closed once no scanner is using it
 func (s *ScanEngine) Stop() {
-	s.TotalRuntime += s.CurrentRuntime
-	s.CurrentRuntime = 0
-	s.RuntimeSoFar = 0
+	if done := s.stop(); done != nil {
+		close(done)
+	}
+}
+
+// Returns the channel that Cancel waits on, for the caller to close
+func (s *ScanEngine) stop() chan struct{} {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.cancel != nil {
+		s.cancel()
+		s.cancel = nil
+	}
+	if s.source != nil {
+		s.disconnects = append(s.disconnects, s.source.Disconnects()...)
+		s.received += s.source.Received()
+		s.dropped += s.source.Dropped()
+		s.source.Close()
+		s.source = nil
+	}
+	// a scan that was stopped early only counts the time it ran
+	ran := time.Since(s.startTime)
+	if ran > s.currentRuntime {
+		ran = s.currentRuntime
+	}
+	s.totalRuntime += ran
+	s.currentRuntime = 0
 	s.running = false
+	s.endTime = time.Now()
+
+	done := s.done
+	s.done = nil
+	return done
 }
 
-func (s *ScanEngine) UpdateTime() {
-	s.RuntimeSoFar = time.Now().Sub(s.StartTime)
+// f is called at the end of every scan run by Run, after the scan has stopped but before a Cancel waiting
+// for it returns, so a reset can't clear the results first
+func (s *ScanEngine) SetOnStop(f func()) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.onStop = f
+}
+
+// Stops a running scan and waits for it to finish. Returns false if the scan wasn't running
+func (s *ScanEngine) Cancel() bool {
+	s.mutex.Lock()
+	cancel, done, running := s.cancel, s.done, s.running
+	s.mutex.Unlock()
 
+	if !running || cancel == nil {
+		return false
+	}
+
+	// the lock isn't held while waiting, the scan needs it to stop
+	cancel()
+	if done != nil {
+		<-done
+	}
+	return true
 }
 
-func (s *ScanEngine) Run(iterator func(*events.Envelope)) {
+func (s *ScanEngine) Running() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.running
+}
+
+// Total time scanned, including the part of a run still in progress
+func (s *ScanEngine) Runtime() time.Duration {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.totalRuntime + s.runtimeSoFar()
+}
 
-	fmt.Fprintf(os.Stdout, "Started acquiring data for %s with timer %s\n", s.Name, s.runtime.String())
+// Why the last run ended, empty while one is running
+func (s *ScanEngine) StopReason() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.stopReason
+}
 
-	s.RunIterator(iterator)
+// When the current or last scan started
+func (s *ScanEngine) Started() time.Time {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.startTime
+}
 
-	s.Stop()
+// When the last scan ended, zero if none has
+func (s *ScanEngine) Ended() time.Time {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.endTime
+}
 
-	fmt.Fprintf(os.Stdout, "Stopped %s\n", s.Name)
+// caller holds the mutex
+func (s *ScanEngine) runtimeSoFar() time.Duration {
+	if !s.running || s.cancel == nil {
+		return 0
+	}
+	soFar := time.Since(s.startTime)
+	if soFar > s.currentRuntime {
+		soFar = s.currentRuntime
+	}
+	return soFar
+}
 
+// The time the envelope being processed was received. Iterators use this rather than time.Now() so that
+// replayed captures give the same intervals and latencies as the original run
+func (s *ScanEngine) MessageTime() time.Time {
+	return s.messageTime
 }
 
-func (s *ScanEngine) RunIterator(iterator func(*events.Envelope)) {
+// The iterator returns whether it used the envelope, which is what count= and bytes= count
+func (s *ScanEngine) Run(iterator func(*events.Envelope) bool) {
 
-	timer := time.NewTimer(s.runtime)
-	for {
-		select {
-		case <-timer.C:
-			return
+	s.mutex.Lock()
+	runtime := s.runtime
+	s.mutex.Unlock()
+
+	fmt.Fprintf(os.Stdout, "Started acquiring data for %s with timer %s\n", s.Name, runtime.String())
 
-		default:
-			msg := <-s.firehose
-			s.UpdateTime()
+	reason := s.RunIterator(iterator)
+	s.series.end()
 
-			iterator(msg)
+	s.mutex.Lock()
+	s.stopReason = reason
+	onStop := s.onStop
+	s.mutex.Unlock()
+
+	done := s.stop()
+	if onStop != nil {
+		onStop()
+	}
+	if done != nil {
+		close(done)
+	}
+
+	fmt.Fprintf(os.Stdout, "Stopped %s: %s\n", s.Name, reason)
+
+}
+
+// Waits on the source and the context together, so a quiet firehose doesn't hold the scan past its runtime.
+// Once a second the throughput is sampled and an until= condition is checked, rather than on every envelope.
+// Returns why the scan ended
+func (s *ScanEngine) RunIterator(iterator func(*events.Envelope) bool) string {
+
+	s.mutex.Lock()
+	source, ctx, limits, until, delay := s.source, s.ctx, s.limits, s.until, s.delay
+	sampling, sampleable := s.sampling, s.Sampleable
+	s.mutex.Unlock()
+
+	var random *rand.Rand
+	if sampling.Mode == "random" {
+		random = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	iterTime := s.throughput.histogram()
+	interval := s.series.bucketInterval()
+
+	// the engine's own counts for each envelope are kept here and added once a second, so the envelope
+	// loop doesn't take a lock for them. The series counts also go in when the envelopes' bucket changes.
+	// What the scanner records takes the series lock
+	var processed uint64
+	var waiting, busy time.Duration
+	var iterTimes []int
+	var counted seriesCount
+	messages := source.Messages()
+	flush := func(end bool) {
+		s.sampleThroughput(processed, waiting, busy, len(messages), end)
+		processed, waiting, busy = 0, 0, 0
+		iterTime.InsertSamples(iterTimes)
+		iterTimes = iterTimes[:0]
+		s.series.flush(&counted)
+	}
+	defer flush(true)
+
+	for {
+		waitStart := time.Now()
+
+		select {
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				return "runtime reached"
+			}
+			return "stopped"
+
+		case <-ticker.C:
+			flush(false)
+
+			if until != nil && until() {
+				return "until " + limits.Until + " met"
+			}
+
+		case msg, ok := <-messages:
+			if !ok {
+				return "end of source"
+			}
+			iterStart := time.Now()
+			waiting += iterStart.Sub(waitStart)
+
+			s.messageTime = source.ReceiveTime(msg)
+			s.series.envelope(&counted, interval, s.messageTime)
+
+			if sampling.Mode != "" && sampleable(msg) && !s.keepSample(sampling, random) {
+				counted.add(false)
+				processed++
+				continue
+			}
+
+			if delay > 0 {
+				benchmarkDelay(delay)
+			}
+			used := iterator(msg)
+			counted.add(used)
+
+			took := time.Since(iterStart)
+			busy += took
+			iterTimes = append(iterTimes, int(took/time.Microsecond))
+			processed++
+
+			if !used {
+				continue
+			}
+			matched := atomic.AddUint64(&s.matched, 1)
+			size := atomic.AddUint64(&s.matchedBytes, uint64(msg.Size()))
+
+			if limits.Count > 0 && matched >= limits.Count {
+				return "count reached"
+			}
+			if limits.Bytes > 0 && size >= limits.Bytes {
+				return "bytes reached"
+			}
 		}
 	}
 }
 
+// The envelopes the scanner used in the current or last scan, and their size
+func (s *ScanEngine) Matched() (count, bytes uint64) {
+	return atomic.LoadUint64(&s.matched), atomic.LoadUint64(&s.matchedBytes)
+}
+
 func (s *ScanEngine) WriteStatus(ow io.Writer) {
-	if s.running {
-		fmt.Fprintf(ow, "%-20s %s|%s ", s.Name, helpers.TimeStr(s.RuntimeSoFar), helpers.TimeStr(s.CurrentRuntime))
+	s.mutex.Lock()
+	running, soFar, current, total := s.running, s.runtimeSoFar(), s.currentRuntime, s.totalRuntime
+	replay, reason, limits, sampling := s.replay, s.stopReason, s.limits, s.sampling
+	s.mutex.Unlock()
+
+	if running {
+		fmt.Fprintf(ow, "%-20s %s|%s ", s.Name, helpers.TimeStr(soFar), helpers.TimeStr(current))
 	} else {
 		fmt.Fprintf(ow, "%-20s -- -- --|-- -- -- ", s.Name)
 	}
 
-	fmt.Fprintf(ow, "(%s)\n", helpers.TimeStr(s.TotalRuntime+s.RuntimeSoFar))
+	fmt.Fprintf(ow, "(%s)", helpers.TimeStr(total+soFar))
+	if replay != "" {
+		fmt.Fprintf(ow, " replay of %s", replay)
+	}
+	if sampling.Mode != "" {
+		fmt.Fprintf(ow, " sampled %s", sampling)
+	}
+	if running {
+		s.writeLimits(ow, limits)
+	}
+	if !running && reason != "" {
+		fmt.Fprintf(ow, " %s", reason)
+	}
+	if s.Partial() {
+		fmt.Fprint(ow, " (partial)")
+	}
+	fmt.Fprintln(ow)
 
+	s.WriteThroughput(ow)
+	s.WriteDropped(ow)
+	s.WriteDisconnects(ow)
 }
 
-func (s *ScanEngine) AppName(guid string) string {
+// progress towards count= and bytes=
+func (s *ScanEngine) writeLimits(ow io.Writer, limits Limits) {
+	matched, size := s.Matched()
+	if limits.Count > 0 {
+		fmt.Fprintf(ow, " %d|%d envelopes", matched, limits.Count)
+	}
+	if limits.Bytes > 0 {
+		fmt.Fprintf(ow, " %s|%s", helpers.BytesStr(size), helpers.BytesStr(limits.Bytes))
+	}
+	if limits.Until != "" {
+		fmt.Fprintf(ow, " until %s", limits.Until)
+	}
+}
 
-	name, err := firehose.AppName(guid)
-	if err != nil {
-		return fmt.Sprintf("error on name lookup %v\n", err)
+// Envelopes lost because this scanner fell behind the shared firehose and its buffer filled up
+func (s *ScanEngine) WriteDropped(ow io.Writer) {
+	received, dropped := s.Envelopes()
+	if dropped == 0 {
+		return
+	}
+	fmt.Fprintf(ow, "%-20s dropped %d of %d firehose envelopes (%.1f%%), scanner fell behind\n", "", dropped, received, 100*float64(dropped)/float64(received))
+}
+
+func (s *ScanEngine) Envelopes() (received, dropped uint64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	received, dropped = s.received, s.dropped
+	if s.source != nil {
+		received += s.source.Received()
+		dropped += s.source.Dropped()
+	}
+	return received, dropped
+}
+
+// Report the time the firehose was not delivering messages, so the numbers in a report can be judged
+// against how much of the run was actually observed
+func (s *ScanEngine) WriteDisconnects(ow io.Writer) {
+
+	disconnects := s.Disconnects()
+	if len(disconnects) == 0 {
+		return
+	}
+
+	s.mutex.Lock()
+	shards := s.shards
+	s.mutex.Unlock()
+
+	// a disconnected shard only loses its share of the subscription
+	total := s.Runtime() * time.Duration(shards)
+	downtime := firehose.Downtime(disconnects)
+
+	observed := 100.0
+	if total > 0 && downtime < total {
+		observed = 100 * float64(total-downtime) / float64(total)
+	} else if total > 0 {
+		observed = 0
+	}
+
+	fmt.Fprintf(ow, "%-20s firehose disconnects %d, not observed %s, observed %.1f%% of run\n", "", len(disconnects), helpers.TimeStr(downtime), observed)
+
+	for _, d := range disconnects {
+		gap := helpers.TimeStr(d.Gap)
+		if d.Open {
+			gap += " (reconnecting)"
+		}
+		fmt.Fprintf(ow, "%-20s   shard %d %s gap %s: %s\n", "", d.Shard, d.Time.Format(time.RFC3339), gap, d.Reason)
 	}
-	return name
+}
+
+func (s *ScanEngine) Disconnects() []firehose.Disconnect {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var disconnects []firehose.Disconnect
+
+	disconnects = append(disconnects, s.disconnects...)
+	if s.source != nil {
+		disconnects = append(disconnects, s.source.Disconnects()...)
+	}
+	return disconnects
+}
+
+/******************************************************************************************/
+// saving the engine's totals across a restart, see persist.go
+
+type EngineState struct {
+	TotalRuntime time.Duration
+	Started      time.Time
+	Ended        time.Time
+	Replay       string
+	Disconnects  []firehose.Disconnect
+	Received     uint64
+	Dropped      uint64
+	Shards       int
+	StopReason   string
+	Running      bool
+	Partial      bool
+	Sampling     Sampling
+	SampleSeen   uint64
+	SampleKept   uint64
+	Series       SeriesData
+}
+
+// A running scan is saved with the time it has run so far
+func (s *ScanEngine) SaveState() EngineState {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	state := EngineState{
+		TotalRuntime: s.totalRuntime + s.runtimeSoFar(),
+		Started:      s.startTime,
+		Ended:        s.endTime,
+		Replay:       s.replay,
+		Disconnects:  append([]firehose.Disconnect(nil), s.disconnects...),
+		Received:     s.received,
+		Dropped:      s.dropped,
+		Shards:       s.shards,
+		StopReason:   s.stopReason,
+		Running:      s.running,
+		Partial:      s.partial,
+		Sampling:     s.sampling,
+		SampleSeen:   atomic.LoadUint64(&s.sampleSeen),
+		SampleKept:   atomic.LoadUint64(&s.sampleKept),
+		Series:       s.series.data(),
+	}
+	// a running scan ends, as far as the save is concerned, when it was saved
+	if s.running {
+		state.Ended = time.Now()
+	}
+	if s.source != nil {
+		state.Disconnects = append(state.Disconnects, s.source.Disconnects()...)
+		state.Received += s.source.Received()
+		state.Dropped += s.source.Dropped()
+	}
+	return state
+}
+
+// A scan that was running when the state was saved isn't restarted, it is marked partial
+func (s *ScanEngine) RestoreState(state EngineState) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.totalRuntime = state.TotalRuntime
+	s.startTime = state.Started
+	s.endTime = state.Ended
+	s.replay = state.Replay
+	s.disconnects = state.Disconnects
+	s.received = state.Received
+	s.dropped = state.Dropped
+	s.shards = state.Shards
+	s.stopReason = state.StopReason
+	s.partial = state.Partial
+	s.sampling = state.Sampling
+	atomic.StoreUint64(&s.sampleSeen, state.SampleSeen)
+	atomic.StoreUint64(&s.sampleKept, state.SampleKept)
+	s.series.restore(state.Series)
+
+	if state.Running {
+		s.partial = true
+		s.stopReason = "interrupted by restart"
+		s.series.end()
+	}
+}
+
+func (s *ScanEngine) Partial() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.partial
 }
@@ -0,0 +1,454 @@
+package scanengine
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+/********************************************************************************************************
+* A run's totals don't show whether the dropped messages came in one burst or were spread out, so every
+* scan also counts into time buckets, bucket=<duration> (default 1m) long. The engine counts the envelopes
+* read from the source and the ones the scanner used; a scanner adds its own columns, see SeriesColumns.
+*
+* Buckets go by the message time, so a replay has the same buckets as the original. A bucket that a scan
+* started or ended in covers less than the interval and is marked partial, peaks and troughs are taken from
+* the whole buckets. Reports show a sparkline and the peak and trough of each column, series=true shows every
+* bucket
+ */
+
+const (
+	defaultBucket = time.Minute
+	minBucket     = time.Second
+
+	// a week of 1m buckets, the oldest are dropped after that
+	maxBuckets = 7 * 24 * 60
+
+	// longer series are drawn with one character for several buckets
+	sparkWidth = 100
+)
+
+var sparkChars = []rune("▁▂▃▄▅▆▇█")
+
+// A scanner's own value in each bucket. Counts are the sum of what was recorded in the bucket, and are
+// scaled up for a sampled run unless they come from envelopes that are never sampled; an average column
+// shows the average of the values recorded
+type SeriesColumn struct {
+	Name    string
+	Average bool
+	Exact   bool
+}
+
+// What was recorded in a column in one bucket
+type SeriesValue struct {
+	Sum int64
+	N   int64
+	Max int64
+}
+
+type SeriesBucket struct {
+	Start     time.Time
+	Envelopes uint64
+	Used      uint64
+	Values    []SeriesValue
+	Partial   bool
+}
+
+// The buckets, saved with the engine's state
+type SeriesData struct {
+	Interval time.Duration
+	Buckets  []SeriesBucket
+}
+
+type series struct {
+	mutex    sync.Mutex
+	interval time.Duration
+	columns  int
+	buckets  []SeriesBucket
+
+	// the next envelope starts a new scan, the time since the last one isn't filled in with empty buckets
+	newScan bool
+}
+
+// bucket=<duration>, zero without it so a continued run keeps its interval
+func GetBucket(req *http.Request) (time.Duration, error) {
+	parm := req.FormValue("bucket")
+	if parm == "" {
+		return 0, nil
+	}
+	bucket, err := time.ParseDuration(parm)
+	if err != nil || bucket < minBucket {
+		return 0, fmt.Errorf("bucket=%s is not a duration of at least %s, such as 10s or 1m", parm, minBucket)
+	}
+	return bucket, nil
+}
+
+func (se *series) reset() {
+	se.mutex.Lock()
+	defer se.mutex.Unlock()
+
+	se.interval = 0
+	se.buckets = nil
+	se.newScan = false
+}
+
+// A new run takes bucket=, or the default. A continued run keeps its buckets, so it can't change their length
+func (se *series) start(interval time.Duration, columns int) error {
+	se.mutex.Lock()
+	defer se.mutex.Unlock()
+
+	if se.interval != 0 && interval != 0 && interval != se.interval {
+		return fmt.Errorf("run has %s buckets, continue it with bucket=%s or without bucket=", se.interval, se.interval)
+	}
+	if se.interval == 0 {
+		se.interval = interval
+	}
+	if se.interval == 0 {
+		se.interval = defaultBucket
+	}
+	se.columns = columns
+	se.newScan = true
+	return nil
+}
+
+// The scan's last bucket didn't run to its end
+func (se *series) end() {
+	se.mutex.Lock()
+	defer se.mutex.Unlock()
+
+	if n := len(se.buckets); n > 0 {
+		se.buckets[n-1].Partial = true
+	}
+	se.newScan = true
+}
+
+// The bucket for the message time, caller holds the mutex
+func (se *series) bucket(t time.Time) *SeriesBucket {
+	start := t.Truncate(se.interval)
+	n := len(se.buckets)
+
+	if n > 0 {
+		last := &se.buckets[n-1]
+
+		// an envelope received out of order is counted in the current bucket, as is the first envelope
+		// of a scan continuing a run in the bucket the last one ended in
+		if !start.After(last.Start) {
+			se.newScan = false
+			return last
+		}
+
+		// buckets without envelopes are filled in, they are troughs too. A gap too long to fill, which
+		// only a replay can have, starts afresh
+		gap := int(start.Sub(last.Start) / se.interval)
+		if !se.newScan && gap <= maxBuckets {
+			for b := last.Start.Add(se.interval); b.Before(start); b = b.Add(se.interval) {
+				se.add(b, false)
+			}
+		}
+	}
+
+	se.add(start, se.newScan || n == 0)
+	se.newScan = false
+	return &se.buckets[len(se.buckets)-1]
+}
+
+// caller holds the mutex
+func (se *series) add(start time.Time, partial bool) {
+	se.buckets = append(se.buckets, SeriesBucket{Start: start, Values: make([]SeriesValue, se.columns), Partial: partial})
+	if len(se.buckets) > maxBuckets {
+		se.buckets = se.buckets[len(se.buckets)-maxBuckets:]
+	}
+}
+
+// The envelopes the scan's go routine has counted in one bucket and not yet added, see flush
+type seriesCount struct {
+	time      time.Time // of the first envelope counted
+	start     time.Time // its bucket
+	envelopes uint64
+	used      uint64
+}
+
+// The bucket length of the scan, which doesn't change while it runs
+func (se *series) bucketInterval() time.Duration {
+	se.mutex.Lock()
+	defer se.mutex.Unlock()
+	return se.interval
+}
+
+// Called by the scan's go routine for every envelope before the scanner sees it, then c.add once it has.
+// The counts are kept in c while the envelopes are in the same bucket, so the lock is only taken when the
+// bucket changes and when the scan flushes them once a second
+func (se *series) envelope(c *seriesCount, interval time.Duration, t time.Time) {
+	start := t.Truncate(interval)
+	if c.envelopes > 0 && !start.Equal(c.start) {
+		se.flush(c)
+	}
+	if c.envelopes == 0 {
+		c.time, c.start = t, start
+	}
+}
+
+// Every envelope, used by the scanner or not
+func (c *seriesCount) add(used bool) {
+	c.envelopes++
+	if used {
+		c.used++
+	}
+}
+
+// Adds the counts to their bucket and clears them. A new bucket's counts are flushed before the scanner
+// records anything in it, so the buckets come out as if each envelope had been added as it was read
+func (se *series) flush(c *seriesCount) {
+	if c.envelopes == 0 {
+		return
+	}
+
+	se.mutex.Lock()
+	if se.interval != 0 {
+		b := se.bucket(c.time)
+		b.Envelopes += c.envelopes
+		b.Used += c.used
+	}
+	se.mutex.Unlock()
+
+	*c = seriesCount{}
+}
+
+func (se *series) data() SeriesData {
+	se.mutex.Lock()
+	defer se.mutex.Unlock()
+
+	data := SeriesData{Interval: se.interval, Buckets: make([]SeriesBucket, len(se.buckets))}
+	for i, b := range se.buckets {
+		b.Values = append([]SeriesValue(nil), b.Values...)
+		data.Buckets[i] = b
+	}
+	return data
+}
+
+func (se *series) restore(data SeriesData) {
+	se.mutex.Lock()
+	defer se.mutex.Unlock()
+
+	se.interval = data.Interval
+	se.buckets = data.Buckets
+	se.newScan = true
+}
+
+/******************************************************************************************/
+
+// Adds the value to the scanner's column in the bucket of the envelope being processed. Only called by the
+// iterator, from the scan's go routine
+func (s *ScanEngine) Record(column int, value int) {
+	se := &s.series
+	se.mutex.Lock()
+	defer se.mutex.Unlock()
+
+	if se.interval == 0 || column >= se.columns {
+		return
+	}
+	v := &se.bucket(s.messageTime).Values[column]
+	v.Sum += int64(value)
+	if v.N == 0 || int64(value) > v.Max {
+		v.Max = int64(value)
+	}
+	v.N++
+}
+
+// The run's buckets, oldest first
+func (s *ScanEngine) Series() SeriesData {
+	return s.series.data()
+}
+
+// One column of the series, as it is shown
+type seriesLine struct {
+	name   string
+	values []float64 // one per bucket
+	has    []bool    // an average column has no value for a bucket where nothing was recorded
+	format func(float64) string
+}
+
+func (s *ScanEngine) seriesLines(data SeriesData) []seriesLine {
+	sampled := s.Sampled()
+	exact := func(v float64) string { return fmt.Sprintf("%.0f", v) }
+	scaled := func(v float64) string { return s.Scale(int(v)).Short() }
+
+	lines := []seriesLine{{name: "envelopes", format: exact}, {name: "used", format: exact}}
+	for _, b := range data.Buckets {
+		lines[0].values = append(lines[0].values, float64(b.Envelopes))
+		lines[0].has = append(lines[0].has, true)
+		lines[1].values = append(lines[1].values, float64(b.Used))
+		lines[1].has = append(lines[1].has, true)
+	}
+
+	for c, column := range s.SeriesColumns {
+		line := seriesLine{name: column.Name, format: exact}
+		if column.Average {
+			line.name = "avg " + column.Name
+			line.format = func(v float64) string { return fmt.Sprintf("%.1f", v) }
+		} else if sampled && !column.Exact {
+			line.name = "~" + column.Name
+			line.format = scaled
+		}
+
+		// an average column also shows the highest value in each bucket
+		high := seriesLine{name: "max " + column.Name, format: exact}
+
+		for _, b := range data.Buckets {
+			var v SeriesValue
+			if c < len(b.Values) {
+				v = b.Values[c]
+			}
+			switch {
+			case column.Average && v.N > 0:
+				line.values = append(line.values, float64(v.Sum)/float64(v.N))
+				line.has = append(line.has, true)
+			case column.Average:
+				line.values = append(line.values, 0)
+				line.has = append(line.has, false)
+			default:
+				line.values = append(line.values, float64(v.Sum))
+				line.has = append(line.has, true)
+			}
+			high.values = append(high.values, float64(v.Max))
+			high.has = append(high.has, v.N > 0)
+		}
+		lines = append(lines, line)
+		if column.Average {
+			lines = append(lines, high)
+		}
+	}
+	return lines
+}
+
+// A sparkline and the peak and trough for each column, then every bucket if table is set
+func (s *ScanEngine) WriteSeries(ow io.Writer, table bool) {
+	data := s.Series()
+	if len(data.Buckets) == 0 {
+		return
+	}
+
+	lines := s.seriesLines(data)
+	partial := 0
+	for _, b := range data.Buckets {
+		if b.Partial {
+			partial++
+		}
+	}
+
+	fmt.Fprintf(ow, "Series of %d %s buckets from %s, %d partial\n", len(data.Buckets), data.Interval, data.Buckets[0].Start.Format(time.RFC3339), partial)
+	for _, line := range lines {
+		fmt.Fprintf(ow, "%-20s %s", line.name, sparkline(line.values))
+		if peak, trough, ok := peakAndTrough(data.Buckets, line); ok {
+			fmt.Fprintf(ow, "  peak %s at %s, trough %s at %s", line.format(line.values[peak]), bucketTime(data.Buckets[peak]),
+				line.format(line.values[trough]), bucketTime(data.Buckets[trough]))
+		}
+		fmt.Fprintln(ow)
+	}
+
+	if !table {
+		return
+	}
+
+	fmt.Fprintf(ow, "%-16s", "bucket")
+	for _, line := range lines {
+		fmt.Fprintf(ow, "|%12.12s ", line.name)
+	}
+	fmt.Fprintln(ow, "|")
+	for i, b := range data.Buckets {
+		mark := " "
+		if b.Partial {
+			mark = "*"
+		}
+		fmt.Fprintf(ow, "%s%-15s", mark, bucketTime(b))
+		for _, line := range lines {
+			value := "--"
+			if line.has[i] {
+				value = line.format(line.values[i])
+			}
+			fmt.Fprintf(ow, "|%12s ", value)
+		}
+		fmt.Fprintln(ow, "|")
+	}
+	fmt.Fprintln(ow, "* partial bucket, the scan started or ended in it")
+}
+
+// e.g. 10-18 14:05:10
+func bucketTime(b SeriesBucket) string {
+	return b.Start.Format("01-02 15:04:05")
+}
+
+// The buckets with the highest and lowest value, among the whole buckets if there are any
+func peakAndTrough(buckets []SeriesBucket, line seriesLine) (peak, trough int, ok bool) {
+	whole := false
+	for i, b := range buckets {
+		if !b.Partial && line.has[i] {
+			whole = true
+			break
+		}
+	}
+
+	peak, trough = -1, -1
+	for i, b := range buckets {
+		if !line.has[i] || (whole && b.Partial) {
+			continue
+		}
+		if peak < 0 || line.values[i] > line.values[peak] {
+			peak = i
+		}
+		if trough < 0 || line.values[i] < line.values[trough] {
+			trough = i
+		}
+	}
+	return peak, trough, peak >= 0
+}
+
+// Scaled between the lowest and highest value. With more values than fit, each character is the highest of
+// the buckets it covers, so a burst still shows
+func sparkline(values []float64) string {
+	if len(values) == 0 {
+		return ""
+	}
+
+	per := (len(values) + sparkWidth - 1) / sparkWidth
+	var points []float64
+	for i := 0; i < len(values); i += per {
+		high := values[i]
+		for _, v := range values[i:min(i+per, len(values))] {
+			if v > high {
+				high = v
+			}
+		}
+		points = append(points, high)
+	}
+
+	low, high := points[0], points[0]
+	for _, p := range points {
+		if p < low {
+			low = p
+		}
+		if p > high {
+			high = p
+		}
+	}
+
+	var spark strings.Builder
+	for _, p := range points {
+		i := 0
+		if high > low {
+			i = int((p - low) / (high - low) * float64(len(sparkChars)-1))
+		}
+		spark.WriteRune(sparkChars[i])
+	}
+	return spark.String()
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,53 @@
+package scanengine
+
+import (
+	"testing"
+	"time"
+)
+
+// Counts kept back by the scan's go routine land in the same buckets as the scanner's own values
+func TestSeriesCountsByBucket(t *testing.T) {
+	s := &ScanEngine{Name: "series"}
+	if err := s.series.start(time.Minute, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	base := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	var counted seriesCount
+	read := func(offset time.Duration, used bool) {
+		s.messageTime = base.Add(offset)
+		s.series.envelope(&counted, time.Minute, s.messageTime)
+		if used {
+			s.Record(0, 1)
+		}
+		counted.add(used)
+	}
+
+	read(10*time.Second, true)
+	read(20*time.Second, false)
+	read(70*time.Second, true)
+	s.series.flush(&counted)
+	read(80*time.Second, true)
+	read(50*time.Second, true) // late, counted in the current bucket
+	read(190*time.Second, false)
+	s.series.flush(&counted)
+
+	want := []SeriesBucket{
+		{Envelopes: 2, Used: 1, Values: []SeriesValue{{Sum: 1, N: 1, Max: 1}}},
+		{Envelopes: 3, Used: 3, Values: []SeriesValue{{Sum: 3, N: 3, Max: 1}}},
+		{},
+		{Envelopes: 1},
+	}
+	buckets := s.Series().Buckets
+	if len(buckets) != len(want) {
+		t.Fatalf("%d buckets, want %d: %+v", len(buckets), len(want), buckets)
+	}
+	for i, b := range buckets {
+		if b.Envelopes != want[i].Envelopes || b.Used != want[i].Used {
+			t.Errorf("bucket %d has %d envelopes, %d used, want %d and %d", i, b.Envelopes, b.Used, want[i].Envelopes, want[i].Used)
+		}
+		if len(want[i].Values) > 0 && b.Values[0] != want[i].Values[0] {
+			t.Errorf("bucket %d recorded %+v, want %+v", i, b.Values[0], want[i].Values[0])
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package scanengine
+
+import (
+	"auditnozzle/helpers"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+/********************************************************************************************************
+* Whether a scanner is keeping up with its source. The scan's go routine times the iterator on every
+* envelope and, once a second, samples the envelopes received and processed and the backlog in the
+* source's buffer. A live scan that drops envelopes, or whose backlog keeps growing past half the buffer,
+* has fallen behind, which is logged and shown in /status until it catches up.
+*
+* delay=<duration> is a benchmark mode, it adds the delay to every envelope before the iterator, to find the
+* rate where the nozzle starts to lose data
+ */
+
+const (
+	// envelopes/sec is averaged over this many one second samples
+	throughputWindow = 10
+
+	// iterator times in microseconds, 5us bins up to 20ms
+	iterBinSize = 5
+	iterBinMax  = 20000
+
+	// backlog, as a fraction of the buffer, that counts as falling behind if it keeps growing, and that
+	// has to be cleared to catch up
+	behindBacklog   = 0.5
+	caughtUpBacklog = 0.1
+	growingSamples  = 3
+)
+
+type rateSample struct {
+	time      time.Time
+	received  uint64
+	processed uint64
+	dropped   uint64
+	backlog   int
+}
+
+type throughput struct {
+	mutex sync.Mutex
+
+	delay    time.Duration
+	iterTime *helpers.HistogramBin
+	samples  []rateSample
+
+	processed   uint64
+	waiting     time.Duration
+	busy        time.Duration
+	backlog     int
+	backlogCap  int
+	peakBacklog int
+	blocked     time.Duration
+
+	// only for live sources, a replay waits for the scanner instead of dropping
+	detect       bool
+	behind       bool
+	behindSince  time.Time
+	behindReason string
+	behindCount  int
+	behindRate   float64 // envelopes/sec processed when it first fell behind
+	peakRate     float64
+}
+
+// delay=<duration> for the benchmark mode, none without it
+func GetDelay(req *http.Request) (time.Duration, error) {
+	parm := req.FormValue("delay")
+	if parm == "" {
+		return 0, nil
+	}
+	delay, err := time.ParseDuration(parm)
+	if err != nil || delay <= 0 {
+		return 0, fmt.Errorf("delay=%s is not a positive duration such as 50us or 2ms", parm)
+	}
+	return delay, nil
+}
+
+// For a new scan, or with a nil histogram to clear it
+func (t *throughput) reset(delay time.Duration, iterTime *helpers.HistogramBin, backlogCap int, detect bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.delay, t.iterTime, t.backlogCap, t.detect = delay, iterTime, backlogCap, detect
+	t.samples = nil
+	t.processed, t.waiting, t.busy, t.blocked = 0, 0, 0, 0
+	t.backlog, t.peakBacklog = 0, 0
+	t.behind, t.behindSince, t.behindReason, t.behindCount, t.behindRate = false, time.Time{}, "", 0, 0
+	t.peakRate = 0
+}
+
+func (t *throughput) histogram() *helpers.HistogramBin {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.iterTime
+}
+
+// A short sleep can take much longer than asked for, so delays under a millisecond spin
+func benchmarkDelay(delay time.Duration) {
+	if delay >= time.Millisecond {
+		time.Sleep(delay)
+		return
+	}
+	for start := time.Now(); time.Since(start) < delay; {
+	}
+}
+
+// Adds what the scan's go routine counted since the last sample. Called once a second and at the end
+func (s *ScanEngine) sampleThroughput(processed uint64, waiting, busy time.Duration, backlog int, end bool) {
+	t := &s.throughput
+
+	s.mutex.Lock()
+	source := s.source
+	s.mutex.Unlock()
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.processed += processed
+	t.waiting += waiting
+	t.busy += busy
+	t.backlog = backlog
+	if backlog > t.peakBacklog {
+		t.peakBacklog = backlog
+	}
+	if source == nil {
+		return
+	}
+	t.blocked = source.Blocked()
+	if end {
+		// a scan that has stopped isn't behind any more, the count of times it fell behind stays
+		t.behind = false
+		return
+	}
+
+	sample := rateSample{time: time.Now(), received: source.Received(), processed: t.processed, dropped: source.Dropped(), backlog: backlog}
+	t.samples = append(t.samples, sample)
+	if len(t.samples) > throughputWindow+1 {
+		t.samples = t.samples[1:]
+	}
+
+	_, processedRate := t.rates()
+	if processedRate > t.peakRate {
+		t.peakRate = processedRate
+	}
+	if t.detect {
+		s.checkBehind(t)
+	}
+}
+
+// caller holds t.mutex
+func (s *ScanEngine) checkBehind(t *throughput) {
+	n := len(t.samples)
+	if n < 2 {
+		return
+	}
+	last, prev := t.samples[n-1], t.samples[n-2]
+	dropping := last.dropped > prev.dropped
+
+	growing := n > growingSamples && float64(last.backlog) >= behindBacklog*float64(t.backlogCap)
+	for i := n - growingSamples; growing && i < n; i++ {
+		growing = t.samples[i].backlog > t.samples[i-1].backlog
+	}
+
+	if !t.behind && (dropping || growing) {
+		t.behind = true
+		t.behindSince = last.time
+		t.behindCount++
+		t.behindReason = "backlog growing"
+		if dropping {
+			t.behindReason = "dropping envelopes"
+		}
+		received, processed := t.rates()
+		if t.behindCount == 1 {
+			t.behindRate = processed
+		}
+		fmt.Fprintf(os.Stdout, "%s falling behind, %s: received %.0f/s processed %.0f/s backlog %d|%d\n", s.Name, t.behindReason, received, processed, last.backlog, t.backlogCap)
+		return
+	}
+
+	if t.behind && !dropping && float64(last.backlog) < caughtUpBacklog*float64(t.backlogCap) {
+		t.behind = false
+		fmt.Fprintf(os.Stdout, "%s caught up after %s\n", s.Name, helpers.TimeStr(last.time.Sub(t.behindSince)))
+	}
+}
+
+// envelopes/sec over the window, caller holds t.mutex
+func (t *throughput) rates() (received, processed float64) {
+	n := len(t.samples)
+	if n < 2 {
+		return 0, 0
+	}
+	first, last := t.samples[0], t.samples[n-1]
+	secs := last.time.Sub(first.time).Seconds()
+	if secs <= 0 {
+		return 0, 0
+	}
+	return float64(last.received-first.received) / secs, float64(last.processed-first.processed) / secs
+}
+
+// e.g. 35us, 1.2ms
+func microsStr(us int) string {
+	if us >= 1000 {
+		return fmt.Sprintf("%.1fms", float64(us)/1000)
+	}
+	return fmt.Sprintf("%dus", us)
+}
+
+func (s *ScanEngine) WriteThroughput(ow io.Writer) {
+	t := &s.throughput
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.iterTime == nil || t.processed == 0 {
+		return
+	}
+
+	received, processed := t.rates()
+	average := 0.0
+	if ran := t.waiting + t.busy; ran > 0 {
+		average = float64(t.processed) / ran.Seconds()
+	}
+	fmt.Fprintf(ow, "%-20s envelopes/sec received %.0f processed %.0f (average %.0f, peak %.0f)", "", received, processed, average, t.peakRate)
+	if t.delay > 0 {
+		fmt.Fprintf(ow, ", benchmark delay %s", t.delay)
+	}
+	fmt.Fprintln(ow)
+
+	d := t.iterTime.Data()
+	fmt.Fprintf(ow, "%-20s iterator 50th %s 90th %s 99th %s max %s\n", "", microsStr(d.Percentile(50)), microsStr(d.Percentile(90)), microsStr(d.Percentile(99)), microsStr(d.Highest))
+
+	fmt.Fprintf(ow, "%-20s backlog %d|%d (peak %d), waiting for envelopes %s, busy %s, source blocked %s\n", "", t.backlog, t.backlogCap, t.peakBacklog, helpers.TimeStr(t.waiting), helpers.TimeStr(t.busy), helpers.TimeStr(t.blocked))
+
+	if t.behind {
+		fmt.Fprintf(ow, "%-20s FALLING BEHIND since %s, %s\n", "", t.behindSince.Format(time.RFC3339), t.behindReason)
+	}
+	if t.behindCount > 0 {
+		fmt.Fprintf(ow, "%-20s fell behind %d time(s), first at %.0f envelopes/sec processed\n", "", t.behindCount, t.behindRate)
+	}
+}
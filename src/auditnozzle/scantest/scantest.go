@@ -0,0 +1,104 @@
+package scantest
+
+import (
+	"auditnozzle/fakecf"
+	"auditnozzle/firehose"
+	"auditnozzle/scanengine"
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+/********************************************************************************************************
+* Helpers for the scanners' tests: a fake foundation to scan, a run of the scanner against it, and its reports
+ */
+
+// A fake foundation playing the script, with the default apps, spaces and orgs, as the default foundation
+func StartFakeCF(t *testing.T, script fakecf.Script) (*fakecf.Server, *firehose.Foundation) {
+	server := fakecf.NewServer(script)
+	for _, app := range fakecf.DefaultApps {
+		server.AddApp(app)
+	}
+	for _, space := range fakecf.DefaultSpaces {
+		server.AddSpace(space)
+	}
+	for _, org := range fakecf.DefaultOrgs {
+		server.AddOrg(org)
+	}
+
+	f := &firehose.Foundation{
+		Name:           "test",
+		Credentials:    firehose.Credentials{ApiEndpoint: server.CC.URL, UserName: "admin", Password: "admin"},
+		SubscriptionId: t.Name(),
+	}
+	firehose.SetFoundations(f.Name, f)
+	return server, f
+}
+
+func Measure(t *testing.T, s scanengine.Scanner, f *firehose.Foundation, query string) *scanengine.Run {
+	t.Helper()
+
+	var out bytes.Buffer
+	run, err := scanengine.NewRun(s, f, httptest.NewRequest("GET", "/"+s.Measure+"?"+query, nil), &out)
+	if err != nil {
+		t.Fatalf("%v: %s", err, out.String())
+	}
+	return run
+}
+
+func WaitEnded(t *testing.T, run *scanengine.Run) {
+	t.Helper()
+
+	for deadline := time.Now().Add(10 * time.Second); run.Results.Engine().Running(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("run %s still running", run.ID)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func Report(s scanengine.Scanner, run *scanengine.Run, route, query string) string {
+	var out bytes.Buffer
+	for _, r := range s.Reports {
+		if r.Route == route {
+			r.Write(run.Results, httptest.NewRequest("GET", "/"+route+"?"+query, nil), &out)
+		}
+	}
+	return out.String()
+}
+
+// The report once it has every line wanted, as fields, failing the test if it doesn't in time. Names are
+// looked up after the envelopes are counted, so a report can take a while to show them
+func WaitReport(t *testing.T, s scanengine.Scanner, run *scanengine.Run, route, query string, want ...[]string) string {
+	t.Helper()
+
+	var text string
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		text = Report(s, run, route, query)
+		if missing := MissingLines(text, want); len(missing) == 0 {
+			return text
+		}
+	}
+	t.Errorf("%s is missing %q:\n%s", route, MissingLines(text, want), text)
+	return text
+}
+
+// The wanted lines, as fields, that aren't in the text
+func MissingLines(text string, want [][]string) [][]string {
+	var missing [][]string
+	for _, fields := range want {
+		found := false
+		for _, line := range strings.Split(text, "\n") {
+			if strings.Join(strings.Fields(line), " ") == strings.Join(fields, " ") {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, fields)
+		}
+	}
+	return missing
+}
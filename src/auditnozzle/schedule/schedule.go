@@ -0,0 +1,277 @@
+package schedule
+
+import (
+	"auditnozzle/firehose"
+	"auditnozzle/scanengine"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/********************************************************************************************************
+* Starts a scanner again and again with the same parameters, either every=<duration> or on a cron=<spec>,
+* instead of someone running the nightly audit by hand:
+*
+*   curl "<host>/schedule?scanner=metrics&cron=0 2 * * *&runtime=30m&foundation=prod"
+*
+* Every start is a new run, and when its scan ends a snapshot of its reports is kept in the run history
+ */
+
+type Schedule struct {
+	ID         string
+	Scanner    scanengine.Scanner
+	Foundation *firehose.Foundation
+	Params     url.Values // passed to the measure route
+	Every      time.Duration
+	Cron       *Cron
+	Created    time.Time
+
+	mutex   sync.Mutex
+	next    time.Time
+	starts  int
+	lastRun string
+	lastErr error
+	stop    chan struct{}
+	seq     int
+}
+
+var (
+	schedules      = make(map[string]*Schedule)
+	scheduleSeq    int
+	schedulesMutex sync.Mutex
+
+	// the schedule's own parameters, the rest go to the scanner
+	ownParams = []string{"scanner", "every", "cron", "run"}
+)
+
+/******************************************************************************************/
+
+// scanner=<name>, every=<duration> or cron=<spec>, foundation=<name>, and the scanner's parameters
+func NewSchedule(req *http.Request) (*Schedule, error) {
+
+	req.ParseForm()
+
+	scanner, ok := scanengine.LookupScanner(req.FormValue("scanner"))
+	if !ok {
+		return nil, fmt.Errorf("scanner= must be one of %s", strings.Join(scanengine.ScannerNames(), ", "))
+	}
+
+	f, err := firehose.FoundationFromRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// rather than finding out at the first start
+	if err := scanengine.CheckParams(req); err != nil {
+		return nil, err
+	}
+
+	s := &Schedule{
+		Scanner:    scanner,
+		Foundation: f,
+		Params:     make(url.Values),
+		Created:    time.Now(),
+		stop:       make(chan struct{}),
+	}
+
+	every, spec := req.FormValue("every"), req.FormValue("cron")
+	switch {
+	case every != "" && spec != "":
+		return nil, errors.New("give either every= or cron=, not both")
+	case every != "":
+		s.Every, err = time.ParseDuration(every)
+		if err != nil || s.Every < time.Minute {
+			return nil, fmt.Errorf("every=%s must be a duration of at least 1m", every)
+		}
+	case spec != "":
+		if s.Cron, err = ParseCron(spec); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("every=<duration> or cron=<spec> is required")
+	}
+
+	for k, v := range req.Form {
+		if !isOwnParam(k) {
+			s.Params[k] = append([]string(nil), v...)
+		}
+	}
+	return s, nil
+}
+
+func Add(s *Schedule) {
+	schedulesMutex.Lock()
+	scheduleSeq++
+	s.seq = scheduleSeq
+	s.ID = fmt.Sprintf("schedule-%d", scheduleSeq)
+	schedules[s.ID] = s
+	schedulesMutex.Unlock()
+
+	fmt.Fprintf(os.Stdout, "Schedule %s: %s on %s %s\n", s.ID, s.Scanner.Name, s.Foundation.Name, s.When())
+	go s.loop()
+}
+
+func Delete(id string) error {
+	schedulesMutex.Lock()
+	defer schedulesMutex.Unlock()
+
+	s, ok := schedules[id]
+	if !ok {
+		return fmt.Errorf("no schedule %s", id)
+	}
+	close(s.stop)
+	delete(schedules, id)
+	return nil
+}
+
+// Oldest first
+func Schedules() []*Schedule {
+	schedulesMutex.Lock()
+	defer schedulesMutex.Unlock()
+
+	var list []*Schedule
+	for _, s := range schedules {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].seq < list[j].seq })
+	return list
+}
+
+/******************************************************************************************/
+
+func (s *Schedule) loop() {
+	for {
+		next := s.nextAfter(time.Now())
+		if next.IsZero() {
+			fmt.Fprintf(os.Stderr, "Schedule %s: %s never matches\n", s.ID, s.When())
+			return
+		}
+
+		s.mutex.Lock()
+		s.next = next
+		s.mutex.Unlock()
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-s.stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+			s.start()
+		}
+	}
+}
+
+// Fixed intervals count from when the schedule was made, so a slow start doesn't push the later ones back
+func (s *Schedule) nextAfter(t time.Time) time.Time {
+	if s.Cron != nil {
+		return s.Cron.Next(t)
+	}
+
+	s.mutex.Lock()
+	next := s.next
+	s.mutex.Unlock()
+
+	if next.IsZero() {
+		next = s.Created
+	}
+	for !next.After(t) {
+		next = next.Add(s.Every)
+	}
+	return next
+}
+
+func (s *Schedule) start() {
+	var out bytes.Buffer
+
+	req, err := http.NewRequest("GET", "/"+s.Scanner.Measure+"?"+s.Params.Encode(), nil)
+	if err == nil {
+		var run *scanengine.Run
+		run, err = scanengine.NewRun(s.Scanner, s.Foundation, req, &out)
+		if err == nil {
+			s.mutex.Lock()
+			s.lastRun = run.ID
+			s.mutex.Unlock()
+		}
+	}
+
+	s.mutex.Lock()
+	s.starts++
+	s.lastErr = err
+	s.mutex.Unlock()
+
+	fmt.Fprintf(os.Stdout, "Schedule %s: %s", s.ID, out.String())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Schedule %s: %v\n", s.ID, err)
+	}
+}
+
+func (s *Schedule) When() string {
+	if s.Cron != nil {
+		return "cron " + s.Cron.String()
+	}
+	return "every " + s.Every.String()
+}
+
+func (s *Schedule) WriteStatus(ow io.Writer) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	fmt.Fprintf(ow, "%-12s %-10s %-12s %-20s next %s, started %d times", s.ID, s.Scanner.Name, s.Foundation.Name, s.When(), s.next.Format(time.RFC3339), s.starts)
+	if s.lastRun != "" {
+		fmt.Fprintf(ow, ", last run %s", s.lastRun)
+	}
+	if s.lastErr != nil {
+		fmt.Fprintf(ow, ", last start failed: %v", s.lastErr)
+	}
+	fmt.Fprintf(ow, " %s\n", s.Params.Encode())
+}
+
+func isOwnParam(name string) bool {
+	for _, p := range ownParams {
+		if p == name {
+			return true
+		}
+	}
+	return false
+}
+
+/******************************************************************************************/
+
+func ScheduleResponse(req *http.Request, res io.Writer) {
+	s, err := NewSchedule(req)
+	if err != nil {
+		fmt.Fprintln(res, err)
+		return
+	}
+	Add(s)
+	fmt.Fprintf(res, "%s: %s on %s %s\n", s.ID, s.Scanner.Name, s.Foundation.Name, s.When())
+}
+
+func SchedulesResponse(res io.Writer) {
+	list := Schedules()
+	if len(list) == 0 {
+		fmt.Fprintln(res, "No schedules")
+		return
+	}
+	for _, s := range list {
+		s.WriteStatus(res)
+	}
+}
+
+func DeleteScheduleResponse(req *http.Request, res io.Writer) {
+	id := req.FormValue("id")
+	if err := Delete(id); err != nil {
+		fmt.Fprintln(res, err)
+		return
+	}
+	fmt.Fprintf(res, "%s deleted\n", id)
+}